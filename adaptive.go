@@ -0,0 +1,79 @@
+package detour
+
+import (
+	"sync"
+	"time"
+)
+
+var (
+	muAdaptiveTimeouts sync.Mutex
+	// grown first read timeouts of hosts which were wrongly detoured
+	adaptiveTimeouts = make(map[string]time.Duration)
+)
+
+// SetAdaptiveDetectionTimeout makes the first read timeout of a host grow once
+// it's found wrongly detoured, i.e. reachable directly when detected again
+// after InvalidateHost(), so hosts on slow links which respond just after the
+// timeout stop being detoured. Detecting again tries double the timeout, up to
+// max, and keeps it for the host if the direct connection works. 0 max, the
+// default, disables it.
+func SetAdaptiveDetectionTimeout(max time.Duration) {
+	UpdateConfig(func(c Config) Config {
+		c.AdaptiveDetectionTimeoutMax = max
+		return c
+	})
+}
+
+// ResetAdaptiveDetectionTimeouts forgets the timeouts grown so far.
+func ResetAdaptiveDetectionTimeouts() {
+	muAdaptiveTimeouts.Lock()
+	defer muAdaptiveTimeouts.Unlock()
+	adaptiveTimeouts = make(map[string]time.Duration)
+}
+
+func adaptedTimeout(addr string) time.Duration {
+	muAdaptiveTimeouts.Lock()
+	defer muAdaptiveTimeouts.Unlock()
+	return adaptiveTimeouts[hostOnly(addr)]
+}
+
+// firstReadTimeout returns how long to wait for the first read, which is
+// grown if the host was wrongly detoured, and grown further to probe if
+// detecting a whitelisted host again.
+func (dc *Conn) firstReadTimeout() time.Duration {
+	d := dc.cfg.firstReadTimeoutFor(dc.addr)
+	max := dc.cfg.AdaptiveDetectionTimeoutMax
+	if max <= 0 {
+		return d
+	}
+	if grown := adaptedTimeout(dc.addr); grown > d {
+		d = grown
+	}
+	if dc.redetecting && whitelisted(dc.whitelistAddr()) {
+		probe := 2 * d
+		if probe > max {
+			probe = max
+		}
+		if probe > d {
+			log.Tracef("Probing %s with first read timeout %v", dc.addr, probe)
+			dc.probeTimeout = probe
+			d = probe
+		}
+	}
+	return d
+}
+
+// keepProbeTimeout keeps the timeout probed with for the host, as the
+// direct connection worked with it.
+func (dc *Conn) keepProbeTimeout() {
+	if dc.probeTimeout <= 0 {
+		return
+	}
+	host := hostOnly(dc.addr)
+	muAdaptiveTimeouts.Lock()
+	defer muAdaptiveTimeouts.Unlock()
+	if dc.probeTimeout > adaptiveTimeouts[host] {
+		log.Debugf("%s was wrongly detoured, grow its first read timeout to %v", host, dc.probeTimeout)
+		adaptiveTimeouts[host] = dc.probeTimeout
+	}
+}
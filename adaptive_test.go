@@ -0,0 +1,39 @@
+package detour
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAdaptiveDetectionTimeout(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	defer ResetAdaptiveDetectionTimeouts()
+	setFirstReadTimeout(50 * time.Millisecond)
+	SetAdaptiveDetectionTimeout(150 * time.Millisecond)
+	defer SetAdaptiveDetectionTimeout(0)
+	detourAddr := newBannerServer("hello detour", 0)
+	// consistently responds just after the first read timeout
+	slowAddr := newBannerServer("hello direct", 80*time.Millisecond)
+	dialer := Dialer(dialTo(slowAddr), dialTo(detourAddr))
+
+	assert.Equal(t, "hello detour", readOnce(t, dialer, slowAddr), "should detour on timeout")
+	assert.EqualValues(t, 0, adaptedTimeout(slowAddr))
+	InvalidateHost(slowAddr)
+	assert.Equal(t, "hello direct", readOnce(t, dialer, slowAddr), "should probe with a longer timeout")
+	assert.Equal(t, 100*time.Millisecond, adaptedTimeout(slowAddr), "should grow the timeout once wrongly detoured")
+
+	RemoveFromWl(slowAddr)
+	assert.Equal(t, "hello direct", readOnce(t, dialer, slowAddr), "should not detour with the grown timeout")
+
+	AddToWl(slowAddr, false)
+	InvalidateHost(slowAddr)
+	assert.Equal(t, "hello direct", readOnce(t, dialer, slowAddr))
+	assert.Equal(t, 150*time.Millisecond, adaptedTimeout(slowAddr), "should grow up to the cap")
+	AddToWl(slowAddr, false)
+	InvalidateHost(slowAddr)
+	readOnce(t, dialer, slowAddr)
+	assert.Equal(t, 150*time.Millisecond, adaptedTimeout(slowAddr), "should not grow beyond the cap")
+}
@@ -0,0 +1,72 @@
+package detour
+
+import (
+	"context"
+	"errors"
+)
+
+// Attempt is a route tried by a connection, see Conn.AttemptLog().
+type Attempt struct {
+	// Route is "direct", "detour", or "proxy <ID>" for each proxy tried by
+	// the dialer returned by DialerWithProxies()
+	Route string
+	// Err is why the attempt failed, nil if it succeeded
+	Err error
+}
+
+var attemptLogKey = &contextKey{"attempt-log"}
+
+// AttemptLog returns the routes tried so far by this connection in order, e.g.
+// direct failed, proxy 1 failed, then proxy 2 succeeded, or nil if
+// SetDebugTimeline() was not enabled when dialing.
+func (dc *Conn) AttemptLog() []Attempt {
+	dc.muTimeline.Lock()
+	defer dc.muTimeline.Unlock()
+	if dc.attempts == nil {
+		return nil
+	}
+	return append([]Attempt(nil), dc.attempts...)
+}
+
+// attempt records an attempt if debugging this connection.
+func (dc *Conn) attempt(route string, err error) {
+	if !dc.debugging() {
+		return
+	}
+	dc.muTimeline.Lock()
+	dc.attempts = append(dc.attempts, Attempt{route, err})
+	dc.muTimeline.Unlock()
+}
+
+// attemptDirect records the outcome of detection as the direct attempt.
+func (dc *Conn) attemptDirect(outcome, reason string) {
+	if outcome == "direct" {
+		dc.attempt("direct", nil)
+	} else {
+		dc.attempt("direct", errors.New(reason))
+	}
+}
+
+// withAttemptLog returns a context for the detour dialer to record the
+// attempts it makes, see recordAttempt().
+func (dc *Conn) withAttemptLog(ctx context.Context) context.Context {
+	if !dc.debugging() {
+		return ctx
+	}
+	return context.WithValue(ctx, attemptLogKey, dc)
+}
+
+// recordAttempt records an attempt made by a detour dialer to the connection
+// which dials it, if debugging.
+func recordAttempt(ctx context.Context, route string, err error) {
+	if dc, _ := ctx.Value(attemptLogKey).(*Conn); dc != nil {
+		dc.attempt(route, err)
+	}
+}
+
+// numAttempts returns the number of attempts recorded so far.
+func (dc *Conn) numAttempts() int {
+	dc.muTimeline.Lock()
+	defer dc.muTimeline.Unlock()
+	return len(dc.attempts)
+}
@@ -0,0 +1,114 @@
+package detour
+
+import (
+	"encoding/csv"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how many records can be queued before new ones are dropped
+const auditQueueSize = 1000
+
+type auditRecord struct {
+	at       time.Time
+	host     string
+	outcome  string
+	reason   string
+	duration time.Duration
+}
+
+type auditLogger struct {
+	records chan auditRecord
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+var (
+	muAuditLog sync.Mutex
+	// instance of *auditLogger, nil if not set
+	auditLog atomic.Value
+)
+
+// SetAuditLog writes one CSV line per completed detection to w, with the
+// fields timestamp (RFC 3339), host, outcome (direct or detour), reason and
+// duration in milliseconds. Lines are written in background by a single
+// goroutine and dropped if w can't keep up. Pass nil to stop logging, which
+// blocks until the pending lines are written.
+func SetAuditLog(w io.Writer) {
+	muAuditLog.Lock()
+	defer muAuditLog.Unlock()
+	if l, _ := auditLog.Load().(*auditLogger); l != nil {
+		close(l.stop)
+		<-l.stopped
+	}
+	if w == nil {
+		auditLog.Store((*auditLogger)(nil))
+		return
+	}
+	l := &auditLogger{
+		records: make(chan auditRecord, auditQueueSize),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go l.run(csv.NewWriter(w))
+	auditLog.Store(l)
+}
+
+func (l *auditLogger) run(w *csv.Writer) {
+	defer close(l.stopped)
+	write := func(r auditRecord) {
+		if err := w.Write([]string{
+			r.at.Format(time.RFC3339Nano),
+			r.host,
+			r.outcome,
+			r.reason,
+			strconv.FormatInt(r.duration.Milliseconds(), 10),
+		}); err != nil {
+			log.Debugf("Unable to write audit log: %v", err)
+		}
+		if len(l.records) == 0 {
+			w.Flush()
+		}
+	}
+	for {
+		select {
+		case r := <-l.records:
+			write(r)
+		case <-l.stop:
+			for {
+				select {
+				case r := <-l.records:
+					write(r)
+				default:
+					w.Flush()
+					return
+				}
+			}
+		}
+	}
+}
+
+// detected counts the outcome of detection, fills it in the report and the
+// attempt log, notifies the observer if any, and writes it to the audit log if
+// set.
+func (dc *Conn) detected(counter *int64, outcome, reason string) {
+	atomic.AddInt64(counter, 1)
+	dc.reportDecision(outcome, reason)
+	dc.attemptDirect(outcome, reason)
+	if dc.observer != nil {
+		dc.observer.Detected(outcome, reason)
+	}
+	l, _ := auditLog.Load().(*auditLogger)
+	if l == nil {
+		return
+	}
+	r := auditRecord{time.Now(), hostOnly(dc.addr), outcome, reason, time.Since(dc.detectStart)}
+	select {
+	case l.records <- r:
+	default:
+		log.Debugf("Audit log queue is full, dropping record of %s", dc.addr)
+	}
+}
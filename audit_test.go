@@ -0,0 +1,43 @@
+package detour
+
+import (
+	"bytes"
+	"encoding/csv"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	var buf bytes.Buffer
+	SetAuditLog(&buf)
+	defer SetAuditLog(nil)
+
+	detourAddr := newBannerServer("hello detour", 0)
+	directAddr := newBannerServer("hello direct", 0)
+	assert.Equal(t, "hello direct", readOnce(t, Dialer(dialTo(directAddr), dialTo(detourAddr)), directAddr))
+	blockedAddr := newBannerServer("", 0)
+	assert.Equal(t, "hello detour", readOnce(t, Dialer(dialTo(blockedAddr), dialTo(detourAddr)), blockedAddr))
+	SetAuditLog(nil)
+
+	records, err := csv.NewReader(&buf).ReadAll()
+	if !assert.NoError(t, err) || !assert.Len(t, records, 2) {
+		return
+	}
+	for _, r := range records {
+		_, err := time.Parse(time.RFC3339Nano, r[0])
+		assert.NoError(t, err, "should have a timestamp")
+		assert.Equal(t, "127.0.0.1", r[1])
+		_, err = strconv.Atoi(r[4])
+		assert.NoError(t, err, "should have a duration")
+	}
+	assert.Equal(t, []string{"direct", "first read"}, records[0][2:4])
+	assert.Equal(t, []string{"detour", "read timeout"}, records[1][2:4])
+	d, _ := strconv.Atoi(records[1][4])
+	assert.True(t, d >= 50, "should take at least the first read timeout, got %dms", d)
+}
@@ -0,0 +1,28 @@
+package detour
+
+import (
+	"context"
+	"fmt"
+)
+
+// CheckDialer validates that d actually works, e.g. before using a proxy
+// configured by the user as the detour. It dials testAddr, which should be an
+// HTTP server, sends a HEAD request and waits for the first byte of response.
+// It's independent of the detection and doesn't touch the whitelist.
+func CheckDialer(ctx context.Context, d dialFunc, testAddr string) error {
+	conn, err := d(ctx, "tcp", testAddr)
+	if err != nil {
+		return fmt.Errorf("Unable to dial %s: %s", testAddr, err)
+	}
+	defer conn.Close()
+	return withDeadline(ctx, conn, func() error {
+		req := fmt.Sprintf("HEAD / HTTP/1.1\r\nHost: %s\r\nConnection: close\r\n\r\n", hostOnly(testAddr))
+		if _, err := conn.Write([]byte(req)); err != nil {
+			return fmt.Errorf("Unable to write to %s: %s", testAddr, err)
+		}
+		if _, err := conn.Read(make([]byte, 1)); err != nil {
+			return fmt.Errorf("Unable to read from %s: %s", testAddr, err)
+		}
+		return nil
+	})
+}
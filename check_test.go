@@ -0,0 +1,22 @@
+package detour
+
+import (
+	"context"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCheckDialer(t *testing.T) {
+	defer stopMockServers()
+	mockURL, _ := newMockServer(directMsg)
+	u, _ := url.Parse(mockURL)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.NoError(t, CheckDialer(ctx, proxyTo(mockURL), "example.com:80"), "should succeed if the dialer works")
+	assert.NoError(t, CheckDialer(ctx, dialTo(u.Host), u.Host))
+	assert.Error(t, CheckDialer(ctx, dialTo("127.0.0.1:1"), "example.com:80"), "should fail if unreachable")
+	assert.Error(t, CheckDialer(ctx, dialTo(newBannerServer("", 0)), "example.com:80"), "should fail if no response")
+}
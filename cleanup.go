@@ -0,0 +1,56 @@
+package detour
+
+import (
+	"context"
+	"time"
+)
+
+// StartCleanup starts a janitor in background which removes the expired
+// temporary whitelist entries, see SetTemporaryEntryTTL(), and the expired IPs
+// resolved from whitelisted hosts every interval, as well as the expired proxy
+// affinities, see SetStickyProxies(), the hosts sampled for content
+// verification long ago, see SetVerifyContent(), and the expired pins and
+// stale detour failures, see SetPinDirect(), so they don't pile up if the
+// hosts are never looked up again. It stops once ctx is done.
+func StartCleanup(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				log.Debugf("Stopped cleaning up whitelist: %v", ctx.Err())
+				return
+			case now := <-ticker.C:
+				sweepExpired(now)
+				sweepAffinity(now)
+				sweepVerifiedHosts(now)
+				sweepPins(now)
+			}
+		}
+	}()
+}
+
+// sweepExpired removes the entries expired by now and returns how many
+// whitelist entries are removed.
+func sweepExpired(now time.Time) (removed int) {
+	ttl := currentConfig().TemporaryEntryTTL
+	muWhitelist.Lock()
+	defer muWhitelist.Unlock()
+	for host, e := range whitelist {
+		if e.expired(ttl, now) {
+			deleteWl(host)
+			evicted(host, EvictExpired)
+			removed++
+		}
+	}
+	for ip, e := range resolvedIPs {
+		if now.After(e.expires) {
+			delete(resolvedIPs, ip)
+		}
+	}
+	if removed > 0 {
+		log.Debugf("Removed %d expired temporary whitelist entries", removed)
+	}
+	return
+}
@@ -0,0 +1,95 @@
+package detour
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStartCleanup(t *testing.T) {
+	SetTemporaryEntryTTL(50 * time.Millisecond)
+	defer SetTemporaryEntryTTL(0)
+	defer RemoveFromWl("temporary.example.com")
+	defer RemoveFromWl("permanent.example.com")
+	inWl := func(host string) bool {
+		muWhitelist.RLock()
+		defer muWhitelist.RUnlock()
+		_, ok := whitelist[host]
+		return ok
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	StartCleanup(ctx, 10*time.Millisecond)
+	AddToWl("temporary.example.com", false)
+	AddToWl("permanent.example.com", true)
+	assert.True(t, whitelisted("temporary.example.com"))
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, inWl("temporary.example.com"), "should remove expired temporary entries")
+	assert.True(t, inWl("permanent.example.com"), "should keep permanent entries")
+
+	cancel()
+	time.Sleep(20 * time.Millisecond)
+	AddToWl("temporary.example.com", false)
+	time.Sleep(100 * time.Millisecond)
+	assert.True(t, inWl("temporary.example.com"), "should stop cleaning up once ctx is done")
+	assert.False(t, whitelisted("temporary.example.com"), "should not match expired entries")
+}
+
+func TestOnWhitelistEvict(t *testing.T) {
+	SetTemporaryEntryTTL(50 * time.Millisecond)
+	defer SetTemporaryEntryTTL(0)
+	defer OnWhitelistEvict(nil)
+	type eviction struct {
+		addr        string
+		reason      EvictReason
+		whitelisted bool
+	}
+	evictions := make(chan eviction, 10)
+	OnWhitelistEvict(func(addr string, reason EvictReason) {
+		// should not hold the whitelist lock
+		evictions <- eviction{addr, reason, whitelisted(addr)}
+	})
+	next := func() eviction {
+		select {
+		case e := <-evictions:
+			return e
+		case <-time.After(time.Second):
+			return eviction{}
+		}
+	}
+
+	AddToWl("expiring.example.com", false)
+	AddToWl("permanent.example.com", true)
+	defer RemoveFromWl("permanent.example.com")
+	sweepExpired(time.Now().Add(time.Second))
+	assert.Equal(t, eviction{"expiring.example.com", EvictExpired, false}, next(), "should invoke callback on expiry")
+
+	AddToWl("removed.example.com", true)
+	RemoveFromWl("removed.example.com")
+	assert.Equal(t, eviction{"removed.example.com", EvictRemoved, false}, next(), "should invoke callback on removal")
+	RemoveFromWl("removed.example.com")
+	select {
+	case e := <-evictions:
+		t.Errorf("Unexpected eviction %v", e)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	for i := 0; i < 5; i++ {
+		AddToWl(fmt.Sprintf("ordered%d.example.com", i), true)
+	}
+	for i := 0; i < 5; i++ {
+		RemoveFromWl(fmt.Sprintf("ordered%d.example.com", i))
+	}
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, eviction{fmt.Sprintf("ordered%d.example.com", i), EvictRemoved, false}, next(), "should invoke callback in order")
+	}
+
+	AddToWl("replaced.example.com", false)
+	entries := WhitelistSnapshot()
+	delete(entries, "replaced.example.com")
+	ReplaceWhitelist(entries)
+	assert.Equal(t, eviction{"replaced.example.com", EvictRemoved, false}, next(), "should invoke callback for entries dropped by ReplaceWhitelist")
+}
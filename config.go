@@ -0,0 +1,230 @@
+package detour
+
+import (
+	"context"
+	"net"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Config is the runtime configuration of detour. Each dial reads a single
+// snapshot of it, so changes apply to connections dialed afterwards. Change it
+// with UpdateConfig() or the individual setters, never in place.
+type Config struct {
+	// FirstReadTimeout is how long to wait for the first read from a direct
+	// connection before considering the site blocked.
+	FirstReadTimeout time.Duration
+	// Country is the country set by SetCountry(), only for DumpConfig() as
+	// changing it here doesn't load the rules of the country.
+	Country string
+	// Detector is the detection rules of Country, see SetCountry()
+	Detector *Detector
+	// SuccessFunc, see SetSuccessFunc()
+	SuccessFunc func(firstBytes []byte, n int, err error) (ok bool)
+	// DetourServerFirst, see SetDetourServerFirst()
+	DetourServerFirst bool
+	// MaxReplayBytes, see SetMaxReplayBytes()
+	MaxReplayBytes int
+	// MaxTotalBufferBytes, see SetMaxTotalBufferBytes()
+	MaxTotalBufferBytes int64
+	// ReplayUnknownProtocols, see SetReplayUnknownProtocols()
+	ReplayUnknownProtocols bool
+	// ReplayableMethods, see SetReplayableMethods(), nil means the default
+	ReplayableMethods map[string]bool
+	// NoReplayHosts by host suffix, see SetNoReplayFor()
+	NoReplayHosts map[string]bool
+	// ErrorClassifier, see SetErrorClassifier()
+	ErrorClassifier func(err error) Signal
+	// VerifyBeforeTrust, see SetVerifyBeforeTrust()
+	VerifyBeforeTrust bool
+	// DetourAutoReconnect, see SetDetourAutoReconnect()
+	DetourAutoReconnect bool
+	// CheckDetourHijack, see SetCheckDetourHijack()
+	CheckDetourHijack bool
+	// DetectRedirectHijack, see SetDetectRedirectHijack()
+	DetectRedirectHijack bool
+	// AllowedRedirectHosts by host suffix, see AllowRedirectTo()
+	AllowedRedirectHosts map[string]bool
+	// DetourSuspendedUntil, see SuspendDetourUntil()
+	DetourSuspendedUntil time.Time
+	// DefaultDialOrder, see SetDefaultDialOrder()
+	DefaultDialOrder DialOrder
+	// MinFirstReadBytesPerSec, see SetMinFirstReadBytesPerSec()
+	MinFirstReadBytesPerSec int64
+	// ThrottleSampleBytes, see SetThrottleSampleBytes()
+	ThrottleSampleBytes int
+	// DetectionSampleRate, see SetDetectionSampleRate()
+	DetectionSampleRate float64
+	// DetectPrivateNetworks, see SetDetectPrivateNetworks()
+	DetectPrivateNetworks bool
+	// OverallTimeout, see SetOverallTimeout()
+	OverallTimeout time.Duration
+	// DetourTimeout, see SetDetourTimeout()
+	DetourTimeout time.Duration
+	// DebugTimeline, see SetDebugTimeline()
+	DebugTimeline bool
+	// DetourAddrRewriter, see SetDetourAddrRewriter()
+	DetourAddrRewriter func(addr string) string
+	// Resolver, see SetResolver()
+	Resolver Resolver
+	// DirectAddressFamily, see SetDirectAddressFamily()
+	DirectAddressFamily AddressFamily
+	// SinkholeIPs, see SetSinkholeIPs(). Don't modify the slice once applied.
+	SinkholeIPs []net.IP
+	// TrustedResolver, see SetTrustedResolver()
+	TrustedResolver Resolver
+	// DetourDNSServer, see SetDetourDNSServer()
+	DetourDNSServer string
+	// WhitelistStore, see SetWhitelistStore()
+	WhitelistStore WhitelistStore
+	// WhitelistResolvedIPsTTL, see SetWhitelistResolvedIPs()
+	WhitelistResolvedIPsTTL time.Duration
+	// ResolvedIPsResolver, see SetResolvedIPsResolver()
+	ResolvedIPsResolver Resolver
+	// AllowMidStreamRestart, see SetAllowMidStreamRestart()
+	AllowMidStreamRestart bool
+	// MidStreamRestartMaxBytes, see SetMidStreamRestartMaxBytes()
+	MidStreamRestartMaxBytes int
+	// MaxTemporaryEntries, see SetMaxTemporaryEntries()
+	MaxTemporaryEntries int
+	// MaxTemporaryEntriesPerDomain, see SetMaxTemporaryEntriesPerDomain()
+	MaxTemporaryEntriesPerDomain int
+	// HostNormalizer, see SetHostNormalizer()
+	HostNormalizer func(host string) string
+	// VerifyContent, see SetVerifyContent()
+	VerifyContent bool
+	// VerifyContentSampleRate, see SetVerifyContentSampleRate()
+	VerifyContentSampleRate float64
+	// HealthCheckAddr, see SetHealthCheckAddr()
+	HealthCheckAddr string
+	// PinDirectAfterDetourFailures, see SetPinDirect()
+	PinDirectAfterDetourFailures int
+	// PinDirectCooldown, see SetPinDirect()
+	PinDirectCooldown time.Duration
+	// AdaptiveDetectionTimeoutMax, see SetAdaptiveDetectionTimeout()
+	AdaptiveDetectionTimeoutMax time.Duration
+	// MinSuccessBytes, see SetMinSuccessBytes()
+	MinSuccessBytes int
+	// Paused, see SetPaused()
+	Paused bool
+	// DetectionTimeouts overrides FirstReadTimeout by host suffix, see
+	// SetDetectionTimeoutFor()
+	DetectionTimeouts map[string]time.Duration
+	// TLSHandshakeStallTimeout, see SetTLSHandshakeStallTimeout()
+	TLSHandshakeStallTimeout time.Duration
+	// Scorer, see SetScorer()
+	Scorer Scorer
+	// WhitelistByRequestTarget, see SetWhitelistByRequestTarget()
+	WhitelistByRequestTarget bool
+	// TemporaryEntryTTL, see SetTemporaryEntryTTL()
+	TemporaryEntryTTL time.Duration
+	// SuccessPatterns by host suffix, see SetSuccessPatternFor()
+	SuccessPatterns map[string]*regexp.Regexp
+	// ConnObserver, see SetConnObserver()
+	ConnObserver func(ctx context.Context, network, addr string) ConnObserver
+	// LookupTracer, see SetLookupTracer()
+	LookupTracer func(queried string, matchedKey string, via string)
+	// DirectReplayWindow, see SetDirectReplayWindow()
+	DirectReplayWindow int
+	// SchemeConfigs by port, see SetSchemeConfig()
+	SchemeConfigs map[int]DetectionConfig
+	// FallbackDirectOnProxyAuth, see SetFallbackDirectOnProxyAuth()
+	FallbackDirectOnProxyAuth bool
+	// StickyProxyTTL, see SetStickyProxies()
+	StickyProxyTTL time.Duration
+	// WeightProxiesBySuccess, see SetWeightProxiesBySuccess()
+	WeightProxiesBySuccess bool
+}
+
+var (
+	// instance of *Config, don't access directly, use UpdateConfig() and
+	// currentConfig() instead.
+	config atomic.Value
+
+	// serializes UpdateConfig() so no update is lost
+	muConfig sync.Mutex
+)
+
+func init() {
+	config.Store(&Config{
+		FirstReadTimeout:         3 * time.Second,
+		Detector:                 detectorByCountry(""),
+		DetectionSampleRate:      1,
+		DetourServerFirst:        true,
+		CheckDetourHijack:        true,
+		DetourTimeout:            30 * time.Second,
+		MaxReplayBytes:           1 << 20,
+		MidStreamRestartMaxBytes: 64 * 1024,
+		MaxTemporaryEntries:      10000,
+		VerifyContentSampleRate:  0.1,
+		HealthCheckAddr:          "www.google.com:80",
+		MinSuccessBytes:          1,
+		ThrottleSampleBytes:      4096,
+		DetourDNSServer:          "8.8.8.8:53",
+	})
+}
+
+// UpdateConfig applies update to a copy of the current config and stores the
+// result as a whole, so readers see either the old or the new config, never a
+// mix of both.
+func UpdateConfig(update func(Config) Config) {
+	muConfig.Lock()
+	defer muConfig.Unlock()
+	cfg := update(*currentConfig())
+	config.Store(&cfg)
+}
+
+// DumpConfig returns a copy of the config currently in effect, e.g. for
+// operators to verify the tunables at runtime.
+func DumpConfig() Config {
+	cfg := *currentConfig()
+	if cfg.DetectionTimeouts != nil {
+		timeouts := make(map[string]time.Duration, len(cfg.DetectionTimeouts))
+		for k, v := range cfg.DetectionTimeouts {
+			timeouts[k] = v
+		}
+		cfg.DetectionTimeouts = timeouts
+	}
+	if cfg.SuccessPatterns != nil {
+		patterns := make(map[string]*regexp.Regexp, len(cfg.SuccessPatterns))
+		for k, v := range cfg.SuccessPatterns {
+			patterns[k] = v
+		}
+		cfg.SuccessPatterns = patterns
+	}
+	if cfg.SchemeConfigs != nil {
+		schemes := make(map[int]DetectionConfig, len(cfg.SchemeConfigs))
+		for k, v := range cfg.SchemeConfigs {
+			schemes[k] = v
+		}
+		cfg.SchemeConfigs = schemes
+	}
+	if cfg.NoReplayHosts != nil {
+		hosts := make(map[string]bool, len(cfg.NoReplayHosts))
+		for k, v := range cfg.NoReplayHosts {
+			hosts[k] = v
+		}
+		cfg.NoReplayHosts = hosts
+	}
+	if cfg.AllowedRedirectHosts != nil {
+		hosts := make(map[string]bool, len(cfg.AllowedRedirectHosts))
+		for k, v := range cfg.AllowedRedirectHosts {
+			hosts[k] = v
+		}
+		cfg.AllowedRedirectHosts = hosts
+	}
+	if cfg.ReplayableMethods != nil {
+		methods := make(map[string]bool, len(cfg.ReplayableMethods))
+		for k, v := range cfg.ReplayableMethods {
+			methods[k] = v
+		}
+		cfg.ReplayableMethods = methods
+	}
+	return cfg
+}
+
+func currentConfig() *Config {
+	return config.Load().(*Config)
+}
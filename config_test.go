@@ -0,0 +1,109 @@
+package detour
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUpdateConfigNoTornRead(t *testing.T) {
+	orig := *currentConfig()
+	defer UpdateConfig(func(Config) Config { return orig })
+	UpdateConfig(func(c Config) Config {
+		c.FirstReadTimeout, c.OverallTimeout, c.MinFirstReadBytesPerSec = 0, 0, 0
+		return c
+	})
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 1; i <= 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// the fields below always change together
+				UpdateConfig(func(c Config) Config {
+					c.FirstReadTimeout = time.Duration(i) * time.Second
+					c.OverallTimeout = time.Duration(i) * time.Minute
+					c.MinFirstReadBytesPerSec = int64(i)
+					return c
+				})
+			}
+		}(i)
+	}
+	deadline := time.Now().Add(200 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		cfg := currentConfig()
+		i := int64(cfg.FirstReadTimeout / time.Second)
+		if !assert.Equal(t, time.Duration(i)*time.Minute, cfg.OverallTimeout, "should never read a mix of two updates") ||
+			!assert.Equal(t, i, cfg.MinFirstReadBytesPerSec, "should never read a mix of two updates") {
+			break
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestUpdateConfigNoLostUpdate(t *testing.T) {
+	orig := *currentConfig()
+	defer UpdateConfig(func(Config) Config { return orig })
+	UpdateConfig(func(c Config) Config {
+		c.MinFirstReadBytesPerSec = 0
+		return c
+	})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			UpdateConfig(func(c Config) Config {
+				c.MinFirstReadBytesPerSec++
+				return c
+			})
+		}()
+	}
+	wg.Wait()
+	assert.EqualValues(t, 100, currentConfig().MinFirstReadBytesPerSec)
+}
+
+func TestSettersUpdateConfig(t *testing.T) {
+	orig := *currentConfig()
+	defer UpdateConfig(func(Config) Config { return orig })
+
+	SetOverallTimeout(time.Second)
+	SetDefaultDialOrder(DetourFirst)
+	cfg := currentConfig()
+	assert.Equal(t, time.Second, cfg.OverallTimeout)
+	assert.Equal(t, DetourFirst, cfg.DefaultDialOrder)
+	assert.Equal(t, orig.FirstReadTimeout, cfg.FirstReadTimeout, "should keep other fields")
+}
+
+func TestDumpConfig(t *testing.T) {
+	s := SaveState()
+	defer RestoreState(s)
+	SetDetourTimeout(time.Minute)
+	SetDetectionSampleRate(0.5)
+	SetCountry("IR")
+	SetDetectionTimeoutFor("slow.com", 10*time.Second)
+	SetSchemeConfig(25, DetectionConfig{FirstReadTimeout: time.Second})
+
+	cfg := DumpConfig()
+	assert.Equal(t, time.Minute, cfg.DetourTimeout)
+	assert.Equal(t, 0.5, cfg.DetectionSampleRate)
+	assert.Equal(t, "IR", cfg.Country)
+	assert.Equal(t, 10*time.Second, cfg.DetectionTimeouts["slow.com"])
+	assert.Equal(t, DetectionConfig{FirstReadTimeout: time.Second}, cfg.SchemeConfigs[25])
+
+	cfg.DetectionTimeouts["slow.com"] = time.Hour
+	assert.Equal(t, 10*time.Second, DumpConfig().DetectionTimeouts["slow.com"], "should not change the config in effect through the dump")
+	SetCountry("")
+	assert.Equal(t, "", DumpConfig().Country)
+}
@@ -2,8 +2,10 @@ package detour
 
 import (
 	"bytes"
+	"errors"
 	"net"
 	"regexp"
+	"syscall"
 )
 
 // Detector is just a set of rules to check if a site is potentially blocked or not
@@ -11,6 +13,9 @@ type Detector struct {
 	DNSPoisoned        func(net.Conn) bool
 	TamperingSuspected func(error) bool
 	FakeResponse       func([]byte) bool
+	// KnownTarget checks if the addr is known to be a target of censorship,
+	// it's only advisory, see LikelyCensored().
+	KnownTarget func(addr string) bool
 }
 
 var (
@@ -18,6 +23,12 @@ var (
 	iranRedirectAddrs        = []string{"10.10.34.34:80", "10.10.34.36:80"}
 	iranBlockingMessageRegex = regexp.MustCompile(`<iframe src="http://10\.10\.34.+`)
 	http403                  = []byte("HTTP/1.1 403 Forbidden")
+	// sites long blocked in Iran, see
+	// https://en.wikipedia.org/wiki/Internet_censorship_in_Iran
+	iranKnownTargets = []string{
+		"facebook.com", "instagram.com", "twitter.com", "x.com", "youtube.com",
+		"telegram.org", "t.me", "bbc.com", "radiofarda.com", "voanews.com",
+	}
 )
 
 func init() {
@@ -40,9 +51,18 @@ func init() {
 		TamperingSuspected: func(err error) bool {
 			return false
 		},
+		KnownTarget: iranKnownTarget,
 	}
 }
 
+// iranKnownTarget checks if addr is one of iranKnownTargets or their
+// subdomains. The list is built on each lookup rather than once at init, so
+// that the targets are normalized the same way as addr even after
+// SetHostNormalizer().
+func iranKnownTarget(addr string) bool {
+	return NewDomainList(iranKnownTargets...).Contains(addr)
+}
+
 var defaultDetector = Detector{
 	DNSPoisoned: func(net.Conn) bool { return false },
 	TamperingSuspected: func(err error) bool {
@@ -61,6 +81,14 @@ var defaultDetector = Detector{
 		return false
 	},
 	FakeResponse: func([]byte) bool { return false },
+	KnownTarget:  func(string) bool { return false },
+}
+
+// unreachable checks if err means the host or network is unreachable, which is
+// often derived from an ICMP unreachable, e.g. administratively prohibited,
+// sent by a firewall, so it's a strong sign of blocking.
+func unreachable(err error) bool {
+	return errors.Is(err, syscall.EHOSTUNREACH) || errors.Is(err, syscall.ENETUNREACH)
 }
 
 func detectorByCountry(country string) *Detector {
@@ -68,10 +96,15 @@ func detectorByCountry(country string) *Detector {
 	if d == nil {
 		return &defaultDetector
 	}
+	knownTarget := d.KnownTarget
+	if knownTarget == nil {
+		knownTarget = defaultDetector.KnownTarget
+	}
 	return &Detector{d.DNSPoisoned,
 		func(err error) bool {
 			return defaultDetector.TamperingSuspected(err) || d.TamperingSuspected(err)
 		},
 		d.FakeResponse,
+		knownTarget,
 	}
 }
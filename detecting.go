@@ -0,0 +1,41 @@
+package detour
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+var (
+	muDetections sync.Mutex
+	// number of connections still detecting by host
+	inFlightDetections = make(map[string]int)
+)
+
+// Detecting checks if there's any connection to the host of addr still
+// detecting whether the site is blocked, e.g. to show "checking..." in UI.
+func Detecting(addr string) bool {
+	muDetections.Lock()
+	defer muDetections.Unlock()
+	return inFlightDetections[hostOnly(addr)] > 0
+}
+
+func (dc *Conn) startDetecting() {
+	if !atomic.CompareAndSwapInt32(&dc.detecting, 0, 1) {
+		return
+	}
+	muDetections.Lock()
+	inFlightDetections[hostOnly(dc.addr)]++
+	muDetections.Unlock()
+}
+
+func (dc *Conn) stopDetecting() {
+	if !atomic.CompareAndSwapInt32(&dc.detecting, 1, 0) {
+		return
+	}
+	host := hostOnly(dc.addr)
+	muDetections.Lock()
+	if inFlightDetections[host]--; inFlightDetections[host] <= 0 {
+		delete(inFlightDetections, host)
+	}
+	muDetections.Unlock()
+}
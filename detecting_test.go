@@ -0,0 +1,37 @@
+package detour
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetecting(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(time.Second)
+	directAddr := newBannerServer("hello direct", 200*time.Millisecond)
+	detourAddr := newBannerServer("hello detour", 0)
+
+	assert.False(t, Detecting(directAddr))
+	conn, err := Dialer(dialTo(directAddr), dialTo(detourAddr))(context.Background(), "tcp", directAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	read := make(chan string)
+	go func() {
+		b := make([]byte, 1024)
+		n, _ := conn.Read(b)
+		read <- string(b[:n])
+	}()
+	assert.True(t, Detecting(directAddr), "should be detecting during a slow first read")
+	assert.Equal(t, "hello direct", <-read)
+	assert.False(t, Detecting(directAddr), "should not be detecting once the first read is done")
+
+	_, err = Dialer(dialTo("127.0.0.1:1"), dialTo("127.0.0.1:1"))(context.Background(), "tcp", "127.0.0.1:1")
+	assert.Error(t, err)
+	assert.False(t, Detecting("127.0.0.1:1"), "should not be detecting if failed to dial")
+}
@@ -24,7 +24,7 @@ The action taken and state transistion in each phase is as follows:
 tl = temporary whitelist
 wl = permanent whitelist
 
-*   The timeout for first read is firstReadTimeoutToDetour, otherwise it's based
+*   The timeout for first read is Config.FirstReadTimeout, otherwise it's based
     on system default or caller supplied deadline.
 **  DNS hijacking is only checked at dial time.
 *** Connection is always detoured if the site is in tl or wl.
@@ -32,11 +32,18 @@ wl = permanent whitelist
 package detour
 
 import (
+	"bufio"
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -47,25 +54,90 @@ import (
 var (
 	log = golog.LoggerFor("detour")
 
-	firstReadTimeoutToDetour = 3 * time.Second
-
-	// instance of Detector
-	blockDetector atomic.Value
-
 	zeroTime time.Time
+
+	// bytes buffered to resend to detour across all connections, accessed
+	// atomically only, see SetMaxTotalBufferBytes()
+	totalBufferedBytes int64
 )
 
-func init() {
-	blockDetector.Store(detectorByCountry(""))
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// ErrOverallTimeout is returned when dialing, detecting and detouring takes
+// longer than the timeout set by SetOverallTimeout().
+var ErrOverallTimeout error = overallTimeoutError{}
+
+type overallTimeoutError struct{}
+
+func (overallTimeoutError) Error() string   { return "detour: overall timeout exceeded" }
+func (overallTimeoutError) Timeout() bool   { return true }
+func (overallTimeoutError) Temporary() bool { return true }
+
+// ErrOnionNeedsDetour is returned when dialing a .onion address, which can't
+// be dialed directly, fails through detour, e.g. as it's not Tor-capable.
+var ErrOnionNeedsDetour = errors.New("detour: .onion addresses can only be dialed through a Tor-capable detour")
+
+// ErrDetourWouldHaveHelped is wrapped in the error returned when detour is
+// paused, see SetPaused(), and the site seems blocked directly, e.g. to prompt
+// the user to enable the proxy.
+var ErrDetourWouldHaveHelped = errors.New("detour: site seems blocked and detour is paused")
+
+// ErrNoDialers is returned by the dialer returned by Dialer() if both the
+// direct and the detour dialers passed in are nil.
+var ErrNoDialers = errors.New("detour: neither direct nor detour dialer is set")
+
+// ErrProxyAuthRequired means the detour proxy rejected the credentials, e.g.
+// responded with 407 Proxy Authentication Required, so detouring won't work
+// until they are fixed. Detour dialers should return errors wrapping it in
+// that case, as the ones created by DialerWithProxyURL() and SOCKS5Dialer()
+// do. See
+// OnProxyAuthRequired() and SetFallbackDirectOnProxyAuth().
+var ErrProxyAuthRequired = errors.New("detour: proxy authentication required")
+
+// ErrDetourSuspended is returned when dialing a force whitelisted host while
+// detour is suspended, see SuspendDetourUntil().
+var ErrDetourSuspended = errors.New("detour: detour is suspended")
+
+// ErrDetourHijacked is returned by the first read from a detoured connection
+// if the response is hijacked too, e.g. the proxy itself is compromised, see
+// SetCheckDetourHijack().
+var ErrDetourHijacked = errors.New("detour: response through detour is hijacked too")
+
+type contextKey struct {
+	name string
 }
 
-type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+// NoWhitelistKey is the context key to set to true on the context passed to
+// the dialer returned by Dialer(), so that the connection still detours if the
+// site seems blocked but never adds the site to whitelist, e.g. for probing.
+var NoWhitelistKey = &contextKey{"no-whitelist"}
+
+// DialOrder decides which route Dialer() tries first for hosts which are not
+// in the whitelist.
+type DialOrder int32
+
+const (
+	// DirectFirst tries direct connection first and detours if the site seems
+	// blocked. This is the default.
+	DirectFirst DialOrder = iota
+	// DetourFirst always tries detour first and falls back to direct
+	// connection only if detour fails, so the local network never sees the
+	// connection as long as detour works.
+	DetourFirst
+)
 
 type Conn struct {
 	// keep track of the total bytes read in this connection
 	// Keep it at the top to make sure 64-bit alignment, see
 	// https://golang.org/pkg/sync/atomic/#pkg-note-BUG
 	readBytes int64
+	// nanoseconds, accessed atomically only, see Latencies()
+	directLatency int64
+	detourLatency int64
+	// unix nanoseconds of the last Write() and the last successful read,
+	// accessed atomically only, see SetDetourAutoReconnect()
+	lastWriteNanos int64
+	lastReadNanos  int64
 
 	muConn sync.RWMutex
 	// the actual connection, will change so protect it
@@ -74,18 +146,83 @@ type Conn struct {
 
 	// don't access directly, use inState() and setState() instead
 	state uint32
+	// 1 if counted in Detecting()
+	detecting int32
 
 	// the function to dial detour if the site fails to connect directly
 	dialDetour dialFunc
+	// the function to dial directly, only used to verify content
+	directDialer dialFunc
 
 	muLocalBuffer sync.Mutex
 	// localBuffer keep track of bytes sent through direct connection
-	// in initial state so we can resend them when detour
-	localBuffer bytes.Buffer
+	// in initial state so we can resend them when detour. It's released
+	// once the state settles so long-lived connections don't hold it.
+	localBuffer *bytes.Buffer
+	// copy of what's resent from localBuffer, only kept if debugging
+	replayed []byte
+	// see ReplayClass()
+	replayClass ReplayClass
+	// the target of the request written if any, see
+	// SetWhitelistByRequestTarget()
+	requestTarget string
+	// more than MaxReplayBytes was written before the first read, or
+	// buffering it would exceed MaxTotalBufferBytes
+	replayTooLarge bool
+	// something was written before the first read but not buffered, see
+	// SetNoReplayFor()
+	replayDisabled bool
+	// read ahead from detour but not returned yet, and the error to return
+	// after, see SetAllowMidStreamRestart()
+	pending    []byte
+	pendingErr error
 
 	network, addr  string
 	_readDeadline  atomic.Value
 	_writeDeadline atomic.Value
+
+	// the config snapshot taken when dialing
+	cfg *Config
+	// don't add the site to whitelist, see NoWhitelistKey
+	noWhitelist bool
+	// nil unless dialed with ReportKey
+	report *Report
+	// nil unless observed, see SetConnObserver()
+	observer ConnObserver
+	// 1 once observer.Done() is called, accessed atomically only
+	observed int32
+	// detecting again though whitelisted, see InvalidateHost()
+	redetecting bool
+	// the grown first read timeout tried while detecting again, see
+	// SetAdaptiveDetectionTimeout()
+	probeTimeout time.Duration
+	// signals of blocking observed while detecting, see SetScorer()
+	signals []Signal
+	// the status in the whitelist store, looked up at most once per dial, see
+	// SetWhitelistStore()
+	storeLooked bool
+	inStore     WhitelistStatus
+	// zero if no overall timeout, see SetOverallTimeout()
+	overallDeadline time.Time
+
+	// when dialing directly or wrapping the direct connection, see
+	// SetAuditLog()
+	detectStart time.Time
+
+	// when the detour was last dialed, see Latencies()
+	detourStart time.Time
+
+	// bytes read from the direct connection after the first read and the
+	// time spent reading them, see SetMinFirstReadBytesPerSec()
+	sampledBytes      int64
+	sampledTime       time.Duration
+	throughputChecked bool
+
+	// only set if debugging, see SetDebugTimeline()
+	dialStart  time.Time
+	muTimeline sync.Mutex
+	timeline   []Step
+	attempts   []Attempt
 }
 
 // Wrapped exposes the underlying connection.
@@ -95,6 +232,12 @@ func (dc *Conn) Wrapped() net.Conn {
 	return dc.conn
 }
 
+// InDetectionWindow tells if the connection is still deciding whether to
+// detour, i.e. the route is provisional until the first read settles it.
+func (dc *Conn) InDetectionWindow() bool {
+	return dc.inState(stateInitial)
+}
+
 const (
 	stateInitial = iota
 	stateDirect
@@ -110,111 +253,769 @@ var statesDesc = []string{
 }
 
 // SetCountry sets the ISO 3166-1 alpha-2 country code
-// to load country specific detection rules
+// to load country specific detection rules. Connections already dialed keep
+// the rules in effect when they were dialed.
 func SetCountry(country string) {
-	blockDetector.Store(detectorByCountry(country))
+	detector := detectorByCountry(country)
+	UpdateConfig(func(c Config) Config {
+		c.Country = country
+		c.Detector = detector
+		return c
+	})
+}
+
+// ClearCountry unloads the country specific detection rules set by
+// SetCountry(), leaving only the rules applied everywhere.
+func ClearCountry() {
+	SetCountry("")
+}
+
+func currentDetector() *Detector {
+	return currentConfig().Detector
+}
+
+// LikelyCensored predicts if addr is censored by checking the whitelist, the
+// list set by SetCensoredList() and the known targets of the rules for the
+// current country. It's advisory only, e.g. to pre-select detour before
+// dialing, and doesn't affect how Dialer() behaves.
+func LikelyCensored(addr string) bool {
+	if whitelisted(addr) || getCensoredList().Contains(addr) {
+		return true
+	}
+	return currentDetector().KnownTarget(addr)
+}
+
+// SetDetourServerFirst controls whether a connection which hasn't written
+// anything before its first read times out may still be detoured. This is the
+// case for server-speaks-first protocols (e.g. SMTP banners), where there's
+// nothing to replay so the detour is simply redialed. Enabled by default.
+func SetDetourServerFirst(enabled bool) {
+	UpdateConfig(func(c Config) Config {
+		c.DetourServerFirst = enabled
+		return c
+	})
+}
+
+// SetPaused pauses or resumes detouring globally. While paused, connections
+// are always dialed directly and nothing is added to whitelist, but detection
+// still runs and is counted in Stats() as if detouring, and the connections
+// which would detour fail with ErrDetourWouldHaveHelped instead.
+func SetPaused(paused bool) {
+	UpdateConfig(func(c Config) Config {
+		c.Paused = paused
+		return c
+	})
+}
+
+// SuspendDetourUntil makes connections dialed before t direct only, without
+// detection, e.g. while the proxy is down for scheduled maintenance. Dialing
+// force whitelisted hosts fails with ErrDetourSuspended in the meantime.
+// Normal behavior resumes automatically at t. Pass a zero time to resume
+// earlier.
+func SuspendDetourUntil(t time.Time) {
+	UpdateConfig(func(c Config) Config {
+		c.DetourSuspendedUntil = t
+		return c
+	})
+}
+
+// SetDefaultDialOrder sets which route to try first for hosts which are
+// neither whitelisted nor force whitelisted.
+func SetDefaultDialOrder(order DialOrder) {
+	UpdateConfig(func(c Config) Config {
+		c.DefaultDialOrder = order
+		return c
+	})
+}
+
+// SetMinFirstReadBytesPerSec sets the minimum throughput of a direct
+// connection, measured over the reads after the first one until
+// ThrottleSampleBytes are read, see SetThrottleSampleBytes(). Below that the
+// site is considered throttled. The connection itself stays direct, as what's
+// been read is already delivered, but the site is added to whitelist so later
+// connections to it detour, counted as WhitelistedThrottled. 0, the default,
+// disables the check.
+func SetMinFirstReadBytesPerSec(n int64) {
+	UpdateConfig(func(c Config) Config {
+		c.MinFirstReadBytesPerSec = n
+		return c
+	})
+}
+
+// SetDetectionSampleRate sets the fraction, between 0 and 1, of connections to
+// hosts not in whitelist to detect blocking from the first read. The others
+// skip waiting for and buffering the first read, so they stay direct unless
+// dialing directly fails in a suspicious way. Hosts detected again after
+// InvalidateHost() are always detected. Defaults to 1.
+func SetDetectionSampleRate(rate float64) {
+	UpdateConfig(func(c Config) Config {
+		c.DetectionSampleRate = rate
+		return c
+	})
+}
+
+// DetectionConfig is how to detect blocking for a port, see SetSchemeConfig().
+type DetectionConfig struct {
+	// FirstReadTimeout overrides Config.FirstReadTimeout if positive, but not
+	// the timeouts set by SetDetectionTimeoutFor().
+	FirstReadTimeout time.Duration
+	// DetectHijackedResponse enables checking the first read for hijacked
+	// content, e.g. block pages served over plain HTTP.
+	DetectHijackedResponse bool
+	// DetectReadFailure enables detouring if the first read times out or fails
+	// suspiciously, e.g. the connection is reset.
+	DetectReadFailure bool
+}
+
+// all detection enabled, for ports without DetectionConfig
+var defaultDetectionConfig = DetectionConfig{DetectHijackedResponse: true, DetectReadFailure: true}
+
+// SetSchemeConfig sets how to detect blocking for connections to port, as
+// blocking often differs by scheme, e.g. hijacked content for HTTP on port 80
+// but connection resets for HTTPS on port 443. All detection is enabled for
+// ports without config, a zero DetectionConfig disables both for the port.
+func SetSchemeConfig(port int, cfg DetectionConfig) {
+	UpdateConfig(func(c Config) Config {
+		configs := make(map[int]DetectionConfig, len(c.SchemeConfigs)+1)
+		for k, v := range c.SchemeConfigs {
+			configs[k] = v
+		}
+		configs[port] = cfg
+		c.SchemeConfigs = configs
+		return c
+	})
+}
+
+// detectionFor returns the DetectionConfig for the port of addr.
+func (c *Config) detectionFor(addr string) DetectionConfig {
+	if len(c.SchemeConfigs) > 0 {
+		if _, p, err := net.SplitHostPort(addr); err == nil {
+			if port, err := strconv.Atoi(p); err == nil {
+				if dc, ok := c.SchemeConfigs[port]; ok {
+					return dc
+				}
+			}
+		}
+	}
+	return defaultDetectionConfig
+}
+
+// SetDetectionTimeoutFor overrides how long to wait for the first read from a
+// direct connection for hostSuffix and its subdomains, e.g. to give known slow
+// sites longer. The most specific suffix wins. A zero d removes the override.
+func SetDetectionTimeoutFor(hostSuffix string, d time.Duration) {
+	host := normalizeHost(hostSuffix)
+	UpdateConfig(func(c Config) Config {
+		timeouts := make(map[string]time.Duration, len(c.DetectionTimeouts)+1)
+		for k, v := range c.DetectionTimeouts {
+			timeouts[k] = v
+		}
+		if d > 0 {
+			timeouts[host] = d
+		} else {
+			delete(timeouts, host)
+		}
+		c.DetectionTimeouts = timeouts
+		return c
+	})
+}
+
+// firstReadTimeoutFor returns the first read timeout for addr, considering the
+// overrides set by SetDetectionTimeoutFor().
+func (c *Config) firstReadTimeoutFor(addr string) time.Duration {
+	if len(c.DetectionTimeouts) > 0 {
+		for host := hostOnly(addr); host != ""; host = getParentDomain(host) {
+			if d, ok := c.DetectionTimeouts[host]; ok {
+				return d
+			}
+		}
+	}
+	if d := c.detectionFor(addr).FirstReadTimeout; d > 0 {
+		return d
+	}
+	return c.FirstReadTimeout
+}
+
+// SetTLSHandshakeStallTimeout sets how long to wait for a reply to a TLS
+// ClientHello sent directly to port 443. Getting nothing back in time is a
+// strong sign of blocking, so the connection detours without waiting for the
+// whole first read timeout if d is shorter. 0, the default, disables it.
+func SetTLSHandshakeStallTimeout(d time.Duration) {
+	UpdateConfig(func(c Config) Config {
+		c.TLSHandshakeStallTimeout = d
+		return c
+	})
+}
+
+// awaitingHandshake checks if a TLS ClientHello has been sent to port 443 and
+// handshake stalls should be detected, see SetTLSHandshakeStallTimeout().
+func (dc *Conn) awaitingHandshake() bool {
+	if dc.cfg.TLSHandshakeStallTimeout <= 0 {
+		return false
+	}
+	if _, port, err := net.SplitHostPort(dc.addr); err != nil || port != "443" {
+		return false
+	}
+	return dc.classifyReplay() == ReplayTLSHandshake
+}
+
+// SetSuccessPatternFor requires the first read from a direct connection to
+// hostSuffix or its subdomains to match re for the site to be considered fine,
+// otherwise it's detoured as if SetSuccessFunc() rejected it. The most specific
+// suffix wins. It's ignored if SetSuccessFunc() is set. A nil re removes it.
+func SetSuccessPatternFor(hostSuffix string, re *regexp.Regexp) {
+	host := normalizeHost(hostSuffix)
+	UpdateConfig(func(c Config) Config {
+		patterns := make(map[string]*regexp.Regexp, len(c.SuccessPatterns)+1)
+		for k, v := range c.SuccessPatterns {
+			patterns[k] = v
+		}
+		if re != nil {
+			patterns[host] = re
+		} else {
+			delete(patterns, host)
+		}
+		c.SuccessPatterns = patterns
+		return c
+	})
+}
+
+// successPatternFor returns the pattern set by SetSuccessPatternFor() for
+// addr, or nil.
+func (c *Config) successPatternFor(addr string) *regexp.Regexp {
+	if len(c.SuccessPatterns) > 0 {
+		for host := hostOnly(addr); host != ""; host = getParentDomain(host) {
+			if re, ok := c.SuccessPatterns[host]; ok {
+				return re
+			}
+		}
+	}
+	return nil
+}
+
+// SetMinSuccessBytes sets how many bytes the first read from a direct
+// connection has to get within the first read timeout for the site to be
+// considered fine, unless a complete HTTP response header or TLS record arrives
+// earlier. Fewer bytes are treated as if nothing arrived, as a censor may send
+// some junk bytes before resetting the connection. Defaults to 1.
+func SetMinSuccessBytes(n int) {
+	UpdateConfig(func(c Config) Config {
+		c.MinSuccessBytes = n
+		return c
+	})
+}
+
+// SetDetourAddrRewriter sets a function to rewrite the address passed to the
+// detour dialer, e.g. for proxies expecting the target by IP. Direct
+// connections always use the original address. If the rewritten address has
+// no port, the original port is kept. Pass nil to remove it.
+func SetDetourAddrRewriter(rewrite func(addr string) string) {
+	UpdateConfig(func(c Config) Config {
+		c.DetourAddrRewriter = rewrite
+		return c
+	})
+}
+
+func rewriteDetourAddr(rewrite func(string) string, addr string) string {
+	if rewrite == nil {
+		return addr
+	}
+	rewritten := rewrite(addr)
+	if _, _, err := net.SplitHostPort(rewritten); err != nil {
+		if _, port, err := net.SplitHostPort(addr); err == nil {
+			rewritten = net.JoinHostPort(rewritten, port)
+		}
+	}
+	log.Tracef("Rewrote detour address %s to %s", addr, rewritten)
+	return rewritten
+}
+
+// SetDetectPrivateNetworks controls whether connections to loopback,
+// link-local and private IP addresses go through detection like others.
+// Disabled by default, so they are always dialed directly without any delay.
+func SetDetectPrivateNetworks(enabled bool) {
+	UpdateConfig(func(c Config) Config {
+		c.DetectPrivateNetworks = enabled
+		return c
+	})
+}
+
+func isOnionAddr(addr string) bool {
+	return strings.HasSuffix(strings.TrimSuffix(hostOnly(addr), "."), ".onion")
+}
+
+// isPrivateAddr checks if the host of addr is a loopback, link-local or
+// private IP address. Host names are not resolved.
+func isPrivateAddr(addr string) bool {
+	ip := net.ParseIP(hostOnly(addr))
+	return ip != nil && (ip.IsLoopback() || ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast())
+}
+
+// SetOverallTimeout sets a timeout covering the whole sequence of dialing
+// directly, detecting on the first read and detouring, rather than each
+// phase. ErrOverallTimeout is returned once exceeded. 0, the default,
+// disables it.
+func SetOverallTimeout(d time.Duration) {
+	UpdateConfig(func(c Config) Config {
+		c.OverallTimeout = d
+		return c
+	})
+}
+
+// SetDetourTimeout bounds the detour phase, i.e. dialing the detour, resending
+// and the first read from it, so a hanging detour can't block forever even if
+// the caller's context has no deadline. 0 disables it. Defaults to 30 seconds.
+func SetDetourTimeout(d time.Duration) {
+	UpdateConfig(func(c Config) Config {
+		c.DetourTimeout = d
+		return c
+	})
+}
+
+// SetSuccessFunc sets a function to decide whether the first read from a
+// direct connection is successful, in place of the built-in detection. The
+// connection detours if it returns false and what's written can be resent,
+// otherwise stays direct. firstBytes is what's read, n its length and err the
+// error of the read, if any. Pass nil to restore the built-in detection.
+func SetSuccessFunc(success func(firstBytes []byte, n int, err error) (ok bool)) {
+	UpdateConfig(func(c Config) Config {
+		c.SuccessFunc = success
+		return c
+	})
 }
 
 // Dialer returns a function with same signature of net.Dialer.DialContext().
+// If both directDialer and detourDialer are nil, the function always fails
+// with ErrNoDialers.
 func Dialer(directDialer dialFunc, detourDialer dialFunc) dialFunc {
+	if directDialer == nil && detourDialer == nil {
+		log.Error(ErrNoDialers)
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, ErrNoDialers
+		}
+	}
 	return func(ctx context.Context, network, addr string) (
 		conn net.Conn, err error,
 	) {
-		dc := &Conn{dialDetour: detourDialer, network: network, addr: addr}
-		if !whitelisted(addr) {
+		cfg := currentConfig()
+		dc := &Conn{dialDetour: detourDialer, directDialer: directDialer, network: network, addr: addr, cfg: cfg, detectStart: time.Now()}
+		dc.noWhitelist, _ = ctx.Value(NoWhitelistKey).(bool)
+		if dc.report, _ = ctx.Value(ReportKey).(*Report); dc.report != nil {
+			dc.report.Host = hostOnly(addr)
+			defer func() { dc.reportResult(err) }()
+		}
+		if observe := cfg.ConnObserver; observe != nil {
+			if dc.observer = observe(ctx, network, addr); dc.observer != nil {
+				defer func() {
+					if err != nil || !dc.inState(stateInitial) {
+						dc.observeDone(err)
+					}
+				}()
+			}
+		}
+		if cfg.DebugTimeline {
+			dc.dialStart = time.Now()
+		}
+		if d := cfg.OverallTimeout; d > 0 {
+			dc.overallDeadline = time.Now().Add(d)
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, dc.overallDeadline)
+			defer cancel()
+			defer func() {
+				if err != nil && dc.overallExceeded() {
+					log.Debugf("Overall timeout dialing %s: %s", addr, err)
+					conn, err = nil, ErrOverallTimeout
+				}
+			}()
+		}
+		if !cfg.DetectPrivateNetworks && isPrivateAddr(addr) {
+			log.Tracef("%v is in private network, dial directly", addr)
+			dc.setState(stateDirect)
+			if dc.conn, err = directDialer(ctx, network, addr); err != nil {
+				return nil, err
+			}
+			return dc, nil
+		}
+		if time.Now().Before(cfg.DetourSuspendedUntil) {
+			if _, via := lookupWl(network, addr, 0); via == LookupForce {
+				return nil, fmt.Errorf("%w: %s is force whitelisted", ErrDetourSuspended, addr)
+			}
+			log.Tracef("Detour is suspended, dial %v directly", addr)
+			dc.setState(stateDirect)
+			if dc.conn, err = directDialer(ctx, network, addr); err != nil {
+				return nil, err
+			}
+			return dc, nil
+		}
+		if getKnownGoodList().Contains(addr) && !dc.whitelisted() {
+			log.Tracef("%v is known to be good, dial directly", addr)
+			dc.setState(stateDirect)
+			if dc.conn, err = directDialer(ctx, network, addr); err != nil {
+				return nil, err
+			}
+			return dc, nil
+		}
+		if unavailable := dc.detourUnavailable(); unavailable != nil {
+			log.Tracef("Detour is unavailable (%v), attempting direct connection for %v", unavailable, addr)
+			dc.setState(stateInitial)
+			detour, err := dc.dialDirect(ctx, directDialer)
+			if detour {
+				dc.stopDetecting()
+				return nil, dc.detourWouldHaveHelped(unavailable, err)
+			}
+			if err != nil {
+				dc.stopDetecting()
+				return nil, err
+			}
+			return dc, nil
+		}
+		if cfg.PinDirectAfterDetourFailures > 0 && pinnedDirect(addr) {
+			log.Tracef("%v is pinned to direct, dial directly", addr)
+			dc.setState(stateDirect)
+			if dc.conn, err = directDialer(ctx, network, addr); err != nil {
+				return nil, err
+			}
+			return dc, nil
+		}
+		if isOnionAddr(addr) {
+			log.Tracef("%v is an onion address, always detour", addr)
+			dc.setState(stateDetour)
+			if dc.detourDialer() == nil {
+				return nil, ErrOnionNeedsDetour
+			}
+			if dc.conn, err = dc.dialDetourConn(ctx); err != nil {
+				return nil, fmt.Errorf("%w: %s", ErrOnionNeedsDetour, err)
+			}
+			return dc, nil
+		}
+		dc.redetecting = consumeInvalidation(addr)
+		if !dc.redetecting && !dc.whitelisted() && cfg.DefaultDialOrder == DetourFirst {
+			return dc.dialDetourFirst(ctx, directDialer)
+		}
+		if dc.redetecting || !dc.whitelisted() {
 			log.Tracef("Attempting direct connection for %v", addr)
-			detector := blockDetector.Load().(*Detector)
 			dc.setState(stateInitial)
-			// Always try direct connection first. The caller may choose a
-			// deadline shorter than the context passed in.
-			dc.conn, err = directDialer(ctx, network, addr)
-			if err == nil {
-				if !detector.DNSPoisoned(dc.conn) {
-					log.Tracef("Dial %s to %s succeeded", dc.stateDesc(), addr)
-					return dc, nil
-				}
-				log.Debugf("Dial %s to %s, dns hijacked, try detour", dc.stateDesc(), addr)
-				if err := dc.conn.Close(); err != nil {
-					log.Debugf("Unable to close connection: %v", err)
+			if detour, err := dc.dialDirect(ctx, directDialer); !detour {
+				if err != nil {
+					dc.stopDetecting()
+				} else if !dc.redetecting && randFloat64() >= cfg.DetectionSampleRate {
+					log.Tracef("%v is not sampled for detection, stay direct", addr)
+					dc.setState(stateDirect)
 				}
-			} else if detector.TamperingSuspected(err) {
-				log.Debugf("Dial %s to %s failed, try detour: %s", dc.stateDesc(), addr, err)
-			} else {
-				log.Debugf("Dial %s to %s failed: %s", dc.stateDesc(), addr, err)
 				return dc, err
 			}
 		}
 		log.Tracef("Detouring %v", addr)
 		// if whitelisted or dial directly failed, try detour
 		dc.setState(stateDetour)
-		dc.conn, err = dc.dialDetour(ctx, network, addr)
+		dc.conn, err = dc.dialDetourConn(ctx)
 		if err != nil {
 			log.Errorf("Dial %s failed: %s", dc.stateDesc(), err)
 			return nil, err
 		}
 		log.Tracef("Dial %s to %s succeeded", dc.stateDesc(), addr)
-		if !whitelisted(addr) {
+		if dc.redetecting || !dc.whitelisted() {
 			log.Tracef("Add %s to whitelist", addr)
-			AddToWl(dc.addr, false)
+			dc.addToWl(false)
 		}
 		return dc, err
 	}
 }
 
+// WrapDirect applies detection to a direct connection to addr the caller has
+// already dialed, and detours through detour if the site seems blocked, the
+// same as a connection directly dialed by Dialer() would.
+func WrapDirect(conn net.Conn, detour dialFunc, addr string) net.Conn {
+	cfg := currentConfig()
+	dc := &Conn{dialDetour: detour, network: "tcp", addr: addr, cfg: cfg, conn: conn, detectStart: time.Now()}
+	if cfg.DebugTimeline {
+		dc.dialStart = time.Now()
+	}
+	if d := cfg.OverallTimeout; d > 0 {
+		dc.overallDeadline = time.Now().Add(d)
+	}
+	log.Tracef("Wrapping direct connection to %v", addr)
+	dc.setState(stateInitial)
+	return dc
+}
+
+// dialDirect tries to dial directly, returns true if the site seems blocked
+// so should detour.
+func (dc *Conn) dialDirect(ctx context.Context, directDialer dialFunc) (detour bool, err error) {
+	detector := dc.cfg.Detector
+	if dnsBlocked(ctx, dc.cfg, dc.addr, dc.detourDialer()) {
+		log.Debugf("Resolve %s, dns blocked", dc.addr)
+		dc.step("dns blocked", nil)
+		if dc.signal(SignalDNSBlocked) {
+			dc.detected(&counters.DetouredHijack, "detour", "dns blocked")
+			return true, nil
+		}
+	}
+	// Always try direct connection first. The caller may choose a
+	// deadline shorter than the context passed in.
+	dc.step("dial direct", nil)
+	dc.conn, err = dialDirectByFamily(ctx, dc.cfg, directDialer, dc.network, dc.addr)
+	dc.step("dialed direct", err)
+	if err != nil {
+		dc.recordDirectLatency()
+	}
+	if err == nil {
+		if !detector.DNSPoisoned(dc.conn) {
+			log.Tracef("Dial %s to %s succeeded", dc.stateDesc(), dc.addr)
+			return false, nil
+		}
+		log.Debugf("Dial %s to %s, dns hijacked", dc.stateDesc(), dc.addr)
+		dc.step("dns hijacked", nil)
+		if !dc.signal(SignalDNSHijacked) {
+			return false, nil
+		}
+		dc.recordDirectLatency()
+		dc.detected(&counters.DetouredHijack, "detour", "dns hijacked")
+		if err := dc.conn.Close(); err != nil {
+			log.Debugf("Unable to close connection: %v", err)
+		}
+		return true, nil
+	}
+	if s, ok := dc.classifyError(err); ok {
+		if s != SignalTransient && dc.signal(s) {
+			log.Debugf("Dial %s to %s failed with %v, try detour: %s", dc.stateDesc(), dc.addr, s, err)
+			dc.detected(&counters.DetouredDialFailure, "detour", string(s))
+			return true, nil
+		}
+		log.Debugf("Dial %s to %s failed with %v: %s", dc.stateDesc(), dc.addr, s, err)
+		return false, err
+	}
+	if unreachable(err) && dc.signal(SignalUnreachable) {
+		log.Debugf("Dial %s to %s unreachable, try detour: %s", dc.stateDesc(), dc.addr, err)
+		dc.detected(&counters.DetouredUnreachable, "detour", "unreachable")
+		return true, nil
+	}
+	if detector.TamperingSuspected(err) && dc.signal(SignalDialFailure) {
+		log.Debugf("Dial %s to %s failed, try detour: %s", dc.stateDesc(), dc.addr, err)
+		dc.detected(&counters.DetouredDialFailure, "detour", "dial failure")
+		return true, nil
+	}
+	log.Debugf("Dial %s to %s failed: %s", dc.stateDesc(), dc.addr, err)
+	return false, err
+}
+
+// dialDetourFirst dials detour without trying direct connection first, and
+// falls back to direct connection only if detour fails. Either way the host
+// is not added to whitelist as nothing is detected.
+func (dc *Conn) dialDetourFirst(ctx context.Context, directDialer dialFunc) (net.Conn, error) {
+	dc.setState(stateDetour)
+	conn, err := dc.dialDetourConn(ctx)
+	if err == nil {
+		log.Tracef("Dial %s to %s succeeded", dc.stateDesc(), dc.addr)
+		dc.conn = conn
+		return dc, nil
+	}
+	log.Debugf("Dial %s to %s failed, fall back to direct: %s", dc.stateDesc(), dc.addr, err)
+	dc.setState(stateDirect)
+	dc.step("dial direct", nil)
+	conn, err = directDialer(ctx, dc.network, dc.addr)
+	dc.step("dialed direct", err)
+	dc.attempt("direct", err)
+	if err != nil {
+		log.Debugf("Dial %s to %s failed: %s", dc.stateDesc(), dc.addr, err)
+		return nil, err
+	}
+	log.Tracef("Dial %s to %s succeeded", dc.stateDesc(), dc.addr)
+	dc.conn = conn
+	return dc, nil
+}
+
 // Read() implements the function from net.Conn
 func (dc *Conn) Read(b []byte) (n int, err error) {
 	if !dc.inState(stateInitial) {
 		return dc.followUpRead(b)
 	}
-	// state will always be settled after first read, safe to clear buffer at end of it
-	defer dc.resetLocalBuffer()
+	// state will always be settled after first read, safe to release buffer at end of it
+	defer dc.releaseLocalBuffer()
+	defer func() {
+		dc.reportResult(err)
+		dc.observeDone(err)
+	}()
+	if dc.cfg.WhitelistByRequestTarget {
+		dc.captureRequestTarget()
+	}
 	start := time.Now()
 	readDeadline := dc.readDeadline()
-	if !readDeadline.IsZero() && readDeadline.Sub(start) < 2*firstReadTimeoutToDetour {
+	firstReadTimeout := dc.firstReadTimeout()
+	awaitingHandshake := dc.awaitingHandshake()
+	if awaitingHandshake && dc.cfg.TLSHandshakeStallTimeout < firstReadTimeout {
+		firstReadTimeout = dc.cfg.TLSHandshakeStallTimeout
+	}
+	if !readDeadline.IsZero() && readDeadline.Sub(start) < 2*firstReadTimeout {
 		log.Tracef("no time left to test %s, read %s", dc.addr, statesDesc[stateDirect])
+		dc.step("no time left for first read, stay direct", nil)
+		dc.detected(&counters.StayedDirect, "direct", "no time left")
 		dc.setState(stateDirect)
 		return dc.countedRead(b)
 	}
-	// wait for at most firstReadTimeoutToDetour to read
-	if err := dc.getConn().SetReadDeadline(start.Add(firstReadTimeoutToDetour)); err != nil {
+	// wait for at most FirstReadTimeout to read
+	detectDeadline := start.Add(firstReadTimeout)
+	if !dc.overallDeadline.IsZero() && dc.overallDeadline.Before(detectDeadline) {
+		detectDeadline = dc.overallDeadline
+	}
+	if err := dc.getConn().SetReadDeadline(detectDeadline); err != nil {
 		log.Debugf("Unable to set read deadline: %v", err)
 	}
+	dc.step("first read", nil)
+	// read straight into b rather than a buffer of our own, so what's read
+	// is handed back without copying if staying direct
 	n, err = dc.countedRead(b)
+	if min := dc.cfg.MinSuccessBytes; min > 1 && err == nil {
+		n, err = dc.readAtLeast(b, n, min)
+	}
+	dc.step("first read done", err)
+	recordDetection(time.Since(start))
+	dc.recordDirectLatency()
 	if err := dc.getConn().SetReadDeadline(readDeadline); err != nil {
 		log.Debugf("Unable to set read deadline: %v", err)
 	}
 
-	detector := blockDetector.Load().(*Detector)
+	if err != nil && dc.overallExceeded() {
+		log.Debugf("Error while read from %s %s: %s", dc.addr, dc.stateDesc(), err)
+		return n, ErrOverallTimeout
+	}
+	if success := dc.cfg.SuccessFunc; success != nil {
+		if !success(b[:n], n, err) && dc.signal(SignalUnsuccessful) {
+			log.Debugf("First read from %s %s is not successful", dc.addr, dc.stateDesc())
+			dc.step("not successful", err)
+			if dc.canReplay() {
+				dc.detected(&counters.DetouredUnsuccessful, "detour", "unsuccessful")
+				return dc.detour(b)
+			}
+			log.Debugf("Unable to replay request to %s, add to whitelist", dc.addr)
+			dc.addToWl(false)
+		}
+		if err != nil {
+			return
+		}
+		dc.stayDirect(n)
+		return
+	}
+	detector := dc.cfg.Detector
+	detection := dc.cfg.detectionFor(dc.addr)
 	if err != nil {
 		log.Debugf("Error while read from %s %s: %s", dc.addr, dc.stateDesc(), err)
-		if detector.TamperingSuspected(err) {
+		if ne, ok := err.(net.Error); ok && ne.Timeout() && n == 0 && awaitingHandshake && dc.canReplay() {
+			log.Debugf("TLS handshake with %s stalled", dc.addr)
+			dc.step("tls handshake stalled", err)
+			if dc.signal(SignalHandshakeStall) {
+				dc.detected(&counters.DetouredHandshakeStall, "detour", "tls handshake stalled")
+				return dc.detour(b)
+			}
+			return
+		}
+		suspected, s := detector.TamperingSuspected(err), SignalReadTimeout
+		if classified, ok := dc.classifyError(err); ok {
+			suspected, s = classified != SignalTransient, classified
+		}
+		if detection.DetectReadFailure && suspected && dc.signal(s) {
+			if unavailable := dc.detourUnavailable(); unavailable != nil {
+				dc.detected(&counters.DetouredReadTimeout, "detour", "read timeout")
+				return n, dc.detourWouldHaveHelped(unavailable, err)
+			}
 			// to avoid double submitting, we only resend Idempotent requests
 			// but return error directly to application for other requests.
-			if dc.isIdempotentRequest() {
-				log.Debugf("Detour HTTP GET request to %s", dc.addr)
+			if dc.canReplay() {
+				log.Debugf("Detour request to %s", dc.addr)
+				dc.detected(&counters.DetouredReadTimeout, "detour", "read timeout")
 				return dc.detour(b)
-			} else {
-				log.Debugf("Not HTTP GET request, add to whitelist")
-				AddToWl(dc.addr, false)
 			}
+			log.Debugf("Unable to replay request to %s, add to whitelist", dc.addr)
+			dc.addToWl(false)
 		}
 		return
 	}
+	if re := dc.cfg.successPatternFor(dc.addr); re != nil && !re.Match(b[:n]) {
+		log.Debugf("First read from %s %s doesn't match %v", dc.addr, dc.stateDesc(), re)
+		dc.step("not successful", nil)
+		if dc.signal(SignalUnsuccessful) {
+			if dc.canReplay() {
+				dc.detected(&counters.DetouredUnsuccessful, "detour", "unsuccessful")
+				return dc.detour(b)
+			}
+			log.Debugf("Unable to replay request to %s, add to whitelist", dc.addr)
+			dc.addToWl(false)
+		}
+	}
 	// Hijacked content is usualy encapsulated in one IP packet,
 	// so just check it in one read rather than consecutive reads.
-	if detector.FakeResponse(b) {
-		log.Tracef("Read %d bytes from %s %s, response is hijacked, detour", n, dc.addr, dc.stateDesc())
-		return dc.detour(b)
+	if detection.DetectHijackedResponse && detector.FakeResponse(b) {
+		log.Tracef("Read %d bytes from %s %s, response is hijacked", n, dc.addr, dc.stateDesc())
+		dc.step("response hijacked", nil)
+		if dc.signal(SignalResponseHijacked) {
+			if dc.canReplay() {
+				dc.detected(&counters.DetouredHijack, "detour", "response hijacked")
+				return dc.detour(b)
+			}
+			log.Debugf("Unable to replay request to %s, add to whitelist", dc.addr)
+			dc.addToWl(false)
+			return
+		}
+	}
+	if detection.DetectHijackedResponse && dc.cfg.DetectRedirectHijack && dc.redirectHijacked(b[:n]) {
+		log.Tracef("Read %d bytes from %s %s, redirect is hijacked", n, dc.addr, dc.stateDesc())
+		dc.step("redirect hijacked", nil)
+		if dc.signal(SignalRedirectHijacked) {
+			if dc.canReplay() {
+				dc.detected(&counters.DetouredHijack, "detour", "redirect hijacked")
+				return dc.detour(b)
+			}
+			log.Debugf("Unable to replay request to %s, add to whitelist", dc.addr)
+			dc.addToWl(false)
+			return
+		}
+	}
+	if req := dc.directReplayRequest(); req != nil {
+		var detour bool
+		if n, detour = dc.readDirectAhead(b, n, req); detour {
+			return dc.detour(b)
+		}
 	}
+	dc.stayDirect(n)
+	return
+}
+
+// stayDirect settles the connection to direct after a successful first read.
+func (dc *Conn) stayDirect(n int) {
 	log.Tracef("Read %d bytes from %s %s, set state to direct", n, dc.addr, dc.stateDesc())
+	dc.step("stay direct", nil)
+	dc.maybeVerifyContent()
+	dc.recordDirectSuccess()
+	dc.learnDirectLatency()
+	if dc.redetecting && whitelisted(dc.whitelistAddr()) {
+		atomic.AddInt64(&counters.FalsePositiveDetours, 1)
+		dc.learnFalsePositive()
+		dc.keepProbeTimeout()
+	}
+	if dc.redetecting && wlTemporarily(dc.whitelistAddr()) {
+		log.Debugf("%s is no longer blocked, remove from whitelist", dc.addr)
+		dc.removeFromWl()
+	}
+	dc.detected(&counters.StayedDirect, "direct", "first read")
 	dc.setState(stateDirect)
-	return
 }
 
 // followUpRead is called by Read() if a connection's state already settled
 func (dc *Conn) followUpRead(b []byte) (n int, err error) {
-	detector := blockDetector.Load().(*Detector)
-	if n, err = dc.countedRead(b); err != nil {
+	detector := dc.cfg.Detector
+	readStart := time.Now()
+	n, err = dc.countedRead(b)
+	if dc.inState(stateDirect) {
+		dc.sampleThroughput(n, time.Since(readStart))
+	}
+	if dc.cfg.DetourAutoReconnect && dc.inState(stateDetour) && dc.idleDisconnected(n, err) && dc.reconnectDetour() {
+		n, err = dc.countedRead(b)
+	}
+	if n > 0 && dc.inState(stateDetour) {
+		dc.recordDetourLatency()
+	}
+	if err != nil {
 		if err == io.EOF {
 			log.Tracef("Read %d bytes from %s %s, EOF", n, dc.addr, dc.stateDesc())
 			return
@@ -226,11 +1027,12 @@ func (dc *Conn) followUpRead(b []byte) (n int, err error) {
 			// we only check first 4K bytes, which roughly equals to the payload of 3 full packets on Ethernet
 			if atomic.LoadInt64(&dc.readBytes) <= 4096 {
 				log.Tracef("Seems %s still blocked, add to whitelist so will try detour next time", dc.addr)
-				AddToWl(dc.addr, false)
+				dc.addToWl(false)
 			}
-		case dc.inState(stateDetour) && wlTemporarily(dc.addr):
+		case dc.inState(stateDetour) && wlTemporarily(dc.whitelistAddr()):
 			log.Tracef("Detoured route is not reliable for %s, not whitelist it", dc.addr)
-			RemoveFromWl(dc.addr)
+			dc.recordDetourFailure()
+			dc.removeFromWl()
 		}
 		return
 	}
@@ -238,7 +1040,7 @@ func (dc *Conn) followUpRead(b []byte) (n int, err error) {
 	// so just check it in one read rather than consecutive reads.
 	if dc.inState(stateDirect) && detector.FakeResponse(b) {
 		log.Tracef("%s still content hijacked, add to whitelist so will try detour next time", dc.addr)
-		AddToWl(dc.addr, false)
+		dc.addToWl(false)
 		return
 	}
 	log.Tracef("Read %d bytes from %s %s", n, dc.addr, dc.stateDesc())
@@ -247,57 +1049,268 @@ func (dc *Conn) followUpRead(b []byte) (n int, err error) {
 
 // detour sets up a detoured connection and try read again from it
 func (dc *Conn) detour(b []byte) (n int, err error) {
-	if err = dc.setupDetour(); err != nil {
-		log.Errorf("Error while dialing detoured connection: %s", err)
-		return
+	if unavailable := dc.detourUnavailable(); unavailable != nil {
+		return 0, dc.detourWouldHaveHelped(unavailable, nil)
 	}
-	if _, err = dc.resend(); err != nil {
-		err = fmt.Errorf("Error while resend buffer to %s: %s", dc.addr, err)
-		log.Error(err)
+	deadline := dc.detourDeadline()
+	if err = dc.setupDetour(deadline); err != nil {
+		log.Errorf("Error while setting up detoured connection: %s", err)
+		if dc.overallExceeded() {
+			err = ErrOverallTimeout
+		}
 		return
 	}
 	dc.setState(stateDetour)
-	if n, err = dc.countedRead(b); err != nil {
+	dc.step("detour first read", nil)
+	if !deadline.IsZero() {
+		readDeadline := dc.readDeadline()
+		if readDeadline.IsZero() || deadline.Before(readDeadline) {
+			if err := dc.getConn().SetReadDeadline(deadline); err != nil {
+				log.Debugf("Unable to set read deadline: %v", err)
+			}
+			defer func() {
+				if err := dc.getConn().SetReadDeadline(readDeadline); err != nil {
+					log.Debugf("Unable to set read deadline: %v", err)
+				}
+			}()
+		}
+	}
+	if req := dc.restartableRequest(); req != nil {
+		n, err = dc.readWithRestart(b, req, deadline)
+	} else {
+		n, err = dc.countedRead(b)
+	}
+	dc.step("detour first read done", err)
+	if n > 0 {
+		dc.recordDetourLatency()
+	}
+	if err != nil {
 		log.Debugf("Read from %s %s still failed: %s", dc.addr, dc.stateDesc(), err)
+		dc.recordDetourFailure()
+		if dc.overallExceeded() {
+			err = ErrOverallTimeout
+		}
 		return
 	}
+	if dc.cfg.CheckDetourHijack && dc.hijacked(b[:n]) {
+		log.Debugf("Read %d bytes from %s %s, response is hijacked too", n, dc.addr, dc.stateDesc())
+		dc.step("detour hijacked", nil)
+		dc.recordDetourFailure()
+		return 0, ErrDetourHijacked
+	}
 	log.Tracef("Read %d bytes from %s %s, add to whitelist", n, dc.addr, dc.stateDesc())
-	AddToWl(dc.addr, false)
+	dc.addToWl(false)
 	return
 }
 
+// hijacked checks b against the same hijack rules as the first read from a
+// direct connection.
+func (dc *Conn) hijacked(b []byte) bool {
+	if !dc.cfg.detectionFor(dc.addr).DetectHijackedResponse {
+		return false
+	}
+	return dc.cfg.Detector.FakeResponse(b) || dc.cfg.DetectRedirectHijack && dc.redirectHijacked(b)
+}
+
+// SetCheckDetourHijack controls whether the first read from a detoured
+// connection is checked for hijacked content the same way as a direct one, in
+// which case the read fails with ErrDetourHijacked rather than delivering the
+// block page, and the site is not added to whitelist. Enabled by default.
+func SetCheckDetourHijack(enabled bool) {
+	UpdateConfig(func(c Config) Config {
+		c.CheckDetourHijack = enabled
+		return c
+	})
+}
+
+// detourDeadline returns the deadline of a detour phase starting now, which is
+// the earlier of the detour timeout and the overall deadline, or zero if
+// neither is set.
+func (dc *Conn) detourDeadline() time.Time {
+	deadline := dc.overallDeadline
+	if d := dc.cfg.DetourTimeout; d > 0 {
+		if t := time.Now().Add(d); deadline.IsZero() || t.Before(deadline) {
+			deadline = t
+		}
+	}
+	return deadline
+}
+
+// overallExceeded checks if the overall timeout of this connection, if any, is
+// exceeded.
+func (dc *Conn) overallExceeded() bool {
+	return !dc.overallDeadline.IsZero() && !time.Now().Before(dc.overallDeadline)
+}
+
+// addToWl adds the site to whitelist unless disabled for this connection.
+func (dc *Conn) addToWl(permanent bool) {
+	if dc.noWhitelist {
+		log.Tracef("Not adding %s to whitelist as requested", dc.addr)
+		return
+	}
+	if dc.cfg.Paused {
+		log.Tracef("Detour is paused, not adding %s to whitelist", dc.addr)
+		return
+	}
+	if time.Now().Before(dc.cfg.DetourSuspendedUntil) {
+		log.Tracef("Detour is suspended, not adding %s to whitelist", dc.addr)
+		return
+	}
+	if dc.redetecting && !permanent && wlPermanently(dc.whitelistAddr()) {
+		log.Tracef("%s is still blocked and already whitelisted permanently", dc.addr)
+		return
+	}
+	if dc.cfg.VerifyBeforeTrust && dc.directDialer != nil {
+		addr := dc.whitelistAddr()
+		if permanent && WhitelistedProvisionally(addr) {
+			log.Tracef("%s is not verified yet, not adding to whitelist permanently", dc.addr)
+			return
+		}
+		if !permanent && addProvisionally(addr) {
+			dc.muLocalBuffer.Lock()
+			var req []byte
+			if dc.localBuffer != nil {
+				req = append(req, dc.localBuffer.Bytes()...)
+			}
+			dc.muLocalBuffer.Unlock()
+			go dc.verifyBlocked(addr, req)
+			return
+		}
+	}
+	AddToWl(dc.whitelistAddr(), permanent)
+	storeAdd(dc.cfg, dc.whitelistAddr(), permanent)
+}
+
+// removeFromWl removes the site from whitelist and the whitelist store if any.
+func (dc *Conn) removeFromWl() {
+	RemoveFromWl(dc.whitelistAddr())
+	storeRemove(dc.cfg, dc.whitelistAddr())
+}
+
+// detourUnavailable returns why the connection can't detour if so, i.e.
+// ErrDetourWouldHaveHelped if paused, or ErrProxyAuthRequired if falling back
+// to direct as the proxy required authentication.
+func (dc *Conn) detourUnavailable() error {
+	if dc.cfg.Paused {
+		return ErrDetourWouldHaveHelped
+	}
+	if dc.cfg.FallbackDirectOnProxyAuth && proxyAuthRequired() {
+		return ErrProxyAuthRequired
+	}
+	return nil
+}
+
+// detourWouldHaveHelped returns the error when detour is unavailable but the
+// site seems blocked, wrapping the reason returned by detourUnavailable().
+func (dc *Conn) detourWouldHaveHelped(unavailable error, err error) error {
+	log.Debugf("Detour is unavailable (%v) but %s seems blocked %s: %v", unavailable, dc.addr, dc.stateDesc(), err)
+	dc.step("detour unavailable", err)
+	if err == nil {
+		return fmt.Errorf("%w: %s", unavailable, dc.addr)
+	}
+	return fmt.Errorf("%w: %s: %s", unavailable, dc.addr, err)
+}
+
+// dialDetourConn dials the detour with the address rewritten if required, see
+// SetDetourAddrRewriter().
+func (dc *Conn) dialDetourConn(ctx context.Context) (net.Conn, error) {
+	if deadline := dc.detourDeadline(); !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	dc.step("dial detour", nil)
+	dc.detourStart = time.Now()
+	attempts := dc.numAttempts()
+	conn, err := dc.detourDialer()(dc.withAttemptLog(ctx), dc.network, rewriteDetourAddr(dc.cfg.DetourAddrRewriter, dc.addr))
+	dc.step("dialed detour", err)
+	if dc.numAttempts() == attempts {
+		// not recorded by the dialer itself
+		dc.attempt("detour", err)
+	}
+	if err != nil {
+		dc.recordDetourFailure()
+		if errors.Is(err, ErrProxyAuthRequired) {
+			proxyAuthRejected()
+		}
+	}
+	return conn, err
+}
+
+// detourDialer returns the dialer bound to the host in whitelist if any, or
+// the one passed to Dialer().
+func (dc *Conn) detourDialer() dialFunc {
+	if d := wlDialer(dc.addr); d != nil {
+		return d
+	}
+	return dc.dialDetour
+}
+
+// resend writes the local buffer to the current connection. The caller should
+// hold muLocalBuffer until bytes written as Buffer.Bytes is subject to change
+// through Buffer.Write().
 func (dc *Conn) resend() (int, error) {
-	dc.muLocalBuffer.Lock()
-	// we have to hold the lock until bytes written
-	// as Buffer.Bytes is subject to change through Buffer.Write()
-	defer dc.muLocalBuffer.Unlock()
-	b := dc.localBuffer.Bytes()
-	if len(b) == 0 {
+	if dc.localBuffer == nil || dc.localBuffer.Len() == 0 {
 		return 0, nil
 	}
+	b := dc.localBuffer.Bytes()
+	if dc.debugging() {
+		dc.replayed = append([]byte(nil), b...)
+	}
 	log.Tracef("Resending %d bytes from local buffer to %s", len(b), dc.addr)
 	n, err := dc.getConn().Write(b)
 	return n, err
 }
 
-func (dc *Conn) setupDetour() error {
-	c, err := dc.dialDetour(context.Background(), dc.network, dc.addr)
+// setupDetour dials a new detour connection, switches to it and resends the
+// local buffer.
+func (dc *Conn) setupDetour(deadline time.Time) error {
+	ctx := context.Background()
+	if !deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+	c, err := dc.dialDetourConn(ctx)
 	if err != nil {
 		return err
 	}
 	log.Tracef("Dialed a new detour connection to %s", dc.addr)
+	// switch and resend under the same lock as Write() buffers, so a write
+	// racing with the switch is either resent or written to the new connection
+	// by Write(), never both or neither.
+	dc.muLocalBuffer.Lock()
+	defer dc.muLocalBuffer.Unlock()
 	dc.setConn(c)
+	if _, err := dc.resend(); err != nil {
+		return fmt.Errorf("Error while resend buffer to %s: %s", dc.addr, err)
+	}
 	return nil
 }
 
 // Write implements the function from net.Conn
 func (dc *Conn) Write(b []byte) (n int, err error) {
+	atomic.StoreInt64(&dc.lastWriteNanos, time.Now().UnixNano())
+	var conn net.Conn
+	var buffered bool
 	if dc.inState(stateInitial) {
-		if n, err = dc.writeLocalBuffer(b); err != nil {
-			return n, fmt.Errorf("Unable to write local buffer: %s", err)
+		// always buffer the whole write, no matter how much of it the direct
+		// connection accepts, so the detour gets exactly what was intended.
+		if conn, buffered, err = dc.writeLocalBuffer(b); err != nil {
+			return 0, fmt.Errorf("Unable to write local buffer: %s", err)
 		}
+	} else {
+		conn = dc.getConn()
 	}
-	if n, err = dc.getConn().Write(b); err != nil {
+	if n, err = conn.Write(b); err != nil {
+		// only if what's written can be resent, otherwise the caller would
+		// never know it's lost.
+		if dc.inState(stateInitial) && buffered && dc.canReplay() && dc.cfg.Detector.TamperingSuspected(err) {
+			// the following read will fail too and detour, which resends the
+			// local buffer, so don't let the caller retry a partial write.
+			log.Debugf("Only wrote %d of %d bytes to %s %s, leave it to detour: %s", n, len(b), dc.addr, dc.stateDesc(), err)
+			return len(b), nil
+		}
 		log.Debugf("Error while write %d bytes to %s %s: %s", len(b), dc.addr, dc.stateDesc(), err)
 		return
 	}
@@ -309,12 +1322,15 @@ func (dc *Conn) Write(b []byte) (n int, err error) {
 func (dc *Conn) Close() error {
 	log.Tracef("Closing %s connection to %s", dc.stateDesc(), dc.addr)
 	if atomic.LoadInt64(&dc.readBytes) > 0 {
-		if dc.inState(stateDetour) && wlTemporarily(dc.addr) {
+		if dc.inState(stateDetour) && wlTemporarily(dc.whitelistAddr()) {
 			log.Tracef("no error found till closing, add %s to permanent whitelist", dc.addr)
-			AddToWl(dc.addr, true)
+			dc.addToWl(true)
 		}
 	}
+	dc.observeDone(nil)
 	dc.setState(stateClosed)
+	dc.releaseLocalBuffer()
+	dc.reportClose()
 	conn := dc.getConn()
 	if conn == nil {
 		return nil
@@ -377,44 +1393,382 @@ func (dc *Conn) writeDeadline() time.Time {
 	return d.(time.Time)
 }
 
-func (dc *Conn) writeLocalBuffer(b []byte) (n int, err error) {
+func (dc *Conn) writeLocalBuffer(b []byte) (conn net.Conn, buffered bool, err error) {
 	dc.muLocalBuffer.Lock()
-	n, err = dc.localBuffer.Write(b)
-	dc.muLocalBuffer.Unlock()
-	return
+	defer dc.muLocalBuffer.Unlock()
+	// b is to be written to the connection as of buffering it, see
+	// setupDetour().
+	conn = dc.getConn()
+	if dc.replayDisabled || dc.cfg.noReplayFor(dc.addr) {
+		dc.replayDisabled = true
+		return conn, false, nil
+	}
+	if dc.replayTooLarge {
+		return conn, false, nil
+	}
+	if dc.localBuffer == nil {
+		dc.localBuffer = new(bytes.Buffer)
+	}
+	if max := dc.cfg.MaxReplayBytes; max > 0 && dc.localBuffer.Len()+len(b) > max {
+		log.Debugf("Written more than %d bytes to %s before first read, unable to replay", max, dc.addr)
+		dc.replayTooLarge = true
+		dc.dropLocalBuffer()
+		return conn, false, nil
+	}
+	if max := dc.cfg.MaxTotalBufferBytes; max > 0 && atomic.LoadInt64(&totalBufferedBytes)+int64(len(b)) > max {
+		log.Debugf("Buffered more than %d bytes in total, unable to replay to %s", max, dc.addr)
+		dc.replayTooLarge = true
+		dc.dropLocalBuffer()
+		return conn, false, nil
+	}
+	atomic.AddInt64(&totalBufferedBytes, int64(len(b)))
+	if _, err = dc.localBuffer.Write(b); err != nil {
+		return conn, false, err
+	}
+	return conn, true, nil
+}
+
+// dropLocalBuffer releases the local buffer. The caller should hold
+// muLocalBuffer.
+func (dc *Conn) dropLocalBuffer() {
+	if dc.localBuffer != nil {
+		atomic.AddInt64(&totalBufferedBytes, -int64(dc.localBuffer.Len()))
+		dc.localBuffer = nil
+	}
 }
 
-func (dc *Conn) resetLocalBuffer() {
+func (dc *Conn) localBufferLen() int {
 	dc.muLocalBuffer.Lock()
-	dc.localBuffer.Reset()
+	defer dc.muLocalBuffer.Unlock()
+	if dc.localBuffer == nil {
+		return 0
+	}
+	return dc.localBuffer.Len()
+}
+
+func (dc *Conn) releaseLocalBuffer() {
+	dc.muLocalBuffer.Lock()
+	dc.dropLocalBuffer()
 	dc.muLocalBuffer.Unlock()
 }
 
-var nonIdempotentMethods = [][]byte{
-	[]byte("POST "),
-	[]byte("PATCH "),
+// ReplayClass is what the bytes written before the first read look like,
+// which decides whether they can be resent to detour.
+type ReplayClass int
+
+const (
+	// ReplayNothingWritten means nothing was written, see
+	// SetDetourServerFirst().
+	ReplayNothingWritten ReplayClass = iota
+	// ReplayTLSHandshake is a TLS handshake, which is safe to resend.
+	ReplayTLSHandshake
+	// ReplayIdempotentHTTP is an HTTP request with an idempotent method.
+	ReplayIdempotentHTTP
+	// ReplayNonIdempotentHTTP is an HTTP request which is not resent to avoid
+	// double submitting.
+	ReplayNonIdempotentHTTP
+	// ReplayUnknown is any other protocol, see SetReplayUnknownProtocols().
+	ReplayUnknown
+	// ReplayTooLarge means more than can be buffered was written, see
+	// SetMaxReplayBytes() and SetMaxTotalBufferBytes(), no matter what it looks
+	// like.
+	ReplayTooLarge
+	// ReplayDisabled means something was written but not buffered as replay is
+	// disabled for the host, see SetNoReplayFor().
+	ReplayDisabled
+)
+
+var replayClassDesc = []string{
+	"nothing written",
+	"TLS handshake",
+	"idempotent HTTP",
+	"non-idempotent HTTP",
+	"unknown",
+	"too large",
+	"replay disabled",
+}
+
+func (c ReplayClass) String() string {
+	return replayClassDesc[c]
 }
 
 // ref section 9.1.2 of https://www.ietf.org/rfc/rfc2616.txt.
-// checks against non-idemponent methods actually,
-// as we consider the https handshake phase to be idemponent.
-func (dc *Conn) isIdempotentRequest() bool {
+var httpMethods = map[string]bool{
+	"GET":     true,
+	"HEAD":    true,
+	"PUT":     true,
+	"DELETE":  true,
+	"OPTIONS": true,
+	"TRACE":   true,
+	"CONNECT": true,
+	"POST":    false,
+	"PATCH":   false,
+}
+
+// SetWhitelistByRequestTarget controls whether a site is added to or removed
+// from whitelist by the target of the HTTP request written before the first
+// read, taken from the CONNECT or absolute-form request line or the Host
+// header, rather than the address dialed, e.g. when dialing an HTTP proxy
+// frontend rather than the site. Disabled by default.
+func SetWhitelistByRequestTarget(enabled bool) {
+	UpdateConfig(func(c Config) Config {
+		c.WhitelistByRequestTarget = enabled
+		return c
+	})
+}
+
+// captureRequestTarget keeps the target of the request written so far, if
+// any, as the local buffer is released after the first read.
+func (dc *Conn) captureRequestTarget() {
 	dc.muLocalBuffer.Lock()
 	defer dc.muLocalBuffer.Unlock()
-	b := dc.localBuffer.Bytes()
-	if len(b) > 4 {
-		for _, m := range nonIdempotentMethods {
-			if bytes.HasPrefix(b, m) {
-				return false
-			}
+	if dc.localBuffer == nil {
+		return
+	}
+	if target := requestTarget(dc.localBuffer.Bytes()); target != "" {
+		log.Tracef("Request to %s is for %s", dc.addr, target)
+		dc.requestTarget = target
+	}
+}
+
+// whitelistAddr returns the address to add to or remove from whitelist, see
+// SetWhitelistByRequestTarget().
+func (dc *Conn) whitelistAddr() string {
+	dc.muLocalBuffer.Lock()
+	defer dc.muLocalBuffer.Unlock()
+	if dc.requestTarget != "" {
+		return dc.requestTarget
+	}
+	return dc.addr
+}
+
+// requestTarget returns the target of the HTTP request in b, or empty if b
+// isn't a complete enough HTTP request.
+func requestTarget(b []byte) string {
+	i := bytes.Index(b, []byte("\r\n"))
+	if i < 0 {
+		return ""
+	}
+	parts := strings.Split(string(b[:i]), " ")
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "HTTP/") {
+		return ""
+	}
+	if parts[0] == http.MethodConnect {
+		return parts[1]
+	}
+	if u, err := url.Parse(parts[1]); err == nil && u.Host != "" {
+		return u.Host
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(b)))
+	if err != nil {
+		return ""
+	}
+	return req.Host
+}
+
+// SetReplayUnknownProtocols controls whether bytes which look like neither a
+// TLS handshake nor an HTTP request may be resent to detour. Disabled by
+// default as resending them may not be safe.
+func SetReplayUnknownProtocols(enabled bool) {
+	UpdateConfig(func(c Config) Config {
+		c.ReplayUnknownProtocols = enabled
+		return c
+	})
+}
+
+// SetReplayableMethods overrides which HTTP methods are considered idempotent,
+// so that requests with them may be resent to detour, e.g. to add a custom
+// safe method. Other requests which look like HTTP are never resent. Methods
+// are case sensitive. Pass nil to restore the default, which is GET, HEAD, PUT,
+// DELETE, OPTIONS, TRACE and CONNECT.
+func SetReplayableMethods(methods []string) {
+	var m map[string]bool
+	if methods != nil {
+		m = make(map[string]bool, len(methods))
+		for _, method := range methods {
+			m[method] = true
+		}
+	}
+	UpdateConfig(func(c Config) Config {
+		c.ReplayableMethods = m
+		return c
+	})
+}
+
+// SetNoReplayFor disables buffering what's written before the first read to
+// hostSuffix and its subdomains, e.g. for known upload-heavy endpoints, to save
+// memory. Connections to them can't be detoured once anything is written, but
+// still can if the first read fails before writing anything, see
+// SetDetourServerFirst().
+func SetNoReplayFor(hostSuffix string) {
+	host := normalizeHost(hostSuffix)
+	UpdateConfig(func(c Config) Config {
+		hosts := make(map[string]bool, len(c.NoReplayHosts)+1)
+		for k, v := range c.NoReplayHosts {
+			hosts[k] = v
+		}
+		hosts[host] = true
+		c.NoReplayHosts = hosts
+		return c
+	})
+}
+
+// noReplayFor checks if replay is disabled for addr, see SetNoReplayFor().
+func (c *Config) noReplayFor(addr string) bool {
+	if len(c.NoReplayHosts) == 0 {
+		return false
+	}
+	for host := hostOnly(addr); host != ""; host = getParentDomain(host) {
+		if c.NoReplayHosts[host] {
+			return true
+		}
+	}
+	return false
+}
+
+// SetMaxReplayBytes caps how many bytes written before the first read are
+// buffered to resend to detour. If more is written, e.g. an idempotent request
+// with a large body, the connection is not detoured midway. 0 means no limit.
+// Defaults to 1MB.
+func SetMaxReplayBytes(n int) {
+	UpdateConfig(func(c Config) Config {
+		c.MaxReplayBytes = n
+		return c
+	})
+}
+
+// SetMaxTotalBufferBytes caps how many bytes are buffered to resend to detour
+// across all connections, so the memory used is predictable no matter how
+// many connections are detecting at once. Once reached, connections don't
+// buffer further writes until the memory is freed, so can't be detoured
+// midway, the same as if exceeding SetMaxReplayBytes(). 0, the default, means
+// no limit.
+func SetMaxTotalBufferBytes(n int64) {
+	UpdateConfig(func(c Config) Config {
+		c.MaxTotalBufferBytes = n
+		return c
+	})
+}
+
+// BufferedBytes returns how many bytes are currently buffered to resend to
+// detour across all connections.
+func BufferedBytes() int64 {
+	return atomic.LoadInt64(&totalBufferedBytes)
+}
+
+// canReplay checks if what's been written so far can be resent to detour.
+func (dc *Conn) canReplay() bool {
+	class := dc.classifyReplay()
+	log.Tracef("Written to %s so far: %v", dc.addr, class)
+	switch class {
+	case ReplayNothingWritten:
+		return dc.cfg.DetourServerFirst
+	case ReplayTLSHandshake, ReplayIdempotentHTTP:
+		return true
+	case ReplayUnknown:
+		return dc.cfg.ReplayUnknownProtocols
+	}
+	return false
+}
+
+// ReplayClass returns what the bytes written before the first read look like,
+// as of the last time this connection decided whether to resend them to
+// detour.
+func (dc *Conn) ReplayClass() ReplayClass {
+	dc.muLocalBuffer.Lock()
+	defer dc.muLocalBuffer.Unlock()
+	return dc.replayClass
+}
+
+func (dc *Conn) classifyReplay() ReplayClass {
+	dc.muLocalBuffer.Lock()
+	defer dc.muLocalBuffer.Unlock()
+	if dc.replayDisabled {
+		dc.replayClass = ReplayDisabled
+		return dc.replayClass
+	}
+	if dc.replayTooLarge {
+		dc.replayClass = ReplayTooLarge
+		return dc.replayClass
+	}
+	var b []byte
+	if dc.localBuffer != nil {
+		b = dc.localBuffer.Bytes()
+	}
+	dc.replayClass = classifyReplay(b, dc.cfg.ReplayableMethods)
+	return dc.replayClass
+}
+
+// classifyReplay classifies b, taking the methods in replayable as idempotent
+// HTTP if not nil, see SetReplayableMethods().
+func classifyReplay(b []byte, replayable map[string]bool) ReplayClass {
+	if len(b) == 0 {
+		return ReplayNothingWritten
+	}
+	// content type handshake, major version 3
+	if len(b) >= 2 && b[0] == 0x16 && b[1] == 0x03 {
+		return ReplayTLSHandshake
+	}
+	sp := bytes.IndexByte(b, ' ')
+	if sp <= 0 {
+		return ReplayUnknown
+	}
+	method := string(b[:sp])
+	idempotent, ok := httpMethods[method]
+	if replayable != nil {
+		idempotent = replayable[method]
+		ok = ok || idempotent
+	}
+	switch {
+	case !ok:
+		return ReplayUnknown
+	case idempotent:
+		return ReplayIdempotentHTTP
+	default:
+		return ReplayNonIdempotentHTTP
+	}
+}
+
+// readAtLeast keeps reading into b after the n bytes already read, until min
+// bytes or a complete frame arrive, b is full, or the read fails.
+func (dc *Conn) readAtLeast(b []byte, n int, min int) (int, error) {
+	if min > len(b) {
+		min = len(b)
+	}
+	for n < min && !completeFrame(b[:n]) {
+		m, err := dc.countedRead(b[n:])
+		n += m
+		if err != nil {
+			log.Debugf("Only read %d bytes from %s %s, fewer than %d: %s", n, dc.addr, dc.stateDesc(), min, err)
+			return n, err
 		}
 	}
-	return true
+	return n, nil
+}
+
+// completeFrame checks if b starts with a complete HTTP response header or TLS
+// record.
+func completeFrame(b []byte) bool {
+	if bytes.HasPrefix(b, []byte("HTTP/")) {
+		return bytes.Contains(b, []byte("\r\n\r\n"))
+	}
+	// content type handshake or alert, major version 3
+	if len(b) >= 5 && (b[0] == 0x16 || b[0] == 0x15) && b[1] == 0x03 {
+		return len(b) >= 5+(int(b[3])<<8|int(b[4]))
+	}
+	return false
 }
 
 func (dc *Conn) countedRead(b []byte) (n int, err error) {
+	if len(dc.pending) > 0 || dc.pendingErr != nil {
+		// already counted
+		return dc.readPending(b)
+	}
 	n, err = dc.getConn().Read(b)
 	atomic.AddInt64(&dc.readBytes, int64(n))
+	if n > 0 {
+		atomic.StoreInt64(&dc.lastReadNanos, time.Now().UnixNano())
+	}
 	return
 }
 
@@ -451,4 +1805,9 @@ func (dc *Conn) inState(s uint32) bool {
 
 func (dc *Conn) setState(s uint32) {
 	atomic.StoreUint32(&dc.state, s)
+	if s == stateInitial {
+		dc.startDetecting()
+	} else {
+		dc.stopDetecting()
+	}
 }
@@ -1,16 +1,24 @@
 package detour
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
 	"net"
 	"net/http"
 	"net/url"
+	"os"
+	"regexp"
+	"runtime"
+	"strings"
 	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 
@@ -28,6 +36,19 @@ var (
 </head><body><iframe src="http://10.10.34.36?type=InvalidKeyword&policy=MainPolicy " style="width: 100%; height: 100%" scrolling="no" marginwidth="0" marginheight="0" frameborder="0" vspace="0" hspace="0"></iframe></body></html>Connection closed by foreign host.`
 )
 
+func TestMain(m *testing.M) {
+	// mock servers are all on loopback
+	SetDetectPrivateNetworks(true)
+	os.Exit(m.Run())
+}
+
+func setFirstReadTimeout(d time.Duration) {
+	UpdateConfig(func(c Config) Config {
+		c.FirstReadTimeout = d
+		return c
+	})
+}
+
 func proxyTo(proxiedURL string) dialFunc {
 	return func(ctx context.Context, network, addr string) (net.Conn, error) {
 		u, _ := url.Parse(proxiedURL)
@@ -39,7 +60,7 @@ func TestBlockedImmediately(t *testing.T) {
 	defer RemoveFromWl("127.0.0.1")
 	defer stopMockServers()
 	proxiedURL, _ := newMockServer(detourMsg)
-	firstReadTimeoutToDetour = 50 * time.Millisecond
+	setFirstReadTimeout(50 * time.Millisecond)
 	mockURL, mock := newMockServer(directMsg)
 
 	client := &http.Client{Timeout: 50 * time.Millisecond}
@@ -80,7 +101,7 @@ func TestReadFailedImmediately(t *testing.T) {
 	defer RemoveFromWl("127.0.0.1")
 	defer stopMockServers()
 	proxiedURL, _ := newMockServer(detourMsg)
-	firstReadTimeoutToDetour = 50 * time.Millisecond
+	setFirstReadTimeout(50 * time.Millisecond)
 	mockURL, _ := newMockServer(directMsg)
 
 	client := newDirectFailingClient(proxiedURL, 1*time.Hour, 0)
@@ -97,7 +118,7 @@ func TestReadFailedEventually(t *testing.T) {
 	defer RemoveFromWl("127.0.0.1")
 	defer stopMockServers()
 	proxiedURL, _ := newMockServer(detourMsg)
-	firstReadTimeoutToDetour = 50 * time.Millisecond
+	setFirstReadTimeout(50 * time.Millisecond)
 	longMessage := make([]byte, 10000)
 	rand.Read(longMessage)
 	mockURL, _ := newMockServer(string(longMessage))
@@ -119,7 +140,7 @@ func TestRemoveFromWhitelist(t *testing.T) {
 	defer stopMockServers()
 	proxiedURL, proxy := newMockServer(detourMsg)
 	proxy.Timeout(200*time.Millisecond, detourMsg)
-	firstReadTimeoutToDetour = 50 * time.Millisecond
+	setFirstReadTimeout(50 * time.Millisecond)
 	mockURL, _ := newMockServer(directMsg)
 	client := newDetourFailingClient(proxiedURL, 1*time.Hour, 0)
 
@@ -138,7 +159,7 @@ func TestClosing(t *testing.T) {
 	defer stopMockServers()
 	proxiedURL, proxy := newMockServer(detourMsg)
 	proxy.Timeout(200*time.Millisecond, detourMsg)
-	firstReadTimeoutToDetour = 50 * time.Millisecond
+	setFirstReadTimeout(50 * time.Millisecond)
 	mockURL, mock := newMockServer(directMsg)
 	mock.Msg(directMsg)
 	if _, err := newClient(proxiedURL, 100*time.Millisecond).Get(mockURL); err != nil {
@@ -147,10 +168,11 @@ func TestClosing(t *testing.T) {
 }
 
 func TestIranRules(t *testing.T) {
-	defer RemoveFromWl("localhost")
+	s := SaveState()
+	defer RestoreState(s)
 	defer stopMockServers()
 	proxiedURL, _ := newMockServer(detourMsg)
-	firstReadTimeoutToDetour = 50 * time.Millisecond
+	setFirstReadTimeout(50 * time.Millisecond)
 	SetCountry("IR")
 	u, mock := newMockServer(directMsg)
 	client := newClient(proxiedURL, 100*time.Millisecond)
@@ -171,6 +193,1202 @@ func TestIranRules(t *testing.T) {
 	}
 }
 
+func TestClearCountry(t *testing.T) {
+	s := SaveState()
+	defer RestoreState(s)
+	defer stopMockServers()
+	proxiedURL, _ := newMockServer(detourMsg)
+	setFirstReadTimeout(50 * time.Millisecond)
+	SetCountry("IR")
+	ClearCountry()
+	assert.Equal(t, "", DumpConfig().Country)
+	u, mock := newMockServer(directMsg)
+	RemoveFromWl(strings.TrimPrefix(u, "http://"))
+	client := newClient(proxiedURL, 100*time.Millisecond)
+
+	mock.Raw(iranResp)
+	before := Stats()
+	resp, err := client.Get(u)
+	if err == nil {
+		b, _ := ioutil.ReadAll(resp.Body)
+		assert.NotEqual(t, detourMsg, string(b), "should not detour if country cleared")
+	}
+	assert.Equal(t, before.DetouredHijack, Stats().DetouredHijack, "should not detect hijack if country cleared")
+}
+
+func TestSuspendDetourUntil(t *testing.T) {
+	s := SaveState()
+	defer RestoreState(s)
+	defer stopMockServers()
+	directAddr := newBannerServer("hello direct", 0)
+	detourAddr := newBannerServer("hello detour", 0)
+	dialer := Dialer(dialTo(directAddr), dialTo(detourAddr))
+	AddToWl("suspended.example.com", true)
+	ForceWhitelist("forced.example.com")
+
+	SuspendDetourUntil(time.Now().Add(200 * time.Millisecond))
+	assert.Equal(t, "hello direct", readOnce(t, dialer, "suspended.example.com:80"), "should dial whitelisted host directly while suspended")
+	_, err := dialer(context.Background(), "tcp", "forced.example.com:80")
+	assert.True(t, errors.Is(err, ErrDetourSuspended), "should fail dialing force whitelisted host while suspended")
+
+	time.Sleep(250 * time.Millisecond)
+	assert.Equal(t, "hello detour", readOnce(t, dialer, "suspended.example.com:80"), "should detour again once the suspension ends")
+	assert.Equal(t, "hello detour", readOnce(t, dialer, "forced.example.com:80"), "should detour again once the suspension ends")
+}
+
+func TestDetourHijacked(t *testing.T) {
+	s := SaveState()
+	defer RestoreState(s)
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	SetCountry("IR")
+	directAddr := newBannerServer(iranResp, 0)
+	detourAddr := newBannerServer(iranResp, 0)
+	dialer := Dialer(dialTo(directAddr), dialTo(detourAddr))
+	addr := "hijacked.example.com:80"
+
+	conn, err := dialer(context.Background(), "tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Read(make([]byte, 1024))
+	assert.Equal(t, ErrDetourHijacked, err, "should fail if detour is hijacked too")
+	conn.Close()
+	assert.False(t, whitelisted(addr), "should not whitelist if detour is hijacked too")
+
+	SetCheckDetourHijack(false)
+	assert.Equal(t, iranResp, readOnce(t, dialer, addr), "should deliver what detour read if not checked")
+}
+
+func TestHijackedNotReplayable(t *testing.T) {
+	s := SaveState()
+	defer RestoreState(s)
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	SetCountry("IR")
+	SetMaxReplayBytes(8)
+	directAddr := newBannerServer(iranResp, 0)
+	detourAddr := newBannerServer("hello detour", 0)
+	var detourDials int32
+	dialer := Dialer(dialTo(directAddr), func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&detourDials, 1)
+		return net.Dial(network, detourAddr)
+	})
+	addr := "hijacked-large.example.com:80"
+
+	conn, err := dialer(context.Background(), "tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: hijacked-large.example.com\r\n\r\n"))
+	assert.NoError(t, err)
+	before := Stats()
+	b := make([]byte, 1024)
+	n, err := conn.Read(b)
+	assert.NoError(t, err)
+	assert.Equal(t, iranResp, string(b[:n]), "should not detour if the request is too large to replay")
+	assert.Equal(t, int32(0), atomic.LoadInt32(&detourDials))
+	assert.Equal(t, int64(0), Stats().DetouredHijack-before.DetouredHijack)
+	assert.True(t, wlTemporarily(addr), "but should be added to whitelist so will detour next time")
+}
+
+func TestServerSpeaksFirst(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	directAddr := newBannerServer("", 0)
+	detourAddr := newBannerServer("220 detour ready\r\n", 0)
+	dialer := Dialer(
+		func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial(network, addr)
+		},
+		func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial(network, detourAddr)
+		},
+	)
+
+	conn, err := dialer(context.Background(), "tcp", directAddr)
+	if assert.NoError(t, err) {
+		b := make([]byte, 1024)
+		n, err := conn.Read(b)
+		if assert.NoError(t, err, "should detour if nothing was written before first read times out") {
+			assert.Equal(t, "220 detour ready\r\n", string(b[:n]))
+		}
+		conn.Close()
+	}
+
+	RemoveFromWl(directAddr)
+	SetDetourServerFirst(false)
+	defer SetDetourServerFirst(true)
+	conn, err = dialer(context.Background(), "tcp", directAddr)
+	if assert.NoError(t, err) {
+		_, err := conn.Read(make([]byte, 1024))
+		assert.Error(t, err, "should not detour if disabled")
+		assert.True(t, wlTemporarily(directAddr), "but should be added to whitelist so will detour next time")
+		conn.Close()
+	}
+}
+
+func TestShortWriteReplay(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	directAddr := newBannerServer("", 0)
+	detourAddr := newEchoServer()
+	dialer := Dialer(
+		func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, addr)
+			if err == nil {
+				conn = &shortWriteConn{conn}
+			}
+			return conn, err
+		},
+		func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial(network, detourAddr)
+		},
+	)
+
+	conn, err := dialer(context.Background(), "tcp", directAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	payload := make([]byte, 64*1024)
+	rand.Read(payload)
+	// look like a TLS handshake so it can be replayed
+	payload[0], payload[1] = 0x16, 0x03
+	n, err := conn.Write(payload)
+	if assert.NoError(t, err, "should not fail the write if direct connection only accepts part of it") {
+		assert.Equal(t, len(payload), n)
+	}
+	received := make([]byte, len(payload))
+	_, err = io.ReadFull(conn, received)
+	if assert.NoError(t, err, "should detour") {
+		assert.Equal(t, payload, received, "detour should receive the complete original bytes")
+	}
+}
+
+func TestShortWriteNotReplayable(t *testing.T) {
+	s := SaveState()
+	defer RestoreState(s)
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	directAddr := newBannerServer("", 0)
+	detourAddr := newEchoServer()
+	dialer := Dialer(
+		func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := net.Dial(network, directAddr)
+			if err == nil {
+				conn = &shortWriteConn{conn}
+			}
+			return conn, err
+		},
+		dialTo(detourAddr),
+	)
+	write := func(addr string, b []byte) error {
+		conn, err := dialer(context.Background(), "tcp", addr)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer conn.Close()
+		_, err = conn.Write(b)
+		return err
+	}
+
+	post := []byte("POST / HTTP/1.1\r\nHost: example.com\r\nContent-Length: 2\r\n\r\nhi")
+	assert.Error(t, write("post.example.com:80", post), "should fail the write if it can't be replayed")
+	SetNoReplayFor("noreplay.example.com")
+	get := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	assert.Error(t, write("noreplay.example.com:80", get), "should fail the write if replay is disabled")
+	SetMaxReplayBytes(8)
+	assert.Error(t, write("large.example.com:80", get), "should fail the write if too large to buffer")
+}
+
+func TestDetourFirst(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	SetDefaultDialOrder(DetourFirst)
+	defer SetDefaultDialOrder(DirectFirst)
+	directAddr := newBannerServer("hello direct", 0)
+	detourAddr := newBannerServer("hello detour", 0)
+	var directDials, detourDials int32
+	detourFails := false
+	dialer := Dialer(
+		func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&directDials, 1)
+			return net.Dial(network, addr)
+		},
+		func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&detourDials, 1)
+			if detourFails {
+				return nil, errors.New("detour failed")
+			}
+			return net.Dial(network, detourAddr)
+		},
+	)
+
+	conn, err := dialer(context.Background(), "tcp", directAddr)
+	if assert.NoError(t, err) {
+		b := make([]byte, 1024)
+		n, err := conn.Read(b)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "hello detour", string(b[:n]))
+		}
+		conn.Close()
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&detourDials))
+	assert.EqualValues(t, 0, atomic.LoadInt32(&directDials), "should never touch the direct dialer if detour works")
+	assert.False(t, whitelisted(directAddr), "should not add to whitelist")
+
+	detourFails = true
+	conn, err = dialer(context.Background(), "tcp", directAddr)
+	if assert.NoError(t, err) {
+		b := make([]byte, 1024)
+		n, err := conn.Read(b)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "hello direct", string(b[:n]), "should fall back to direct if detour fails")
+		}
+		conn.Close()
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&directDials))
+}
+
+func TestDetourWithBoundDialer(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	directAddr := newBannerServer("hello direct", 0)
+	detourAddr := newBannerServer("hello detour", 0)
+	boundAddr := newBannerServer("hello bound", 0)
+	dialer := Dialer(dialTo(directAddr), dialTo(detourAddr))
+
+	AddToWlWithDialer(directAddr, false, dialTo(boundAddr))
+	assert.Equal(t, "hello bound", readOnce(t, dialer, directAddr), "should detour via the bound dialer")
+	AddToWl(directAddr, true)
+	assert.Equal(t, "hello bound", readOnce(t, dialer, directAddr), "should keep the bound dialer when updating the entry")
+	AddToWlForNetwork(directAddr, "tcp", false)
+	AddToWlLabeled(directAddr, false, "bound")
+	AddToWl(directAddr, true)
+	AddToWlWithDialer(directAddr, false, nil)
+	assert.Equal(t, "hello detour", readOnce(t, dialer, directAddr), "should fall back to the default detour dialer")
+	muWhitelist.RLock()
+	e := whitelist[hostOnly(directAddr)]
+	muWhitelist.RUnlock()
+	assert.True(t, e.permanent, "should keep the entry permanent")
+	assert.Equal(t, "bound", e.label, "should keep the label")
+	assert.Equal(t, "tcp", e.network, "should keep the network")
+}
+
+func TestStats(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	detourAddr := newBannerServer("hello detour", 0)
+	assertStats := func(expected DetectionStats, before DetectionStats, msg string) {
+		after := Stats()
+		assert.Equal(t, expected, DetectionStats{
+			DetouredDialFailure: after.DetouredDialFailure - before.DetouredDialFailure,
+			DetouredReadTimeout: after.DetouredReadTimeout - before.DetouredReadTimeout,
+			DetouredHijack:      after.DetouredHijack - before.DetouredHijack,
+			StayedDirect:        after.StayedDirect - before.StayedDirect,
+		}, msg)
+	}
+
+	before := Stats()
+	failingDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+	}
+	readOnce(t, Dialer(failingDial, dialTo(detourAddr)), "127.0.0.1:1")
+	assertStats(DetectionStats{DetouredDialFailure: 1}, before, "should count dial failure")
+	RemoveFromWl("127.0.0.1")
+
+	before = Stats()
+	blackhole := newBannerServer("", 0)
+	readOnce(t, Dialer(dialTo(blackhole), dialTo(detourAddr)), blackhole)
+	assertStats(DetectionStats{DetouredReadTimeout: 1}, before, "should count read timeout")
+	RemoveFromWl("127.0.0.1")
+
+	before = Stats()
+	SetCountry("IR")
+	hijacked := newBannerServer(iranResp, 0)
+	readOnce(t, Dialer(dialTo(hijacked), dialTo(detourAddr)), hijacked)
+	SetCountry("")
+	assertStats(DetectionStats{DetouredHijack: 1}, before, "should count hijack")
+	RemoveFromWl("127.0.0.1")
+
+	before = Stats()
+	direct := newBannerServer("hello direct", 0)
+	readOnce(t, Dialer(dialTo(direct), dialTo(detourAddr)), direct)
+	assertStats(DetectionStats{StayedDirect: 1}, before, "should count staying direct")
+}
+
+func TestUnreachable(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	detourAddr := newBannerServer("hello detour", 0)
+	for _, err := range []error{
+		&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)},
+		&net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)},
+		// not even a net.Error
+		fmt.Errorf("Unable to dial: %w", syscall.EHOSTUNREACH),
+	} {
+		dialErr := err
+		before := Stats()
+		unreachableDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, dialErr
+		}
+		assert.Equal(t, "hello detour", readOnce(t, Dialer(unreachableDial, dialTo(detourAddr)), "127.0.0.1:1"), "should detour on %v", dialErr)
+		assert.True(t, whitelisted("127.0.0.1"), "should whitelist on %v", dialErr)
+		after := Stats()
+		assert.EqualValues(t, 1, after.DetouredUnreachable-before.DetouredUnreachable, "should count as unreachable")
+		assert.EqualValues(t, 0, after.DetouredDialFailure-before.DetouredDialFailure, "should not count as generic dial failure")
+		RemoveFromWl("127.0.0.1")
+	}
+}
+
+func TestDetourAddrRewriter(t *testing.T) {
+	defer RemoveFromWl("example.com")
+	defer SetDetourAddrRewriter(nil)
+	var directAddr, detourAddr string
+	dialer := Dialer(
+		func(ctx context.Context, network, addr string) (net.Conn, error) {
+			directAddr = addr
+			return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+		},
+		func(ctx context.Context, network, addr string) (net.Conn, error) {
+			detourAddr = addr
+			return nil, errors.New("detour failed")
+		},
+	)
+
+	SetDetourAddrRewriter(func(addr string) string { return "93.184.216.34" })
+	dialer(context.Background(), "tcp", "example.com:443")
+	assert.Equal(t, "example.com:443", directAddr, "direct should use the original address")
+	assert.Equal(t, "93.184.216.34:443", detourAddr, "detour should use the rewritten address with port preserved")
+
+	SetDetourAddrRewriter(func(addr string) string { return "[::1]:8443" })
+	dialer(context.Background(), "tcp", "example.com:443")
+	assert.Equal(t, "[::1]:8443", detourAddr, "should use the port set by the rewriter")
+}
+
+func TestPrivateNetworks(t *testing.T) {
+	SetDetectPrivateNetworks(false)
+	defer SetDetectPrivateNetworks(true)
+	defer RemoveFromWl("192.168.1.1")
+	var detourDials int32
+	dialer := Dialer(
+		func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c1, c2 := net.Pipe()
+			c2.Close()
+			return c1, nil
+		},
+		func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&detourDials, 1)
+			return nil, errors.New("should not detour")
+		},
+	)
+	AddToWl("192.168.1.1", true)
+	for _, addr := range []string{"10.1.2.3:80", "192.168.1.1:443", "127.0.0.1:80", "[::1]:80", "[fe80::1]:80"} {
+		conn, err := dialer(context.Background(), "tcp", addr)
+		if assert.NoError(t, err) {
+			assert.True(t, conn.(*Conn).inState(stateDirect), "%s should skip detection", addr)
+			conn.Close()
+		}
+	}
+	assert.EqualValues(t, 0, atomic.LoadInt32(&detourDials), "should never detour private addresses")
+
+	conn, err := dialer(context.Background(), "tcp", "8.8.8.8:53")
+	if assert.NoError(t, err) {
+		assert.True(t, conn.(*Conn).inState(stateInitial), "public address should go through detection")
+		conn.Close()
+	}
+}
+
+func TestOverallTimeout(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	SetOverallTimeout(150 * time.Millisecond)
+	defer SetOverallTimeout(0)
+
+	// slow to read from both direct and detour
+	directAddr := newBannerServer("", 0)
+	detourAddr := newBannerServer("", 0)
+	start := time.Now()
+	conn, err := Dialer(dialTo(directAddr), dialTo(detourAddr))(context.Background(), "tcp", directAddr)
+	if assert.NoError(t, err) {
+		_, err = conn.Read(make([]byte, 1024))
+		assert.Equal(t, ErrOverallTimeout, err, "should fail if both direct and detour are slow")
+		conn.Close()
+	}
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 150*time.Millisecond && elapsed < time.Second, "should time out after overall timeout, took %v", elapsed)
+	RemoveFromWl(directAddr)
+
+	// slow to dial both direct and detour
+	slowDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	start = time.Now()
+	_, err = Dialer(slowDial, slowDial)(context.Background(), "tcp", "example.com:80")
+	assert.Equal(t, ErrOverallTimeout, err, "should fail if dialing both direct and detour are slow")
+	elapsed = time.Since(start)
+	assert.True(t, elapsed >= 150*time.Millisecond && elapsed < time.Second, "should time out after overall timeout, took %v", elapsed)
+	assert.False(t, whitelisted("example.com:80"))
+}
+
+func TestDetourTimeout(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	SetDetourTimeout(150 * time.Millisecond)
+	defer SetDetourTimeout(30 * time.Second)
+
+	// the detour proxy accepts but never responds
+	directAddr := newBannerServer("", 0)
+	detourAddr := newBannerServer("", 0)
+	start := time.Now()
+	conn, err := Dialer(dialTo(directAddr), dialTo(detourAddr))(context.Background(), "tcp", directAddr)
+	if assert.NoError(t, err) {
+		_, err = conn.Read(make([]byte, 1024))
+		if assert.Error(t, err, "should fail if detour hangs") {
+			netErr, ok := err.(net.Error)
+			assert.True(t, ok && netErr.Timeout(), "should be a timeout error, got %v", err)
+		}
+		conn.Close()
+	}
+	elapsed := time.Since(start)
+	assert.True(t, elapsed >= 200*time.Millisecond && elapsed < time.Second, "should time out after detection and detour timeouts, took %v", elapsed)
+	RemoveFromWl(directAddr)
+
+	// the detour proxy never finishes dialing
+	hangingDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	AddToWl("example.com:80", false)
+	defer RemoveFromWl("example.com:80")
+	start = time.Now()
+	_, err = Dialer(dialTo(directAddr), hangingDial)(context.Background(), "tcp", "example.com:80")
+	assert.Error(t, err, "should fail if dialing detour hangs")
+	elapsed = time.Since(start)
+	assert.True(t, elapsed >= 150*time.Millisecond && elapsed < time.Second, "should time out after detour timeout, took %v", elapsed)
+}
+
+func TestThrottled(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(500 * time.Millisecond)
+	SetMinFirstReadBytesPerSec(1000)
+	defer SetMinFirstReadBytesPerSec(0)
+	SetThrottleSampleBytes(10)
+	defer SetThrottleSampleBytes(4096)
+	detourAddr := newBannerServer("hello detour", 0)
+	readFull := func(addr string, n int) {
+		conn, err := Dialer(dialTo(addr), dialTo(detourAddr))(context.Background(), "tcp", addr)
+		if assert.NoError(t, err) {
+			_, err = io.ReadFull(conn, make([]byte, n))
+			assert.NoError(t, err)
+			conn.Close()
+		}
+	}
+
+	directAddr := newDripServer("hello direct, slowly", 20*time.Millisecond)
+	before := Stats()
+	readFull(directAddr, 15)
+	assert.EqualValues(t, 1, Stats().WhitelistedThrottled-before.WhitelistedThrottled)
+	assert.True(t, whitelisted(directAddr), "should add to whitelist if throttled")
+	assert.Equal(t, "hello detour", readOnce(t, Dialer(dialTo(directAddr), dialTo(detourAddr)), directAddr), "should detour later connections once throttled")
+	RemoveFromWl(directAddr)
+
+	directAddr = newDripServer("hi", 20*time.Millisecond)
+	readFull(directAddr, 2)
+	assert.False(t, whitelisted(directAddr), "should not judge before enough bytes are read")
+
+	directAddr = newBannerServer(strings.Repeat("x", 2048), 200*time.Millisecond)
+	readFull(directAddr, 2048)
+	assert.EqualValues(t, 1, Stats().WhitelistedThrottled-before.WhitelistedThrottled)
+	assert.False(t, whitelisted(directAddr), "should not count the time to first byte")
+}
+
+func TestDetectionSampleRate(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	SetDetectionSampleRate(0)
+	defer SetDetectionSampleRate(1)
+	detourAddr := newBannerServer("hello detour", 0)
+
+	blackhole := newBannerServer("", 0)
+	conn, err := Dialer(dialTo(blackhole), dialTo(detourAddr))(context.Background(), "tcp", blackhole)
+	if assert.NoError(t, err) {
+		assert.True(t, conn.(*Conn).inState(stateDirect), "should skip detection if not sampled")
+		_ = conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, err = conn.Read(make([]byte, 1024))
+		assert.Error(t, err, "should not detour if the first read times out")
+		conn.Close()
+	}
+	RemoveFromWl("127.0.0.1")
+
+	failingDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+	}
+	assert.Equal(t, "hello detour", readOnce(t, Dialer(failingDial, dialTo(detourAddr)), "127.0.0.1:1"), "should still detour if dialing directly fails")
+}
+
+func TestInDetectionWindow(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	detourAddr := newBannerServer("hello detour", 0)
+	for _, directAddr := range []string{newBannerServer("hello direct", 0), newBannerServer("", 0)} {
+		conn, err := Dialer(dialTo(directAddr), dialTo(detourAddr))(context.Background(), "tcp", directAddr)
+		if !assert.NoError(t, err) {
+			continue
+		}
+		dc := conn.(*Conn)
+		assert.True(t, dc.InDetectionWindow(), "should be in detection window before the first read")
+		_, err = conn.Read(make([]byte, 1024))
+		assert.NoError(t, err)
+		assert.False(t, dc.InDetectionWindow(), "should leave detection window once decided")
+		conn.Close()
+	}
+}
+
+func TestMaxTotalBufferBytes(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	SetMaxTotalBufferBytes(BufferedBytes() + 10)
+	defer SetMaxTotalBufferBytes(0)
+	directAddr := newEchoServer()
+	dialer := Dialer(dialTo(directAddr), dialTo(directAddr))
+	dial := func() *Conn {
+		conn, err := dialer(context.Background(), "tcp", directAddr)
+		if !assert.NoError(t, err) {
+			t.FailNow()
+		}
+		return conn.(*Conn)
+	}
+
+	first := dial()
+	_, err := first.Write([]byte("12345678"))
+	assert.NoError(t, err)
+	assert.Equal(t, 8, first.localBufferLen())
+	second := dial()
+	_, err = second.Write([]byte("12345678"))
+	assert.NoError(t, err, "should write though not buffered")
+	assert.Equal(t, 0, second.localBufferLen(), "should skip buffering once the cap would be exceeded")
+	assert.False(t, second.canReplay())
+	assert.Equal(t, ReplayTooLarge, second.ReplayClass())
+	second.Close()
+
+	_, err = first.Read(make([]byte, 1024))
+	assert.NoError(t, err)
+	first.Close()
+	third := dial()
+	defer third.Close()
+	_, err = third.Write([]byte("12345678"))
+	assert.NoError(t, err)
+	assert.Equal(t, 8, third.localBufferLen(), "should buffer again once memory is freed")
+}
+
+func TestSchemeConfig(t *testing.T) {
+	defer stopMockServers()
+	defer RemoveFromWl("example.com:80")
+	defer RemoveFromWl("example.com:443")
+	setFirstReadTimeout(50 * time.Millisecond)
+	SetCountry("IR")
+	defer SetCountry("")
+	SetSchemeConfig(80, DetectionConfig{DetectHijackedResponse: true})
+	SetSchemeConfig(443, DetectionConfig{DetectReadFailure: true})
+	defer UpdateConfig(func(c Config) Config {
+		c.SchemeConfigs = nil
+		return c
+	})
+	detourAddr := newBannerServer("hello detour", 0)
+	hijacked := Dialer(dialTo(newBannerServer(iranResp, 0)), dialTo(detourAddr))
+	silent := Dialer(dialTo(newBannerServer("", 0)), dialTo(detourAddr))
+
+	assert.Equal(t, "hello detour", readOnce(t, hijacked, "example.com:80"), "should detour hijacked response on port 80")
+	RemoveFromWl("example.com:80")
+	conn, err := silent(context.Background(), "tcp", "example.com:80")
+	if assert.NoError(t, err) {
+		_, err = conn.Read(make([]byte, 1024))
+		assert.Error(t, err, "should not detour read timeout on port 80")
+		conn.Close()
+	}
+	assert.False(t, whitelisted("example.com:80"))
+
+	got := readOnce(t, hijacked, "example.com:443")
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 403"), "should not detour hijacked response on port 443")
+	assert.Equal(t, "hello detour", readOnce(t, silent, "example.com:443"), "should detour read timeout on port 443")
+}
+
+func TestDetectionTimeoutFor(t *testing.T) {
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	SetDetectionTimeoutFor("Slow.example.com", 500*time.Millisecond)
+	defer SetDetectionTimeoutFor("slow.example.com", 0)
+	defer RemoveFromWl("other.example.com:80")
+	detourAddr := newBannerServer("hello detour", 0)
+	directAddr := newBannerServer("hello direct", 150*time.Millisecond)
+	dialer := Dialer(dialTo(directAddr), dialTo(detourAddr))
+
+	assert.Equal(t, "hello direct", readOnce(t, dialer, "www.slow.example.com:80"), "should wait longer for subdomains of a slow host")
+	assert.Equal(t, "hello detour", readOnce(t, dialer, "other.example.com:80"), "should detour other hosts with the default timeout")
+	assert.Equal(t, 50*time.Millisecond, currentConfig().firstReadTimeoutFor("example.com:443"))
+}
+
+func TestTLSHandshakeStall(t *testing.T) {
+	defer stopMockServers()
+	setFirstReadTimeout(2 * time.Second)
+	SetTLSHandshakeStallTimeout(50 * time.Millisecond)
+	defer SetTLSHandshakeStallTimeout(0)
+	defer RemoveFromWl("example.com:443")
+	directAddr := newBannerServer("", 0)
+	detourAddr := newEchoServer()
+
+	clientHello := []byte{0x16, 0x03, 0x01, 0x00, 0x01, 0x01}
+	before := Stats()
+	start := time.Now()
+	conn, err := Dialer(dialTo(directAddr), dialTo(detourAddr))(context.Background(), "tcp", "example.com:443")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write(clientHello)
+	assert.NoError(t, err)
+	b := make([]byte, 1024)
+	n, err := conn.Read(b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, clientHello, b[:n], "should resend the ClientHello through detour")
+	}
+	assert.True(t, time.Since(start) < time.Second, "should not wait for the whole first read timeout")
+	assert.EqualValues(t, 1, Stats().DetouredHandshakeStall-before.DetouredHandshakeStall)
+	assert.True(t, whitelisted("example.com:443"))
+}
+
+func TestReplayClientHelloAfterReset(t *testing.T) {
+	defer stopMockServers()
+	defer RemoveFromWl("example.com:443")
+	setFirstReadTimeout(time.Second)
+	directAddr := newResetServer()
+	detourAddr := newEchoServer()
+
+	// capture a real ClientHello as the caller's TLS stack would send it
+	client, server := net.Pipe()
+	go tls.Client(client, &tls.Config{ServerName: "example.com"}).Handshake()
+	clientHello := make([]byte, 64*1024)
+	n, err := server.Read(clientHello)
+	if !assert.NoError(t, err) {
+		return
+	}
+	clientHello = clientHello[:n]
+	client.Close()
+	server.Close()
+
+	before := Stats()
+	conn, err := Dialer(dialTo(directAddr), dialTo(detourAddr))(context.Background(), "tcp", "example.com:443")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write(clientHello)
+	assert.NoError(t, err)
+	received := make([]byte, len(clientHello))
+	_, err = io.ReadFull(conn, received)
+	if assert.NoError(t, err, "should detour after reset") {
+		assert.Equal(t, clientHello, received, "detour should receive the exact ClientHello")
+	}
+	assert.EqualValues(t, 1, Stats().DetouredReadTimeout-before.DetouredReadTimeout)
+	assert.Equal(t, ReplayTLSHandshake, conn.(*Conn).ReplayClass())
+}
+
+func TestBlackholeThenDetour(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	closed := make(chan bool, 10)
+	directAddr := newBlackholeServer(closed)
+	detourAddr := newBannerServer("hello detour", 0)
+	dialer := Dialer(dialTo(directAddr), dialTo(detourAddr))
+	before := runtime.NumGoroutine()
+	for i := 0; i < 5; i++ {
+		RemoveFromWl(directAddr)
+		conn, err := dialer(context.Background(), "tcp", directAddr)
+		if !assert.NoError(t, err) {
+			return
+		}
+		b := make([]byte, 1024)
+		n, err := conn.Read(b)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello detour", string(b[:n]))
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			assert.Fail(t, "should close the direct connection once detoured")
+		}
+		conn.Close()
+	}
+	for deadline := time.Now().Add(time.Second); runtime.NumGoroutine() > before && time.Now().Before(deadline); {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.True(t, runtime.NumGoroutine() <= before, "should not leak goroutines, %d before and %d after", before, runtime.NumGoroutine())
+}
+
+func TestWriteAfterDetour(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	SetReplayUnknownProtocols(true)
+	defer SetReplayUnknownProtocols(false)
+	blackhole := newBannerServer("", 0)
+	detourAddr := newEchoServer()
+	conn, err := Dialer(dialTo(blackhole), dialTo(detourAddr))(context.Background(), "tcp", blackhole)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	// keep writing while the first read times out and switches to detour
+	var expected strings.Builder
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 20; i++ {
+			msg := fmt.Sprintf("message %d\n", i)
+			expected.WriteString(msg)
+			if _, err := conn.Write([]byte(msg)); !assert.NoError(t, err) {
+				return
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}()
+	var received []byte
+	b := make([]byte, 1024)
+	for len(received) < len("message 0\n")*10+len("message 10\n")*10 {
+		n, err := conn.Read(b)
+		if !assert.NoError(t, err) {
+			return
+		}
+		received = append(received, b[:n]...)
+	}
+	<-done
+	assert.True(t, conn.(*Conn).inState(stateDetour))
+	assert.Equal(t, expected.String(), string(received), "detour should receive each write exactly once")
+
+	_, err = conn.Write([]byte("after switch"))
+	assert.NoError(t, err)
+	n, err := conn.Read(b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "after switch", string(b[:n]), "should write to detour after switched")
+	}
+}
+
+func TestInvalidateHost(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	detourAddr := newBannerServer("hello detour", 0)
+	directAddr := newBannerServer("hello direct", 0)
+	dialer := Dialer(dialTo(directAddr), dialTo(detourAddr))
+
+	AddToWl(directAddr, false)
+	InvalidateHost(directAddr)
+	assert.Equal(t, "hello direct", readOnce(t, dialer, directAddr), "should detect again after invalidated")
+	assert.False(t, whitelisted(directAddr), "should remove temporary entry if no longer blocked")
+
+	AddToWl(directAddr, true)
+	InvalidateHost(directAddr)
+	assert.Equal(t, "hello direct", readOnce(t, dialer, directAddr), "should detect again after invalidated")
+	assert.True(t, wlPermanently(directAddr), "should keep permanent entry")
+	assert.Equal(t, "hello detour", readOnce(t, dialer, directAddr), "should only detect again once")
+}
+
+func TestFalsePositiveDetours(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	detourAddr := newBannerServer("hello detour", 0)
+	blackhole := newBannerServer("", 0)
+	var direct atomic.Value
+	direct.Store(blackhole)
+	dialer := Dialer(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return net.Dial(network, direct.Load().(string))
+	}, dialTo(detourAddr))
+
+	before := Stats().FalsePositiveDetours
+	assert.Equal(t, "hello detour", readOnce(t, dialer, blackhole), "should detour while blocked")
+	InvalidateHost(blackhole)
+	assert.Equal(t, "hello detour", readOnce(t, dialer, blackhole), "should detour while still blocked")
+	assert.Equal(t, before, Stats().FalsePositiveDetours, "should not count if still blocked")
+
+	// the block clears
+	direct.Store(newBannerServer("hello direct", 0))
+	assert.Equal(t, "hello detour", readOnce(t, dialer, blackhole), "should keep detouring until detected again")
+	InvalidateHost(blackhole)
+	assert.Equal(t, "hello direct", readOnce(t, dialer, blackhole), "should detect again after invalidated")
+	assert.Equal(t, before+1, Stats().FalsePositiveDetours, "should count once reachable directly")
+	readOnce(t, dialer, blackhole)
+	assert.Equal(t, before+1, Stats().FalsePositiveDetours, "should only count detected again")
+}
+
+func TestWhitelistByRequestTarget(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer RemoveFromWl("target.example.com")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	SetWhitelistByRequestTarget(true)
+	defer SetWhitelistByRequestTarget(false)
+	proxyAddr := newBannerServer("", 0)
+	detourAddr := newEchoServer()
+
+	req := "CONNECT target.example.com:443 HTTP/1.1\r\nHost: target.example.com:443\r\n\r\n"
+	conn, err := Dialer(dialTo(proxyAddr), dialTo(detourAddr))(context.Background(), "tcp", proxyAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(req))
+	assert.NoError(t, err)
+	b := make([]byte, 1024)
+	n, err := conn.Read(b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, req, string(b[:n]), "should resend the request through detour")
+	}
+	assert.True(t, whitelisted("target.example.com"), "should whitelist the request target")
+	assert.False(t, whitelisted(proxyAddr), "should not whitelist the address dialed")
+
+	assert.Equal(t, "example.org", requestTarget([]byte("GET / HTTP/1.1\r\nHost: example.org\r\n\r\n")))
+	assert.Equal(t, "example.org:8080", requestTarget([]byte("GET http://example.org:8080/ HTTP/1.1\r\n")))
+	assert.Equal(t, "", requestTarget([]byte("GET / HTTP/1.1\r\nHost: exam")), "should not guess from incomplete headers")
+	assert.Equal(t, "", requestTarget([]byte{0x16, 0x03, 0x01}))
+}
+
+func TestSuccessPatternFor(t *testing.T) {
+	defer stopMockServers()
+	defer RemoveFromWl("strict.example.com:80")
+	setFirstReadTimeout(50 * time.Millisecond)
+	SetSuccessPatternFor("example.com", regexp.MustCompile(`^HTTP/1\.1 200`))
+	defer SetSuccessPatternFor("example.com", nil)
+	SetSuccessPatternFor("lenient.example.com", regexp.MustCompile(`^HTTP/`))
+	defer SetSuccessPatternFor("lenient.example.com", nil)
+	detourAddr := newBannerServer("hello detour", 0)
+	directAddr := newBannerServer("HTTP/1.1 403 Forbidden\r\n\r\n", 0)
+	dialer := Dialer(dialTo(directAddr), dialTo(detourAddr))
+
+	before := Stats()
+	assert.Equal(t, "hello detour", readOnce(t, dialer, "strict.example.com:80"), "should detour if the first read doesn't match")
+	assert.EqualValues(t, 1, Stats().DetouredUnsuccessful-before.DetouredUnsuccessful)
+	assert.True(t, whitelisted("strict.example.com:80"))
+	assert.Equal(t, "HTTP/1.1 403 Forbidden\r\n\r\n", readOnce(t, dialer, "www.lenient.example.com:80"), "should use the most specific pattern")
+	assert.Equal(t, "HTTP/1.1 403 Forbidden\r\n\r\n", readOnce(t, dialer, "other.org:80"), "should not check hosts without pattern")
+}
+
+func TestNoDialers(t *testing.T) {
+	_, err := Dialer(nil, nil)(context.Background(), "tcp", "example.com:80")
+	assert.Equal(t, ErrNoDialers, err)
+}
+
+func TestMinSuccessBytes(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(100 * time.Millisecond)
+	SetMinSuccessBytes(4)
+	defer SetMinSuccessBytes(1)
+	detourAddr := newBannerServer("hello detour", 0)
+
+	directAddr := newBannerServer("x", 0)
+	assert.Equal(t, "hello detour", readOnce(t, Dialer(dialTo(directAddr), dialTo(detourAddr)), directAddr), "should detour if too few bytes arrive")
+	assert.True(t, whitelisted(directAddr), "should add to whitelist if too few bytes arrive")
+	RemoveFromWl(directAddr)
+
+	directAddr = newDripServer("hello direct", 10*time.Millisecond)
+	assert.Equal(t, "hell", readOnce(t, Dialer(dialTo(directAddr), dialTo(detourAddr)), directAddr), "should not detour once enough bytes arrive")
+
+	assert.True(t, completeFrame([]byte("HTTP/1.1 204 No Content\r\n\r\n")))
+	assert.False(t, completeFrame([]byte("HTTP/1.1 200 OK\r\n")))
+	assert.True(t, completeFrame([]byte{0x15, 0x03, 0x03, 0x00, 0x02, 0x02, 0x28}), "should take a complete TLS alert")
+	assert.False(t, completeFrame([]byte{0x16, 0x03, 0x03, 0x00, 0x40, 0x02}))
+}
+
+func TestPausedAndBlocked(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	SetPaused(true)
+	defer SetPaused(false)
+	detourAddr := newBannerServer("hello detour", 0)
+
+	directAddr := newBannerServer("", 0)
+	dialer := Dialer(dialTo(directAddr), dialTo(detourAddr))
+	before := Stats()
+	conn, err := dialer(context.Background(), "tcp", directAddr)
+	if assert.NoError(t, err) {
+		_, err = conn.Read(make([]byte, 1024))
+		assert.True(t, errors.Is(err, ErrDetourWouldHaveHelped), "should tell detour would have helped, got %v", err)
+		conn.Close()
+	}
+	assert.Equal(t, int64(1), Stats().DetouredReadTimeout-before.DetouredReadTimeout, "should count the detection while paused")
+	assert.False(t, whitelisted(directAddr), "should not add to whitelist while paused")
+
+	AddToWl(directAddr, false)
+	directAddr = newBannerServer("hello direct", 0)
+	assert.Equal(t, "hello direct", readOnce(t, Dialer(dialTo(directAddr), dialTo(detourAddr)), directAddr), "should dial directly even if whitelisted while paused")
+}
+
+func TestOnionAlwaysDetours(t *testing.T) {
+	defer stopMockServers()
+	detourAddr := newBannerServer("hello detour", 0)
+	var directDials int32
+	direct := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&directDials, 1)
+		return nil, errors.New("should not dial directly")
+	}
+	assert.Equal(t, "hello detour", readOnce(t, Dialer(direct, dialTo(detourAddr)), "example.onion:80"))
+	assert.EqualValues(t, 0, atomic.LoadInt32(&directDials), "should skip the direct dialer")
+	assert.False(t, whitelisted("example.onion:80"), "should not need to whitelist onion addresses")
+
+	failing := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New("not Tor-capable")
+	}
+	_, err := Dialer(direct, failing)(context.Background(), "tcp", "sub.example.onion:80")
+	assert.True(t, errors.Is(err, ErrOnionNeedsDetour), "should return a clear error if detour can't handle it, got %v", err)
+	_, err = Dialer(direct, nil)(context.Background(), "tcp", "example.onion:80")
+	assert.Equal(t, ErrOnionNeedsDetour, err)
+	assert.EqualValues(t, 0, atomic.LoadInt32(&directDials))
+}
+
+func TestSuccessFunc(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	SetSuccessFunc(func(firstBytes []byte, n int, err error) bool {
+		return err == nil && !strings.Contains(string(firstBytes), "blocked by censor")
+	})
+	defer SetSuccessFunc(nil)
+	detourAddr := newBannerServer("hello detour", 0)
+
+	directAddr := newBannerServer("blocked by censor", 0)
+	before := Stats()
+	assert.Equal(t, "hello detour", readOnce(t, Dialer(dialTo(directAddr), dialTo(detourAddr)), directAddr), "should detour if rejected by success func")
+	assert.EqualValues(t, 1, Stats().DetouredUnsuccessful-before.DetouredUnsuccessful)
+	RemoveFromWl(directAddr)
+
+	directAddr = newBannerServer("hello direct", 0)
+	assert.Equal(t, "hello direct", readOnce(t, Dialer(dialTo(directAddr), dialTo(detourAddr)), directAddr), "should stay direct if accepted by success func")
+	assert.False(t, whitelisted(directAddr))
+}
+
+func TestNoWhitelistKey(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	directAddr := newBannerServer("", 0)
+	detourAddr := newBannerServer("hello detour", 0)
+	ctx := context.WithValue(context.Background(), NoWhitelistKey, true)
+	conn, err := Dialer(dialTo(directAddr), dialTo(detourAddr))(ctx, "tcp", directAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	b := make([]byte, 1024)
+	n, err := conn.Read(b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "hello detour", string(b[:n]), "should still detour")
+	}
+	conn.Close()
+	assert.False(t, whitelisted(directAddr), "should not add to whitelist")
+}
+
+func TestClassifyReplay(t *testing.T) {
+	assert.Equal(t, ReplayNothingWritten, classifyReplay(nil, nil))
+	assert.Equal(t, ReplayTLSHandshake, classifyReplay([]byte{0x16, 0x03, 0x01, 0x02, 0x00}, nil))
+	assert.Equal(t, ReplayIdempotentHTTP, classifyReplay([]byte("GET / HTTP/1.1\r\n"), nil))
+	assert.Equal(t, ReplayIdempotentHTTP, classifyReplay([]byte("DELETE /x HTTP/1.1\r\n"), nil))
+	assert.Equal(t, ReplayNonIdempotentHTTP, classifyReplay([]byte("POST / HTTP/1.1\r\n"), nil))
+	assert.Equal(t, ReplayUnknown, classifyReplay([]byte("EHLO example.com\r\n"), nil), "unknown command should not be taken as HTTP")
+	assert.Equal(t, ReplayUnknown, classifyReplay([]byte{0x00, 0x01, 0x02}, nil))
+	assert.Equal(t, ReplayUnknown, classifyReplay([]byte("GET"), nil), "should not guess from incomplete request line")
+}
+
+func TestReplayableMethods(t *testing.T) {
+	replayable := map[string]bool{"GET": true, "PURGE": true}
+	assert.Equal(t, ReplayIdempotentHTTP, classifyReplay([]byte("PURGE / HTTP/1.1\r\n"), replayable), "should take custom method as idempotent")
+	assert.Equal(t, ReplayNonIdempotentHTTP, classifyReplay([]byte("DELETE /x HTTP/1.1\r\n"), replayable), "should not take unlisted method as idempotent")
+	assert.Equal(t, ReplayUnknown, classifyReplay([]byte("EHLO example.com\r\n"), replayable))
+
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	SetReplayableMethods([]string{"GET", "PURGE"})
+	defer SetReplayableMethods(nil)
+	directAddr := newBannerServer("", 0)
+	detourAddr := newEchoServer()
+	conn, err := Dialer(dialTo(directAddr), dialTo(detourAddr))(context.Background(), "tcp", directAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	req := "PURGE /cache HTTP/1.1\r\nHost: example.com\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); !assert.NoError(t, err) {
+		return
+	}
+	b := make([]byte, 1024)
+	n, err := conn.Read(b)
+	if assert.NoError(t, err, "should replay custom method") {
+		assert.Equal(t, req, string(b[:n]))
+	}
+	assert.Equal(t, ReplayIdempotentHTTP, conn.(*Conn).ReplayClass())
+}
+
+func TestReplayNonHTTP(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	directAddr := newBannerServer("", 0)
+	detourAddr := newEchoServer()
+	dialer := Dialer(dialTo(directAddr), dialTo(detourAddr))
+	readAfterWrite := func() (*Conn, string, error) {
+		conn, err := dialer(context.Background(), "tcp", directAddr)
+		if !assert.NoError(t, err) {
+			return nil, "", err
+		}
+		defer conn.Close()
+		if _, err := conn.Write([]byte{0x00, 0x01, 0x02}); !assert.NoError(t, err) {
+			return nil, "", err
+		}
+		b := make([]byte, 1024)
+		n, err := conn.Read(b)
+		return conn.(*Conn), string(b[:n]), err
+	}
+
+	dc, _, err := readAfterWrite()
+	assert.Error(t, err, "should not replay non-HTTP bytes by default")
+	if dc != nil {
+		assert.Equal(t, ReplayUnknown, dc.ReplayClass())
+	}
+	assert.True(t, whitelisted(directAddr), "should still add to whitelist so will detour next time")
+
+	RemoveFromWl(directAddr)
+	SetReplayUnknownProtocols(true)
+	defer SetReplayUnknownProtocols(false)
+	_, read, err := readAfterWrite()
+	if assert.NoError(t, err, "should replay non-HTTP bytes if configured") {
+		assert.Equal(t, "\x00\x01\x02", read)
+	}
+}
+
+func TestReplayTooLarge(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	SetMaxReplayBytes(1024)
+	defer SetMaxReplayBytes(1 << 20)
+	directAddr := newBannerServer("", 0)
+	detourAddr := newEchoServer()
+
+	conn, err := Dialer(dialTo(directAddr), dialTo(detourAddr))(context.Background(), "tcp", directAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	body := strings.Repeat("a", 4096)
+	n, err := conn.Write([]byte("GET / HTTP/1.1\r\nContent-Length: 4096\r\n\r\n" + body))
+	if assert.NoError(t, err, "should still write beyond the cap") {
+		assert.True(t, n > 4096)
+	}
+	_, err = conn.Read(make([]byte, 1024))
+	assert.Error(t, err, "should not detour an idempotent request with a body beyond the cap")
+	assert.Equal(t, ReplayTooLarge, conn.(*Conn).ReplayClass())
+	assert.Equal(t, "too large", conn.(*Conn).ReplayClass().String())
+	dc := conn.(*Conn)
+	dc.muLocalBuffer.Lock()
+	assert.Nil(t, dc.localBuffer, "should not hold the buffer beyond the cap")
+	dc.muLocalBuffer.Unlock()
+	assert.True(t, whitelisted(directAddr), "should still add to whitelist so will detour next time")
+}
+
+func TestReleaseLocalBuffer(t *testing.T) {
+	defer stopMockServers()
+	directAddr := newEchoServer()
+	conn, err := Dialer(dialTo(directAddr), dialTo(directAddr))(context.Background(), "tcp", directAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	dc := conn.(*Conn)
+	_, err = conn.Write([]byte("hello"))
+	if !assert.NoError(t, err) {
+		return
+	}
+	dc.muLocalBuffer.Lock()
+	assert.NotNil(t, dc.localBuffer, "should buffer writes before first read")
+	dc.muLocalBuffer.Unlock()
+	b := make([]byte, 1024)
+	n, err := conn.Read(b)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "hello", string(b[:n]))
+	}
+	dc.muLocalBuffer.Lock()
+	assert.Nil(t, dc.localBuffer, "should release buffer after first read")
+	dc.muLocalBuffer.Unlock()
+}
+
+func TestNoReplayFor(t *testing.T) {
+	s := SaveState()
+	defer RestoreState(s)
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	SetNoReplayFor("localhost")
+	directAddr := newBannerServer("", 0)
+	detourAddr := newBannerServer("hello detour", 0)
+	_, port, _ := net.SplitHostPort(directAddr)
+	addr := net.JoinHostPort("uploads.localhost", port)
+	dialer := Dialer(dialTo(directAddr), dialTo(detourAddr))
+
+	buffered := BufferedBytes()
+	conn, err := dialer(context.Background(), "tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	dc := conn.(*Conn)
+	n, err := conn.Write([]byte("GET / HTTP/1.1\r\nHost: uploads.localhost\r\n\r\n"))
+	if assert.NoError(t, err) {
+		assert.True(t, n > 0)
+	}
+	dc.muLocalBuffer.Lock()
+	assert.Nil(t, dc.localBuffer, "should not buffer writes for matching hosts")
+	dc.muLocalBuffer.Unlock()
+	assert.Equal(t, buffered, BufferedBytes())
+	_, err = conn.Read(make([]byte, 1024))
+	assert.Error(t, err, "should not replay for matching hosts")
+	assert.Equal(t, ReplayDisabled, dc.ReplayClass())
+
+	RemoveFromWl(addr)
+	assert.Equal(t, "hello detour", readOnce(t, dialer, addr), "should still detour if nothing written")
+}
+
+// dialTo returns a dialFunc which always dials target regardless of addr
+func dialTo(target string) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return net.Dial(network, target)
+	}
+}
+
+// readOnce dials addr and returns what's read from the first read
+func readOnce(t *testing.T, dialer dialFunc, addr string) string {
+	conn, err := dialer(context.Background(), "tcp", addr)
+	if !assert.NoError(t, err) {
+		return ""
+	}
+	defer conn.Close()
+	b := make([]byte, 1024)
+	n, err := conn.Read(b)
+	assert.NoError(t, err)
+	return string(b[:n])
+}
+
 func newClient(proxyURL string, timeout time.Duration) *http.Client {
 	return newDetourFailingClient(proxyURL, timeout, math.MaxInt64)
 }
@@ -190,7 +1408,8 @@ func newFailingClient(proxyURL string, timeout time.Duration, directFailAfterRea
 				dialer := Dialer(
 					func(ctx context.Context, network, addr string) (net.Conn, error) {
 						// for simplicity, we use the same timeout for direct dialer.
-						newCTX, _ := context.WithTimeout(ctx, firstReadTimeoutToDetour)
+						newCTX, cancel := context.WithTimeout(ctx, currentConfig().FirstReadTimeout)
+						defer cancel()
 						conn, err := netx.DialContext(newCTX, network, addr)
 						if err == nil {
 							conn = &eventuallyFailingConn{Conn: conn, failAfterReads: directFailAfterReads}
@@ -237,3 +1456,77 @@ func (conn *eventuallyFailingConn) Read(b []byte) (int, error) {
 	}
 	return conn.Conn.Read(b)
 }
+
+// shortWriteConn only writes half of the bytes and then fails
+type shortWriteConn struct {
+	net.Conn
+}
+
+func (conn *shortWriteConn) Write(b []byte) (int, error) {
+	n, err := conn.Conn.Write(b[:len(b)/2])
+	if err != nil {
+		return n, err
+	}
+	return n, &net.OpError{
+		Op:     "write",
+		Net:    "tcp",
+		Source: conn.Conn.LocalAddr(),
+		Addr:   conn.Conn.RemoteAddr(),
+		Err:    errors.New("connection reset by peer"),
+	}
+}
+
+func TestWrapDirect(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	detourAddr := newBannerServer("hello", 0)
+
+	// nothing ever comes from the other end of the pipe
+	direct, peer := net.Pipe()
+	defer peer.Close()
+	conn := WrapDirect(direct, dialTo(detourAddr), detourAddr)
+	defer conn.Close()
+	b := make([]byte, 1024)
+	n, err := conn.Read(b)
+	if assert.NoError(t, err, "should detour if the wrapped connection times out") {
+		assert.Equal(t, "hello", string(b[:n]))
+	}
+	assert.True(t, whitelisted(detourAddr), "should add to whitelist after detour")
+}
+
+// BenchmarkFirstRead measures a direct connection settling after the first read,
+// which reads straight into the caller's buffer without copying.
+func BenchmarkFirstRead(b *testing.B) {
+	resp := []byte("HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n")
+	req := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	direct := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		c1, c2 := net.Pipe()
+		go func() {
+			defer c2.Close()
+			buf := make([]byte, len(req))
+			if _, err := io.ReadFull(c2, buf); err == nil {
+				_, _ = c2.Write(resp)
+			}
+			_, _ = io.Copy(io.Discard, c2)
+		}()
+		return c1, nil
+	}
+	dialer := Dialer(direct, direct)
+	buf := make([]byte, 1024)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		conn, err := dialer(context.Background(), "tcp", "8.8.8.8:80")
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, err := conn.Write(req); err != nil {
+			b.Fatal(err)
+		}
+		if n, err := conn.Read(buf); err != nil || !bytes.Equal(buf[:n], resp) {
+			b.Fatalf("Unexpected first read %q: %v", buf[:n], err)
+		}
+		conn.Close()
+	}
+}
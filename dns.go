@@ -0,0 +1,155 @@
+package detour
+
+import (
+	"context"
+	"errors"
+	"net"
+)
+
+// Resolver looks up the IP addresses of host.
+type Resolver func(ctx context.Context, host string) ([]net.IP, error)
+
+// SetResolver sets the resolver used to check if a site is blocked by DNS
+// before dialing it directly. Setting it enables the check, nil disables it
+// unless sinkhole IPs are set, in which case the system resolver is used.
+func SetResolver(r Resolver) {
+	UpdateConfig(func(c Config) Config {
+		c.Resolver = r
+		return c
+	})
+}
+
+// SetSinkholeIPs sets the IPs censors resolve blocked sites to. A site which
+// resolves to any of them, or doesn't exist at all according to the resolver,
+// is resolved again by the trusted resolver, see SetTrustedResolver(), and
+// detoured only if the answers differ, so sites which really don't exist or
+// really resolve to such IPs are left alone.
+func SetSinkholeIPs(ips []net.IP) {
+	ips = append([]net.IP(nil), ips...)
+	UpdateConfig(func(c Config) Config {
+		c.SinkholeIPs = ips
+		return c
+	})
+}
+
+// SetTrustedResolver sets the resolver not subject to censorship to check
+// against when a site seems blocked by DNS, e.g. one using DNS over HTTPS. nil,
+// the default, resolves through the detour with the DNS server set by
+// SetDetourDNSServer().
+func SetTrustedResolver(r Resolver) {
+	UpdateConfig(func(c Config) Config {
+		c.TrustedResolver = r
+		return c
+	})
+}
+
+// SetDetourDNSServer sets the DNS server to query over TCP through the detour
+// when there's no trusted resolver, see SetTrustedResolver(). Defaults to
+// 8.8.8.8:53.
+func SetDetourDNSServer(addr string) {
+	UpdateConfig(func(c Config) Config {
+		c.DetourDNSServer = addr
+		return c
+	})
+}
+
+func getResolver(cfg *Config) Resolver {
+	if cfg.Resolver == nil && len(cfg.SinkholeIPs) > 0 {
+		return systemResolve
+	}
+	return cfg.Resolver
+}
+
+func systemResolve(ctx context.Context, host string) ([]net.IP, error) {
+	return net.DefaultResolver.LookupIP(ctx, "ip", host)
+}
+
+func getTrustedResolver(cfg *Config, detourDialer dialFunc) Resolver {
+	if cfg.TrustedResolver != nil {
+		return cfg.TrustedResolver
+	}
+	if detourDialer == nil || cfg.DetourDNSServer == "" {
+		return nil
+	}
+	return detourResolver(detourDialer, cfg.DetourDNSServer)
+}
+
+// detourResolver resolves hosts by querying server through the detour. The
+// connection isn't a net.PacketConn so DNS over TCP is used.
+func detourResolver(detourDialer dialFunc, server string) Resolver {
+	r := &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			return detourDialer(ctx, "tcp", server)
+		},
+	}
+	return func(ctx context.Context, host string) ([]net.IP, error) {
+		return r.LookupIP(ctx, "ip", host)
+	}
+}
+
+// dnsBlocked checks if resolving the host of addr returns NXDOMAIN or a
+// sinkhole IP, while the trusted resolver returns different answers. It's a
+// noop if neither the resolver nor sinkhole IPs are set.
+func dnsBlocked(ctx context.Context, cfg *Config, addr string, detourDialer dialFunc) bool {
+	r := getResolver(cfg)
+	host := hostOnly(addr)
+	if r == nil || net.ParseIP(host) != nil {
+		return false
+	}
+	ips, err := r(ctx, host)
+	if err != nil {
+		if !isNotFound(err) {
+			return false
+		}
+		log.Debugf("%s not found by resolver", host)
+	} else if !resolvedToSinkhole(cfg, host, ips) {
+		return false
+	}
+	trusted := getTrustedResolver(cfg, detourDialer)
+	if trusted == nil {
+		log.Debugf("No trusted resolver to check %s against", host)
+		return false
+	}
+	trustedIPs, trustedErr := trusted(ctx, host)
+	if trustedErr != nil {
+		log.Debugf("Unable to resolve %s with trusted resolver: %v", host, trustedErr)
+		return false
+	}
+	if err == nil && sameAnswers(ips, trustedIPs) {
+		log.Debugf("%s resolves to %v with trusted resolver too", host, trustedIPs)
+		return false
+	}
+	log.Debugf("%s resolves to %v with trusted resolver", host, trustedIPs)
+	return true
+}
+
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+func resolvedToSinkhole(cfg *Config, host string, ips []net.IP) bool {
+	for _, ip := range ips {
+		for _, sinkhole := range cfg.SinkholeIPs {
+			if ip.Equal(sinkhole) {
+				log.Debugf("%s resolved to sinkhole %s", host, ip)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sameAnswers checks if a and b have any IP in common, as the IPs returned for
+// the same host vary across resolvers.
+func sameAnswers(a, b []net.IP) bool {
+	for _, ipa := range a {
+		for _, ipb := range b {
+			if ipa.Equal(ipb) {
+				return true
+			}
+		}
+	}
+	return false
+}
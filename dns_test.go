@@ -0,0 +1,135 @@
+package detour
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestDNSBlocked(t *testing.T) {
+	defer RestoreState(SaveState())
+	defer stopMockServers()
+	detourAddr := newBannerServer("hello detour", 0)
+	directAddr := newBannerServer("hello direct", 0)
+	notFound := func(host string) error {
+		return &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	SetSinkholeIPs([]net.IP{net.ParseIP("10.10.34.34")})
+	SetResolver(func(ctx context.Context, host string) ([]net.IP, error) {
+		switch host {
+		case "blocked.example", "sinkhole.example":
+			return []net.IP{net.ParseIP("10.10.34.34")}, nil
+		case "missing.example", "gone.example":
+			return nil, notFound(host)
+		default:
+			return []net.IP{net.ParseIP("127.0.0.1")}, nil
+		}
+	})
+	SetTrustedResolver(func(ctx context.Context, host string) ([]net.IP, error) {
+		switch host {
+		case "sinkhole.example":
+			return []net.IP{net.ParseIP("10.10.34.34")}, nil
+		case "gone.example":
+			return nil, notFound(host)
+		default:
+			return []net.IP{net.ParseIP("127.0.0.1")}, nil
+		}
+	})
+	var directDials int32
+	dialer := Dialer(
+		func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&directDials, 1)
+			return net.Dial(network, directAddr)
+		},
+		dialTo(detourAddr),
+	)
+
+	assert.Equal(t, "hello detour", readOnce(t, dialer, "blocked.example:80"), "should detour if resolved to sinkhole")
+	assert.True(t, whitelisted("blocked.example:80"), "should add to whitelist if resolved to sinkhole")
+	assert.Equal(t, "hello detour", readOnce(t, dialer, "missing.example:80"), "should detour if not found by resolver")
+	assert.True(t, whitelisted("missing.example:80"), "should add to whitelist if not found by resolver")
+	assert.EqualValues(t, 0, atomic.LoadInt32(&directDials), "should not dial directly if blocked by DNS")
+
+	assert.Equal(t, "hello direct", readOnce(t, dialer, "fine.example:80"), "should not detour if resolved normally")
+	assert.False(t, whitelisted("fine.example:80"))
+	assert.Equal(t, "hello direct", readOnce(t, dialer, "gone.example:80"), "should not detour if not found by trusted resolver either")
+	assert.False(t, whitelisted("gone.example:80"))
+	assert.Equal(t, "hello direct", readOnce(t, dialer, "sinkhole.example:80"), "should not detour if trusted resolver returns the same")
+	assert.False(t, whitelisted("sinkhole.example:80"))
+}
+
+func TestDetourResolver(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go serveDNSOverTCP(l, net.ParseIP("192.0.2.1"))
+	var detourDials int32
+	detourDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&detourDials, 1)
+		return net.Dial(network, addr)
+	}
+	ips, err := detourResolver(detourDial, l.Addr().String())(context.Background(), "blocked.example")
+	if assert.NoError(t, err) && assert.NotEmpty(t, ips) {
+		assert.Equal(t, "192.0.2.1", ips[0].String())
+	}
+	assert.True(t, atomic.LoadInt32(&detourDials) > 0, "should resolve through the detour")
+}
+
+// serveDNSOverTCP answers all A queries with ip and the others with no
+// records.
+func serveDNSOverTCP(l net.Listener, ip net.IP) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				var size uint16
+				if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+					return
+				}
+				b := make([]byte, size)
+				if _, err := io.ReadFull(conn, b); err != nil {
+					return
+				}
+				var req dnsmessage.Message
+				if err := req.Unpack(b); err != nil || len(req.Questions) == 0 {
+					return
+				}
+				q := req.Questions[0]
+				resp := dnsmessage.Message{
+					Header:    dnsmessage.Header{ID: req.ID, Response: true, Authoritative: true},
+					Questions: req.Questions,
+				}
+				if q.Type == dnsmessage.TypeA {
+					var a [4]byte
+					copy(a[:], ip.To4())
+					resp.Answers = []dnsmessage.Resource{{
+						Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+						Body:   &dnsmessage.AResource{A: a},
+					}}
+				}
+				packed, err := resp.Pack()
+				if err != nil {
+					return
+				}
+				if err := binary.Write(conn, binary.BigEndian, uint16(len(packed))); err != nil {
+					return
+				}
+				if _, err := conn.Write(packed); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
@@ -0,0 +1,245 @@
+package detour
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// DomainList is a static set of domains, e.g. a list of sites known to be
+// censored. Like the whitelist, all subdomains of a domain in the list are
+// also considered to be in it.
+type DomainList struct {
+	domains map[string]bool
+}
+
+var (
+	// instance of *DomainList
+	censoredList atomic.Value
+	// instance of *DomainList
+	knownGoodList atomic.Value
+)
+
+// NewDomainList builds a DomainList from the given domains, which may
+// optionally carry a port.
+func NewDomainList(domains ...string) *DomainList {
+	l := &DomainList{domains: make(map[string]bool, len(domains))}
+	for _, d := range domains {
+		l.add(d)
+	}
+	return l
+}
+
+// RejectedLine is a malformed line in a domain list.
+type RejectedLine struct {
+	// Line is the 1-based line number
+	Line   int
+	Text   string
+	Reason string
+}
+
+// Reasons a line is rejected
+const (
+	ReasonEmptyHost   = "empty host"
+	ReasonBadHost     = "bad host"
+	ReasonInvalidPort = "invalid port"
+)
+
+// ParseDomainList reads a newline delimited list of domains from r. Blank
+// lines and lines starting with # are skipped, so are malformed lines, see
+// ValidateDomainList().
+func ParseDomainList(r io.Reader) (*DomainList, error) {
+	l := NewDomainList()
+	rejected, err := scanDomainLines(r, func(host string) {
+		l.domains[host] = true
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, rl := range rejected {
+		log.Debugf("Skipping line %d %q of domain list: %s", rl.Line, rl.Text, rl.Reason)
+	}
+	return l, nil
+}
+
+// ValidateDomainList reads a domain list from r like ParseDomainList() or
+// LoadWhitelistLines() without loading it anywhere, and returns the malformed
+// lines.
+func ValidateDomainList(r io.Reader) ([]RejectedLine, error) {
+	return scanDomainLines(r, func(string) {})
+}
+
+// LoadWhitelistLines adds the domains in a newline delimited list from r to
+// whitelist permanently. Blank lines and lines starting with # are skipped. It
+// returns the number of domains added and the malformed lines, which are not
+// added.
+func LoadWhitelistLines(r io.Reader) (int, []RejectedLine, error) {
+	var hosts []string
+	rejected, err := scanDomainLines(r, func(host string) {
+		hosts = append(hosts, host)
+	})
+	if err != nil {
+		return 0, rejected, err
+	}
+	muWhitelist.Lock()
+	defer muWhitelist.Unlock()
+	now := time.Now()
+	for _, host := range hosts {
+		addToWl(host, true, now)
+	}
+	log.Debugf("Loaded %d whitelist entries, rejected %d lines", len(hosts), len(rejected))
+	return len(hosts), rejected, nil
+}
+
+// LoadForceWhitelist force whitelists the domains in a newline delimited list
+// from r, e.g. a static list of sites to always detour shipped along with the
+// app. Blank lines and lines starting with # are skipped, so are malformed
+// ones, which can be found with ValidateDomainList(). It returns the number of
+// domains added.
+func LoadForceWhitelist(r io.Reader) (int, error) {
+	var hosts []string
+	rejected, err := scanDomainLines(r, func(host string) {
+		hosts = append(hosts, host)
+	})
+	if err != nil {
+		return 0, err
+	}
+	muWhitelist.Lock()
+	defer muWhitelist.Unlock()
+	for _, host := range hosts {
+		forceWhitelist[host] = wlEntry{permanent: true}
+	}
+	updateWlHighWaterMark()
+	log.Debugf("Loaded %d force whitelist entries, skipped %d malformed lines", len(hosts), len(rejected))
+	return len(hosts), nil
+}
+
+// scanDomainLines calls fn with the normalized host of each valid line from r
+// and returns the malformed ones.
+func scanDomainLines(r io.Reader, fn func(host string)) (rejected []RejectedLine, err error) {
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		host, reason := validateDomainLine(line)
+		if reason != "" {
+			rejected = append(rejected, RejectedLine{n, line, reason})
+			continue
+		}
+		fn(host)
+	}
+	return rejected, scanner.Err()
+}
+
+// validateDomainLine returns the normalized host of a domain optionally with a
+// port, or the reason it's malformed.
+func validateDomainLine(line string) (host string, reason string) {
+	host, port, err := net.SplitHostPort(line)
+	switch {
+	case err != nil && net.ParseIP(strings.Trim(line, "[]")) != nil:
+		// IPv6 address without port
+		host = strings.Trim(line, "[]")
+	case err != nil && strings.Count(line, ":") > 0:
+		return "", ReasonInvalidPort
+	case err != nil:
+		host = line
+	default:
+		if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+			return "", ReasonInvalidPort
+		}
+	}
+	host = hostOnly(host)
+	if host == "" {
+		return "", ReasonEmptyHost
+	}
+	if net.ParseIP(host) == nil && !validDomain(host) {
+		return "", ReasonBadHost
+	}
+	return host, ""
+}
+
+// validDomain checks if host is a syntactically valid domain name.
+func validDomain(host string) bool {
+	if len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (l *DomainList) add(domain string) {
+	if host := normalizeHost(domain); host != "" {
+		l.domains[host] = true
+	}
+}
+
+// Contains checks if addr or any of its parent domains is in the list.
+func (l *DomainList) Contains(addr string) bool {
+	_, ok := l.Match(addr)
+	return ok
+}
+
+// Match returns the domain in the list which addr matches, i.e. addr itself or
+// its closest parent domain in the list, e.g. to find out why a host matched.
+func (l *DomainList) Match(addr string) (entry string, ok bool) {
+	if l == nil {
+		return "", false
+	}
+	for host := normalizeHost(addr); host != ""; host = getParentDomain(host) {
+		if l.domains[host] {
+			return host, true
+		}
+	}
+	return "", false
+}
+
+// Len returns the number of domains in the list.
+func (l *DomainList) Len() int {
+	if l == nil {
+		return 0
+	}
+	return len(l.domains)
+}
+
+// SetCensoredList sets the list of domains known to be censored, which is
+// consulted by LikelyCensored(). Pass nil to clear it.
+func SetCensoredList(l *DomainList) {
+	censoredList.Store(l)
+}
+
+func getCensoredList() *DomainList {
+	l, _ := censoredList.Load().(*DomainList)
+	return l
+}
+
+// SetKnownGoodList sets the list of domains known to be unblocked in the
+// current region. Unless whitelisted, connections to them are dialed directly
+// without detection, so they neither wait for the first read nor detour even if
+// they fail. Pass nil to clear it.
+func SetKnownGoodList(l *DomainList) {
+	knownGoodList.Store(l)
+}
+
+func getKnownGoodList() *DomainList {
+	l, _ := knownGoodList.Load().(*DomainList)
+	return l
+}
+
+func normalizeHost(addr string) string {
+	return hostOnly(strings.TrimSpace(addr))
+}
@@ -0,0 +1,177 @@
+package detour
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseDomainList(t *testing.T) {
+	l, err := ParseDomainList(strings.NewReader("# comment\n\nblocked.com\n Other.org:443 \n"))
+	if assert.NoError(t, err) {
+		assert.Equal(t, 2, l.Len())
+		assert.True(t, l.Contains("www.blocked.com:80"), "should match subdomain")
+		assert.True(t, l.Contains("other.org"), "should match regardless of case and port")
+		assert.False(t, l.Contains("comment"), "should skip comments")
+		assert.False(t, l.Contains("notblocked.com"), "should not match by suffix only")
+	}
+}
+
+func TestDomainListMatch(t *testing.T) {
+	l := NewDomainList("blocked.com", "cdn.blocked.com")
+	entry, ok := l.Match("img.cdn.blocked.com:443")
+	assert.True(t, ok)
+	assert.Equal(t, "cdn.blocked.com", entry, "should return the closest matching entry")
+	entry, ok = l.Match("www.blocked.com")
+	assert.True(t, ok)
+	assert.Equal(t, "blocked.com", entry)
+	_, ok = l.Match("notblocked.com")
+	assert.False(t, ok)
+	_, ok = (*DomainList)(nil).Match("blocked.com")
+	assert.False(t, ok, "nil list should match nothing")
+}
+
+func TestValidateDomainList(t *testing.T) {
+	list := strings.Join([]string{
+		"# comment",
+		"",
+		"valid.com",
+		"valid.org:443",
+		"10.0.0.1",
+		"[::1]:80",
+		"::1",
+		":443",
+		"bad host.com",
+		"-bad.com",
+		"bad..com",
+		"port.com:http",
+		"port.com:70000",
+		"port.com:",
+	}, "\n")
+	rejected, err := ValidateDomainList(strings.NewReader(list))
+	if assert.NoError(t, err) {
+		assert.Equal(t, []RejectedLine{
+			{8, ":443", ReasonEmptyHost},
+			{9, "bad host.com", ReasonBadHost},
+			{10, "-bad.com", ReasonBadHost},
+			{11, "bad..com", ReasonBadHost},
+			{12, "port.com:http", ReasonInvalidPort},
+			{13, "port.com:70000", ReasonInvalidPort},
+			{14, "port.com:", ReasonInvalidPort},
+		}, rejected)
+	}
+	assert.False(t, whitelisted("valid.com"), "dry run should not load anything")
+
+	l, err := ParseDomainList(strings.NewReader(list))
+	if assert.NoError(t, err) {
+		assert.Equal(t, 4, l.Len(), "should skip malformed lines and merge the same host")
+	}
+
+	defer RemoveFromWl("valid.com")
+	defer RemoveFromWl("valid.org")
+	defer RemoveFromWl("10.0.0.1")
+	defer RemoveFromWl("::1")
+	loaded, rejected, err := LoadWhitelistLines(strings.NewReader(list))
+	if assert.NoError(t, err) {
+		assert.Equal(t, 5, loaded, "should count duplicated hosts separately")
+		assert.Len(t, rejected, 7)
+		assert.True(t, whitelisted("www.valid.com:80"))
+		assert.True(t, whitelisted("valid.org:80"))
+		assert.False(t, whitelisted("bad host.com"))
+		assert.Contains(t, DumpWhitelist(), "valid.com", "should load as permanent")
+	}
+}
+
+func TestLoadForceWhitelist(t *testing.T) {
+	defer stopMockServers()
+	defer RestoreState(SaveState())
+	list := `# always detour
+forced-load.com
+
+bad host.com
+forced-load.org:443
+`
+	loaded, err := LoadForceWhitelist(strings.NewReader(list))
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, 2, loaded)
+	assert.Equal(t, ForceWhitelisted, WhitelistSnapshot()["forced-load.org"])
+
+	detourAddr := newBannerServer("hello detour", 0)
+	directAddr := newBannerServer("hello direct", 0)
+	dialer := Dialer(dialTo(directAddr), dialTo(detourAddr))
+	assert.Equal(t, "hello detour", readOnce(t, dialer, "www.forced-load.com:80"), "should force detour listed hosts")
+	assert.Equal(t, "hello direct", readOnce(t, dialer, "unlisted-load.com:80"))
+}
+
+func TestLikelyCensored(t *testing.T) {
+	defer SetCensoredList(nil)
+	defer RemoveFromWl("whitelisted.com")
+	assert.False(t, LikelyCensored("listed.com:443"))
+	SetCensoredList(NewDomainList("listed.com"))
+	assert.True(t, LikelyCensored("listed.com:443"), "should include hosts in the censored list")
+	assert.True(t, LikelyCensored("sub.listed.com:443"), "should include subdomains of hosts in the censored list")
+
+	assert.False(t, LikelyCensored("whitelisted.com:80"))
+	AddToWl("whitelisted.com:80", false)
+	assert.True(t, LikelyCensored("whitelisted.com:80"), "should include whitelisted hosts")
+
+	detectors["XX"] = &Detector{
+		DNSPoisoned:        func(net.Conn) bool { return false },
+		TamperingSuspected: func(error) bool { return false },
+		FakeResponse:       func([]byte) bool { return false },
+		KnownTarget:        func(addr string) bool { return hostOnly(addr) == "target.com" },
+	}
+	defer delete(detectors, "XX")
+	SetCountry("XX")
+	defer SetCountry("")
+	assert.True(t, LikelyCensored("target.com:443"), "should include known targets of the country rules")
+
+	assert.False(t, LikelyCensored("www.youtube.com:443"))
+	SetCountry("IR")
+	assert.True(t, LikelyCensored("www.youtube.com:443"), "should include known targets in Iran")
+	assert.False(t, LikelyCensored("www.example.com:443"))
+	SetHostNormalizer(strings.ToUpper)
+	defer SetHostNormalizer(nil)
+	assert.True(t, LikelyCensored("www.youtube.com:443"), "should normalize known targets the same way as the host")
+}
+
+func TestKnownGoodList(t *testing.T) {
+	defer SetKnownGoodList(nil)
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	var detourDials int32
+	detour := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&detourDials, 1)
+		return nil, errors.New("should not detour")
+	}
+	SetKnownGoodList(NewDomainList("127.0.0.1"))
+
+	directAddr := newBannerServer("hello direct", 200*time.Millisecond)
+	start := time.Now()
+	conn, err := Dialer(dialTo(directAddr), detour)(context.Background(), "tcp", directAddr)
+	if assert.NoError(t, err) {
+		assert.True(t, conn.(*Conn).inState(stateDirect), "should skip detection")
+		assert.True(t, time.Since(start) < 50*time.Millisecond, "should not wait for the first read")
+		b := make([]byte, 1024)
+		n, err := conn.Read(b)
+		assert.NoError(t, err)
+		assert.Equal(t, "hello direct", string(b[:n]), "should not detour slow known good hosts")
+		conn.Close()
+	}
+
+	l, _ := net.Listen("tcp", "127.0.0.1:0")
+	closedAddr := l.Addr().String()
+	l.Close()
+	_, err = Dialer(dialTo(closedAddr), detour)(context.Background(), "tcp", closedAddr)
+	assert.Error(t, err, "should fail normally if known good host fails")
+	assert.EqualValues(t, 0, atomic.LoadInt32(&detourDials), "should never detour known good hosts")
+	assert.False(t, whitelisted(closedAddr))
+}
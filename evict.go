@@ -0,0 +1,95 @@
+package detour
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// EvictReason is why an entry is removed from whitelist, see
+// OnWhitelistEvict().
+type EvictReason int
+
+const (
+	// EvictExpired means a temporary entry expired, see
+	// SetTemporaryEntryTTL().
+	EvictExpired EvictReason = iota
+	// EvictLRU means a temporary entry was the least recently used one when
+	// there were too many, see SetMaxTemporaryEntries() and
+	// SetMaxTemporaryEntriesPerDomain().
+	EvictLRU
+	// EvictRemoved means the entry was removed by RemoveFromWl(), either by
+	// the caller or once the site is found no longer blocked, or dropped by
+	// ReplaceWhitelist().
+	EvictRemoved
+)
+
+var evictReasonDesc = []string{
+	"expired",
+	"lru",
+	"removed",
+}
+
+func (r EvictReason) String() string {
+	return evictReasonDesc[r]
+}
+
+var (
+	// instance of func(addr string, reason EvictReason)
+	whitelistEvictCallback atomic.Value
+
+	muEvictions sync.Mutex
+	// evictions not delivered to the callback yet, in order
+	pendingEvictions []eviction
+	// whether a goroutine is delivering pendingEvictions
+	deliveringEvictions bool
+)
+
+type eviction struct {
+	cb     func(addr string, reason EvictReason)
+	host   string
+	reason EvictReason
+}
+
+// OnWhitelistEvict sets a callback invoked each time an entry is removed from
+// whitelist, e.g. to update a persisted store or UI. It's invoked in
+// background without holding the whitelist lock, so it may call back into the
+// whitelist functions, but always in the order the entries are removed. Pass
+// nil to unset it.
+func OnWhitelistEvict(cb func(addr string, reason EvictReason)) {
+	whitelistEvictCallback.Store(cb)
+}
+
+// evicted queues the eviction to the callback set by OnWhitelistEvict() if
+// any.
+func evicted(host string, reason EvictReason) {
+	cb, _ := whitelistEvictCallback.Load().(func(addr string, reason EvictReason))
+	if cb == nil {
+		return
+	}
+	muEvictions.Lock()
+	defer muEvictions.Unlock()
+	pendingEvictions = append(pendingEvictions, eviction{cb, host, reason})
+	if !deliveringEvictions {
+		deliveringEvictions = true
+		go deliverEvictions()
+	}
+}
+
+// deliverEvictions invokes the callbacks of the pending evictions one by one
+// until there's none left.
+func deliverEvictions() {
+	for {
+		muEvictions.Lock()
+		batch := pendingEvictions
+		pendingEvictions = nil
+		if len(batch) == 0 {
+			deliveringEvictions = false
+			muEvictions.Unlock()
+			return
+		}
+		muEvictions.Unlock()
+		for _, e := range batch {
+			e.cb(e.host, e.reason)
+		}
+	}
+}
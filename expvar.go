@@ -0,0 +1,79 @@
+package detour
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// 1 means true
+	_expvarEnabled int32
+	publishOnce    sync.Once
+)
+
+// PublishExpvar controls whether the detour counters, whitelist sizes and
+// detection durations are exposed via expvar, as detour.detours,
+// detour.whitelist and detour.detection. As expvar variables can't be removed,
+// they are published when first enabled and read as null once disabled.
+func PublishExpvar(enabled bool) {
+	var v int32
+	if enabled {
+		v = 1
+		publishOnce.Do(publishExpvar)
+	}
+	atomic.StoreInt32(&_expvarEnabled, v)
+}
+
+func expvarEnabled() bool {
+	return atomic.LoadInt32(&_expvarEnabled) == 1
+}
+
+func publishExpvar() {
+	expvar.Publish("detour.detours", expvarFunc(func() interface{} {
+		s := Stats()
+		return map[string]int64{
+			"dial_failure":    s.DetouredDialFailure,
+			"unreachable":     s.DetouredUnreachable,
+			"read_timeout":    s.DetouredReadTimeout,
+			"hijack":          s.DetouredHijack,
+			"unsuccessful":    s.DetouredUnsuccessful,
+			"handshake_stall": s.DetouredHandshakeStall,
+			"stayed_direct":   s.StayedDirect,
+			"false_positive":  s.FalsePositiveDetours,
+		}
+	}))
+	expvar.Publish("detour.whitelist", expvarFunc(func() interface{} {
+		permanent, temporary, force := WhitelistSize()
+		return map[string]int{
+			"permanent":       permanent,
+			"temporary":       temporary,
+			"force":           force,
+			"high_water_mark": WhitelistHighWaterMark(),
+			"throttled":       int(Stats().WhitelistedThrottled),
+		}
+	}))
+	expvar.Publish("detour.detection", expvarFunc(func() interface{} {
+		count, total := DetectionDurations()
+		var avg time.Duration
+		if count > 0 {
+			avg = total / time.Duration(count)
+		}
+		return map[string]int64{
+			"count":    count,
+			"total_ms": total.Milliseconds(),
+			"avg_ms":   avg.Milliseconds(),
+		}
+	}))
+}
+
+// expvarFunc reads as null unless PublishExpvar() is enabled.
+func expvarFunc(f func() interface{}) expvar.Func {
+	return func() interface{} {
+		if !expvarEnabled() {
+			return nil
+		}
+		return f()
+	}
+}
@@ -0,0 +1,43 @@
+package detour
+
+import (
+	"encoding/json"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPublishExpvar(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	PublishExpvar(true)
+	defer PublishExpvar(false)
+	readVar := func(name string) map[string]int64 {
+		v := expvar.Get(name)
+		if !assert.NotNil(t, v, "should publish %s", name) {
+			return nil
+		}
+		var m map[string]int64
+		assert.NoError(t, json.Unmarshal([]byte(v.String()), &m))
+		return m
+	}
+
+	detours := readVar("detour.detours")
+	detection := readVar("detour.detection")
+	detourAddr := newBannerServer("hello detour", 0)
+	directAddr := newBannerServer("", 0)
+	readOnce(t, Dialer(dialTo(directAddr), dialTo(detourAddr)), directAddr)
+
+	assert.Equal(t, detours["read_timeout"]+1, readVar("detour.detours")["read_timeout"])
+	after := readVar("detour.detection")
+	assert.Equal(t, detection["count"]+1, after["count"])
+	assert.True(t, after["total_ms"]-detection["total_ms"] >= 50, "should count the detection duration")
+	permanent, _, _ := WhitelistSize()
+	assert.EqualValues(t, permanent, readVar("detour.whitelist")["permanent"])
+
+	PublishExpvar(false)
+	assert.Equal(t, "null", expvar.Get("detour.detours").String(), "should read as null once disabled")
+}
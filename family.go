@@ -0,0 +1,73 @@
+package detour
+
+import (
+	"context"
+	"net"
+)
+
+// AddressFamily is which IP version to prefer when dialing directly, see
+// SetDirectAddressFamily().
+type AddressFamily int
+
+const (
+	// AnyFamily leaves it to the direct dialer, which is the default.
+	AnyFamily AddressFamily = iota
+	// PreferIPv4 dials the IPv4 addresses of the host first.
+	PreferIPv4
+	// PreferIPv6 dials the IPv6 addresses of the host first.
+	PreferIPv6
+)
+
+// SetDirectAddressFamily makes dialing directly try the IP addresses of the
+// preferred family first, and those of the other family only if all of them
+// fail, before resorting to detour. It helps on networks where one family is
+// black-holed, so detection doesn't waste time on it. The host is resolved by
+// the resolver set by SetResolver() if any, otherwise the system one, and the
+// direct dialer is passed the IP addresses instead of the host name.
+func SetDirectAddressFamily(pref AddressFamily) {
+	UpdateConfig(func(c Config) Config {
+		c.DirectAddressFamily = pref
+		return c
+	})
+}
+
+// dialDirectByFamily dials addr directly, trying the IP addresses of the
+// preferred family first if set, see SetDirectAddressFamily().
+func dialDirectByFamily(ctx context.Context, cfg *Config, directDialer dialFunc, network, addr string) (net.Conn, error) {
+	if cfg.DirectAddressFamily == AnyFamily || (network != "tcp" && network != "udp") {
+		return directDialer(ctx, network, addr)
+	}
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return directDialer(ctx, network, addr)
+	}
+	resolve := cfg.Resolver
+	if resolve == nil {
+		resolve = systemResolve
+	}
+	ips, err := resolve(ctx, host)
+	if err != nil || len(ips) == 0 {
+		log.Debugf("Unable to resolve %s to prefer address family, dial as is: %v", host, err)
+		return directDialer(ctx, network, addr)
+	}
+	var preferred, others []net.IP
+	for _, ip := range ips {
+		if (ip.To4() != nil) == (cfg.DirectAddressFamily == PreferIPv4) {
+			preferred = append(preferred, ip)
+		} else {
+			others = append(others, ip)
+		}
+	}
+	for _, ip := range append(preferred, others...) {
+		var conn net.Conn
+		conn, err = directDialer(ctx, network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		log.Debugf("Unable to dial %s directly via %s: %v", addr, ip, err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,50 @@
+package detour
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDirectAddressFamily(t *testing.T) {
+	defer stopMockServers()
+	defer RemoveFromWl("dual.example.com")
+	SetResolver(func(ctx context.Context, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("192.0.2.1")}, nil
+	})
+	defer SetResolver(nil)
+	defer SetDirectAddressFamily(AnyFamily)
+	directAddr := newBannerServer("hello direct", 0)
+	detourAddr := newBannerServer("hello detour", 0)
+	var mx sync.Mutex
+	var dialed []string
+	// IPv6 is black-holed, IPv4 works
+	direct := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		mx.Lock()
+		dialed = append(dialed, addr)
+		mx.Unlock()
+		if addr == "[2001:db8::1]:443" {
+			return nil, errors.New("network unreachable")
+		}
+		return net.Dial(network, directAddr)
+	}
+	dialer := Dialer(direct, dialTo(detourAddr))
+
+	SetDirectAddressFamily(PreferIPv4)
+	assert.Equal(t, "hello direct", readOnce(t, dialer, "dual.example.com:443"))
+	assert.Equal(t, []string{"192.0.2.1:443"}, dialed, "should dial the preferred family only if it works")
+
+	dialed = nil
+	SetDirectAddressFamily(PreferIPv6)
+	assert.Equal(t, "hello direct", readOnce(t, dialer, "dual.example.com:443"), "should fall back to the other family before detouring")
+	assert.Equal(t, []string{"[2001:db8::1]:443", "192.0.2.1:443"}, dialed)
+
+	dialed = nil
+	SetDirectAddressFamily(AnyFamily)
+	assert.Equal(t, "hello direct", readOnce(t, dialer, "dual.example.com:443"))
+	assert.Equal(t, []string{"dual.example.com:443"}, dialed, "should leave it to the direct dialer by default")
+}
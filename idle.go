@@ -0,0 +1,48 @@
+package detour
+
+import (
+	"sync"
+)
+
+// IdleCloser is something pooling detoured connections which can close the
+// idle ones, e.g. an *http.Transport dialing with Dialer().
+type IdleCloser interface {
+	CloseIdleConnections()
+}
+
+var (
+	muIdleClosers sync.Mutex
+	idleClosers   = make(map[*IdleCloser]bool)
+)
+
+// RegisterIdleCloser registers a pool of detoured connections to be closed by
+// CloseIdleDetours(). It returns a function to unregister it, e.g. once the
+// pool is no longer used.
+func RegisterIdleCloser(c IdleCloser) (unregister func()) {
+	key := &c
+	muIdleClosers.Lock()
+	idleClosers[key] = true
+	muIdleClosers.Unlock()
+	return func() {
+		muIdleClosers.Lock()
+		delete(idleClosers, key)
+		muIdleClosers.Unlock()
+	}
+}
+
+// CloseIdleDetours closes the idle connections of the pools registered by
+// RegisterIdleCloser(), e.g. when the network changes so the detoured ones
+// are likely stale, and the next dial establishes a fresh one. It's a noop for
+// pools not registered.
+func CloseIdleDetours() {
+	muIdleClosers.Lock()
+	closers := make([]IdleCloser, 0, len(idleClosers))
+	for c := range idleClosers {
+		closers = append(closers, *c)
+	}
+	muIdleClosers.Unlock()
+	log.Debugf("Closing idle connections of %d pools", len(closers))
+	for _, c := range closers {
+		c.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,63 @@
+package detour
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloseIdleDetours(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	var closed int32
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello detour"))
+	}))
+	s.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateClosed {
+			atomic.AddInt32(&closed, 1)
+		}
+	}
+	s.Start()
+	defer s.Close()
+	detourAddr := s.Listener.Addr().String()
+	AddToWl(detourAddr, false)
+	var detourDials int32
+	tr := &http.Transport{
+		DialContext: Dialer(dialTo(detourAddr), func(ctx context.Context, network, addr string) (net.Conn, error) {
+			atomic.AddInt32(&detourDials, 1)
+			return net.Dial(network, detourAddr)
+		}),
+	}
+	unregister := RegisterIdleCloser(tr)
+	client := &http.Client{Transport: tr}
+	get := func() {
+		resp, err := client.Get("http://" + detourAddr)
+		if assert.NoError(t, err) {
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		}
+	}
+
+	get()
+	get()
+	assert.EqualValues(t, 1, atomic.LoadInt32(&detourDials), "should reuse the pooled detour connection")
+	CloseIdleDetours()
+	for i := 0; i < 100 && atomic.LoadInt32(&closed) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.EqualValues(t, 1, atomic.LoadInt32(&closed), "should close the idle detour connection")
+	get()
+	assert.EqualValues(t, 2, atomic.LoadInt32(&detourDials), "should dial a fresh detour connection")
+
+	unregister()
+	CloseIdleDetours()
+	get()
+	assert.EqualValues(t, 2, atomic.LoadInt32(&detourDials), "should not close pools unregistered")
+}
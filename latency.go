@@ -0,0 +1,28 @@
+package detour
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Latencies returns how long the direct attempt took, from dialing until the
+// first read returns or dialing fails, and how long detour took from dialing
+// until the first bytes read through it, e.g. for higher layers to learn which
+// route is faster for a host over time. Either is zero if the route wasn't
+// used.
+func (dc *Conn) Latencies() (direct, detour time.Duration) {
+	return time.Duration(atomic.LoadInt64(&dc.directLatency)), time.Duration(atomic.LoadInt64(&dc.detourLatency))
+}
+
+// recordDirectLatency records the latency of the direct attempt if not yet.
+func (dc *Conn) recordDirectLatency() {
+	atomic.CompareAndSwapInt64(&dc.directLatency, 0, int64(time.Since(dc.detectStart)))
+}
+
+// recordDetourLatency records the latency of detour if not yet.
+func (dc *Conn) recordDetourLatency() {
+	if atomic.LoadInt64(&dc.detourLatency) != 0 || dc.detourStart.IsZero() {
+		return
+	}
+	atomic.CompareAndSwapInt64(&dc.detourLatency, 0, int64(time.Since(dc.detourStart)))
+}
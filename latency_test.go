@@ -0,0 +1,35 @@
+package detour
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencies(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	detourAddr := newBannerServer("hello detour", 20*time.Millisecond)
+	readLatencies := func(directAddr string) (time.Duration, time.Duration) {
+		conn, err := Dialer(dialTo(directAddr), dialTo(detourAddr))(context.Background(), "tcp", directAddr)
+		if !assert.NoError(t, err) {
+			return 0, 0
+		}
+		defer conn.Close()
+		_, err = conn.Read(make([]byte, 1024))
+		assert.NoError(t, err)
+		return conn.(*Conn).Latencies()
+	}
+
+	direct, detour := readLatencies(newBannerServer("", 0))
+	assert.True(t, direct >= 50*time.Millisecond, "should measure the direct attempt, got %v", direct)
+	assert.True(t, detour >= 20*time.Millisecond, "should measure detour, got %v", detour)
+	RemoveFromWl("127.0.0.1")
+
+	direct, detour = readLatencies(newBannerServer("hello direct", 0))
+	assert.True(t, direct > 0 && direct < 50*time.Millisecond, "should measure direct, got %v", direct)
+	assert.Zero(t, detour, "should be zero if not detoured")
+}
@@ -0,0 +1,100 @@
+package detour
+
+import (
+	"sync"
+	"time"
+)
+
+// LearnedParams is what's learned about a host while detecting, which is
+// saved along with the whitelist by SaveWhitelist() so it survives restarts.
+type LearnedParams struct {
+	// FirstReadTimeout is the grown first read timeout, see
+	// SetAdaptiveDetectionTimeout()
+	FirstReadTimeout time.Duration `json:"first_read_timeout,omitempty"`
+	// FalsePositives counts the times the host was found reachable directly
+	// while whitelisted
+	FalsePositives int64 `json:"false_positives,omitempty"`
+	// DirectLatency is the moving average of the direct latency when the
+	// direct connection worked, see Conn.Latencies()
+	DirectLatency time.Duration `json:"direct_latency,omitempty"`
+}
+
+var (
+	muLearned sync.Mutex
+	// false positives and direct latencies by host, the first read timeouts
+	// are in adaptiveTimeouts
+	learned = make(map[string]LearnedParams)
+)
+
+// Learned returns what's learned about the host of addr so far.
+func Learned(addr string) LearnedParams {
+	host := hostOnly(addr)
+	muLearned.Lock()
+	p := learned[host]
+	muLearned.Unlock()
+	p.FirstReadTimeout = adaptedTimeout(host)
+	return p
+}
+
+// learnFalsePositive counts that the host was wrongly detoured.
+func (dc *Conn) learnFalsePositive() {
+	host := hostOnly(dc.addr)
+	muLearned.Lock()
+	defer muLearned.Unlock()
+	p := learned[host]
+	p.FalsePositives++
+	learned[host] = p
+}
+
+// learnDirectLatency folds the latency of the direct connection which worked
+// into the moving average of the host.
+func (dc *Conn) learnDirectLatency() {
+	d, _ := dc.Latencies()
+	if d <= 0 {
+		return
+	}
+	host := hostOnly(dc.addr)
+	muLearned.Lock()
+	defer muLearned.Unlock()
+	p := learned[host]
+	if p.DirectLatency == 0 {
+		p.DirectLatency = d
+	} else {
+		p.DirectLatency += (d - p.DirectLatency) / 5
+	}
+	learned[host] = p
+}
+
+// allLearned returns what's learned about all hosts.
+func allLearned() map[string]LearnedParams {
+	all := make(map[string]LearnedParams)
+	muLearned.Lock()
+	for host, p := range learned {
+		all[host] = p
+	}
+	muLearned.Unlock()
+	muAdaptiveTimeouts.Lock()
+	for host, d := range adaptiveTimeouts {
+		p := all[host]
+		p.FirstReadTimeout = d
+		all[host] = p
+	}
+	muAdaptiveTimeouts.Unlock()
+	return all
+}
+
+// restoreLearned restores what's learned about host, e.g. loaded by
+// LoadWhitelist().
+func restoreLearned(host string, p LearnedParams) {
+	if p.FirstReadTimeout > 0 {
+		muAdaptiveTimeouts.Lock()
+		adaptiveTimeouts[host] = p.FirstReadTimeout
+		muAdaptiveTimeouts.Unlock()
+	}
+	p.FirstReadTimeout = 0
+	if p != (LearnedParams{}) {
+		muLearned.Lock()
+		learned[host] = p
+		muLearned.Unlock()
+	}
+}
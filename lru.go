@@ -0,0 +1,140 @@
+package detour
+
+import (
+	"container/heap"
+)
+
+// lruItem is a temporary whitelist entry in a tempLRU. used is when the entry
+// was last used as far as the tempLRU knows, which may lag behind the entry's
+// lastUsed as entries are touched with only the read lock held.
+type lruItem struct {
+	host   string
+	domain string
+	used   int64
+	index  int
+}
+
+type lruHeap []*lruItem
+
+func (h lruHeap) Len() int           { return len(h) }
+func (h lruHeap) Less(i, j int) bool { return h[i].used < h[j].used }
+func (h lruHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lruHeap) Push(x interface{}) {
+	item := x.(*lruItem)
+	item.index = len(*h)
+	*h = append(*h, item)
+}
+
+func (h *lruHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return item
+}
+
+// tempLRU orders temporary whitelist entries by when they were last used so
+// that counting them is O(1) and finding the least recently used one is
+// O(log n).
+type tempLRU struct {
+	items map[string]*lruItem
+	heap  lruHeap
+}
+
+func newTempLRU() *tempLRU {
+	return &tempLRU{items: make(map[string]*lruItem)}
+}
+
+func (l *tempLRU) Len() int {
+	return len(l.heap)
+}
+
+func (l *tempLRU) add(host string, domain string, used int64) {
+	if item := l.items[host]; item != nil {
+		item.used = used
+		heap.Fix(&l.heap, item.index)
+		return
+	}
+	item := &lruItem{host: host, domain: domain, used: used}
+	l.items[host] = item
+	heap.Push(&l.heap, item)
+}
+
+func (l *tempLRU) remove(host string) *lruItem {
+	item := l.items[host]
+	if item != nil {
+		delete(l.items, host)
+		heap.Remove(&l.heap, item.index)
+	}
+	return item
+}
+
+// oldest returns the least recently used host, or empty if there isn't any.
+// Entries touched since added are reordered lazily here, so each touch costs
+// at most one O(log n) fix. The caller should hold muWhitelist.
+func (l *tempLRU) oldest() string {
+	for len(l.heap) > 0 {
+		item := l.heap[0]
+		if used := whitelist[item.host].lastUsedNano(); used > item.used {
+			item.used = used
+			heap.Fix(&l.heap, 0)
+			continue
+		}
+		return item.host
+	}
+	return ""
+}
+
+var (
+	// all temporary whitelist entries, guarded by muWhitelist
+	temporaryLRU = newTempLRU()
+	// temporary whitelist entries by registered domain, guarded by muWhitelist
+	temporaryLRUByDomain = make(map[string]*tempLRU)
+)
+
+// trackTemporary keeps the temporary LRUs in sync after the entry of host is
+// stored. The caller should hold muWhitelist.
+func trackTemporary(host string, e wlEntry) {
+	if e.permanent {
+		untrackTemporary(host)
+		return
+	}
+	domain := registeredDomain(host)
+	temporaryLRU.add(host, domain, e.lastUsedNano())
+	byDomain := temporaryLRUByDomain[domain]
+	if byDomain == nil {
+		byDomain = newTempLRU()
+		temporaryLRUByDomain[domain] = byDomain
+	}
+	byDomain.add(host, domain, e.lastUsedNano())
+}
+
+// untrackTemporary removes host from the temporary LRUs. The caller should
+// hold muWhitelist.
+func untrackTemporary(host string) {
+	item := temporaryLRU.remove(host)
+	if item == nil {
+		return
+	}
+	if byDomain := temporaryLRUByDomain[item.domain]; byDomain != nil {
+		byDomain.remove(host)
+		if byDomain.Len() == 0 {
+			delete(temporaryLRUByDomain, item.domain)
+		}
+	}
+}
+
+// rebuildTemporaryLRU rebuilds the temporary LRUs after whitelist is replaced
+// as a whole. The caller should hold muWhitelist.
+func rebuildTemporaryLRU() {
+	temporaryLRU = newTempLRU()
+	temporaryLRUByDomain = make(map[string]*tempLRU)
+	for host, e := range whitelist {
+		trackTemporary(host, e)
+	}
+}
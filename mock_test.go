@@ -1,12 +1,19 @@
 package detour
 
 import (
+	"bytes"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
 	"time"
 )
 
-var servers []*httptest.Server
+var (
+	servers   []*httptest.Server
+	listeners []net.Listener
+)
 
 type mockHandler struct {
 	writer func(w http.ResponseWriter)
@@ -55,9 +62,306 @@ func newMockServer(msg string) (string, *mockHandler) {
 	return s.URL, &m
 }
 
+// newBannerServer starts a server which speaks first: it writes banner to each
+// accepted connection after delay without waiting for the client. An empty
+// banner makes the server accept connections but never write anything.
+func newBannerServer(banner string, delay time.Duration) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	listeners = append(listeners, l)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				time.Sleep(delay)
+				if banner != "" {
+					if _, err := conn.Write([]byte(banner)); err != nil {
+						log.Debugf("Unable to write to connection: %v", err)
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// newDripServer starts a server which speaks first, writing msg one byte per
+// interval.
+func newDripServer(msg string, interval time.Duration) string {
+	return newBurstDripServer("", msg, interval)
+}
+
+// newBurstDripServer starts a server which speaks first, writing burst at once
+// and then msg one byte per interval.
+func newBurstDripServer(burst string, msg string, interval time.Duration) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	listeners = append(listeners, l)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if burst != "" {
+					if _, err := conn.Write([]byte(burst)); err != nil {
+						return
+					}
+				}
+				for i := 0; i < len(msg); i++ {
+					time.Sleep(interval)
+					if _, err := conn.Write([]byte{msg[i]}); err != nil {
+						return
+					}
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// newEchoServer starts a server which writes back whatever it receives.
+func newEchoServer() string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	listeners = append(listeners, l)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if _, err := io.Copy(conn, conn); err != nil {
+					log.Debugf("Unable to echo: %v", err)
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// newResetServer starts a server which resets each connection once it reads
+// anything from it, as censors often do after seeing the TLS SNI.
+func newResetServer() string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	listeners = append(listeners, l)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if _, err := conn.Read(make([]byte, 1)); err != nil {
+					log.Debugf("Unable to read from connection: %v", err)
+				}
+				if err := conn.(*net.TCPConn).SetLinger(0); err != nil {
+					log.Debugf("Unable to set linger: %v", err)
+				}
+				conn.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// newBlackholeServer starts a server which accepts connections but never
+// writes anything, and signals closed once the client closes one.
+func newBlackholeServer(closed chan<- bool) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	listeners = append(listeners, l)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				if _, err := io.Copy(io.Discard, conn); err != nil {
+					log.Debugf("Unable to read from connection: %v", err)
+				}
+				conn.Close()
+				closed <- true
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// newSOCKS5Server starts a SOCKS5 proxy without authentication which only
+// supports CONNECT.
+func newSOCKS5Server() string {
+	return newSOCKS5ServerWithAuth(nil)
+}
+
+// newSOCKS5ServerWithAuth starts a SOCKS5 proxy which only supports CONNECT,
+// and requires the username and password in auth if not nil.
+func newSOCKS5ServerWithAuth(auth *SOCKS5Auth) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	listeners = append(listeners, l)
+	readString := func(conn net.Conn) (string, error) {
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return "", err
+		}
+		b := make([]byte, l[0])
+		_, err := io.ReadFull(conn, b)
+		return string(b), err
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				head := make([]byte, 2)
+				if _, err := io.ReadFull(conn, head); err != nil {
+					return
+				}
+				methods := make([]byte, head[1])
+				if _, err := io.ReadFull(conn, methods); err != nil {
+					return
+				}
+				if auth == nil {
+					if _, err := conn.Write([]byte{5, 0}); err != nil {
+						return
+					}
+				} else {
+					if !bytes.Contains(methods, []byte{2}) {
+						conn.Write([]byte{5, 0xff})
+						return
+					}
+					if _, err := conn.Write([]byte{5, 2}); err != nil {
+						return
+					}
+					if _, err := io.ReadFull(conn, make([]byte, 1)); err != nil {
+						return
+					}
+					username, err := readString(conn)
+					if err != nil {
+						return
+					}
+					password, err := readString(conn)
+					if err != nil {
+						return
+					}
+					if username != auth.Username || password != auth.Password {
+						conn.Write([]byte{1, 1})
+						return
+					}
+					if _, err := conn.Write([]byte{1, 0}); err != nil {
+						return
+					}
+				}
+				req := make([]byte, 4)
+				if _, err := io.ReadFull(conn, req); err != nil {
+					return
+				}
+				var host string
+				switch req[3] {
+				case 1, 4:
+					ip := make([]byte, net.IPv4len)
+					if req[3] == 4 {
+						ip = make([]byte, net.IPv6len)
+					}
+					if _, err := io.ReadFull(conn, ip); err != nil {
+						return
+					}
+					host = net.IP(ip).String()
+				case 3:
+					if host, err = readString(conn); err != nil {
+						return
+					}
+				default:
+					return
+				}
+				port := make([]byte, 2)
+				if _, err := io.ReadFull(conn, port); err != nil {
+					return
+				}
+				target, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port[0])<<8|int(port[1]))))
+				if err != nil {
+					conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+					return
+				}
+				defer target.Close()
+				if _, err := conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+					return
+				}
+				pipe(conn, target)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// newConnectProxy starts an HTTP proxy which only supports CONNECT
+func newConnectProxy() string {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		target, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		defer target.Close()
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+			return
+		}
+		pipe(conn, target)
+	}))
+	servers = append(servers, s)
+	return s.URL
+}
+
+func pipe(a net.Conn, b net.Conn) {
+	go func() {
+		if _, err := io.Copy(a, b); err != nil {
+			log.Debugf("Unable to copy: %v", err)
+		}
+		a.Close()
+	}()
+	if _, err := io.Copy(b, a); err != nil {
+		log.Debugf("Unable to copy: %v", err)
+	}
+}
+
 func stopMockServers() {
 	for _, s := range servers {
 		s.CloseClientConnections()
 		s.Close()
 	}
+	for _, l := range listeners {
+		if err := l.Close(); err != nil {
+			log.Debugf("Unable to close listener: %v", err)
+		}
+	}
+	servers, listeners = nil, nil
 }
@@ -0,0 +1,40 @@
+package detour
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// ConnObserver observes how a connection dialed by Dialer() decides whether
+// to detour, e.g. to trace it, see SetConnObserver(). The methods are called
+// from the goroutines using the connection.
+type ConnObserver interface {
+	// Step is called for each step taken, the same as recorded in
+	// Conn.Timeline().
+	Step(event string, err error)
+	// Detected is called when detection decides the path, "direct" or
+	// "detour", along with the reason.
+	Detected(path, reason string)
+	// Done is called once deciding is over, i.e. when dialing fails, the first
+	// read returns, or the connection is closed before that, with whether it
+	// ended up detoured and the error if any.
+	Done(detoured bool, err error)
+}
+
+// SetConnObserver sets a function called when dialing each connection with
+// the context passed to the dialer, which returns the ConnObserver of the
+// connection, or nil not to observe it. Pass nil to disable.
+func SetConnObserver(fn func(ctx context.Context, network, addr string) ConnObserver) {
+	UpdateConfig(func(c Config) Config {
+		c.ConnObserver = fn
+		return c
+	})
+}
+
+// observeDone calls Done() of the observer, if any, unless already called.
+func (dc *Conn) observeDone(err error) {
+	if dc.observer == nil || !atomic.CompareAndSwapInt32(&dc.observed, 0, 1) {
+		return
+	}
+	dc.observer.Done(dc.inState(stateDetour), err)
+}
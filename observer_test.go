@@ -0,0 +1,69 @@
+package detour
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type recordingObserver struct {
+	mx     sync.Mutex
+	events []string
+}
+
+func (o *recordingObserver) record(event string) {
+	o.mx.Lock()
+	o.events = append(o.events, event)
+	o.mx.Unlock()
+}
+
+func (o *recordingObserver) Step(event string, err error) { o.record(event) }
+func (o *recordingObserver) Detected(path, reason string) { o.record(path + ": " + reason) }
+func (o *recordingObserver) Done(detoured bool, err error) {
+	if detoured {
+		o.record("done detoured")
+	} else {
+		o.record("done direct")
+	}
+}
+
+func TestConnObserver(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	var o *recordingObserver
+	SetConnObserver(func(ctx context.Context, network, addr string) ConnObserver {
+		o = &recordingObserver{}
+		return o
+	})
+	defer SetConnObserver(nil)
+	detourAddr := newBannerServer("hello detour", 0)
+	directAddr := newBannerServer("", 0)
+	dialer := Dialer(dialTo(directAddr), dialTo(detourAddr))
+
+	assert.Equal(t, "hello detour", readOnce(t, dialer, directAddr))
+	assert.Equal(t, []string{"dial direct", "dialed direct", "first read", "first read done",
+		"detour: read timeout", "dial detour", "dialed detour", "detour first read", "detour first read done", "done detoured"}, o.events)
+
+	conn, err := dialer(context.Background(), "tcp", directAddr)
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	assert.Equal(t, []string{"dial detour", "dialed detour", "done detoured"}, o.events, "should be done by the time dial returns if whitelisted")
+
+	RemoveFromWl(directAddr)
+	conn, err = dialer(context.Background(), "tcp", directAddr)
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	assert.Equal(t, []string{"dial direct", "dialed direct", "done direct"}, o.events, "should be done once closed before the first read")
+	_, err = Dialer(dialTo(directAddr), func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, net.UnknownNetworkError("unreachable")
+	})(context.Background(), "tcp", "example.onion:80")
+	assert.Error(t, err)
+	assert.Equal(t, []string{"dial detour", "dialed detour", "done detoured"}, o.events, "should be done if dialing fails")
+}
@@ -0,0 +1,116 @@
+// Package oteldetour traces how detour decides whether to detour each dial as
+// OpenTelemetry spans. It's separate from package detour so that only those
+// who use it depend on OpenTelemetry.
+package oteldetour
+
+import (
+	"context"
+	"net"
+	"sync"
+
+	"github.com/getlantern/detour"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "github.com/getlantern/detour"
+
+// SetTracerProvider makes detour create a span from tp for each dial, as a
+// child of the span in the context passed to the dialer if any. The direct
+// attempt, the detection decision and the detour attempt are recorded as its
+// child spans, with the attributes host, detoured and reason. Pass nil to
+// stop tracing.
+func SetTracerProvider(tp trace.TracerProvider) {
+	if tp == nil {
+		detour.SetConnObserver(nil)
+		return
+	}
+	tracer := tp.Tracer(instrumentationName)
+	detour.SetConnObserver(func(ctx context.Context, network, addr string) detour.ConnObserver {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		ctx, span := tracer.Start(ctx, "detour.dial", trace.WithAttributes(attribute.String("host", host)))
+		return &observer{tracer: tracer, ctx: ctx, span: span, host: host}
+	})
+}
+
+type observer struct {
+	tracer trace.Tracer
+	host   string
+
+	mx   sync.Mutex
+	ctx  context.Context
+	span trace.Span
+	// the spans of the direct and detour attempts in progress if any
+	direct trace.Span
+	detour trace.Span
+}
+
+func (o *observer) Step(event string, err error) {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+	o.span.AddEvent(event)
+	switch event {
+	case "dial direct":
+		o.direct = o.start("detour.direct")
+	case "dialed direct":
+		if err != nil {
+			end(&o.direct, err)
+		}
+	case "first read done":
+		end(&o.direct, err)
+	case "dial detour":
+		// the direct attempt is over once detouring
+		end(&o.direct, nil)
+		o.detour = o.start("detour.detour")
+	case "dialed detour":
+		if err != nil {
+			end(&o.detour, err)
+		}
+	case "detour first read done":
+		end(&o.detour, err)
+	}
+}
+
+func (o *observer) Detected(path, reason string) {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+	attrs := []attribute.KeyValue{attribute.Bool("detoured", path == "detour"), attribute.String("reason", reason)}
+	_, span := o.tracer.Start(o.ctx, "detour.decision", trace.WithAttributes(append(attrs, attribute.String("host", o.host))...))
+	span.End()
+	o.span.SetAttributes(attrs...)
+}
+
+func (o *observer) Done(detoured bool, err error) {
+	o.mx.Lock()
+	defer o.mx.Unlock()
+	end(&o.direct, nil)
+	end(&o.detour, nil)
+	o.span.SetAttributes(attribute.Bool("detoured", detoured))
+	if err != nil {
+		o.span.RecordError(err)
+		o.span.SetStatus(codes.Error, err.Error())
+	}
+	o.span.End()
+}
+
+func (o *observer) start(name string) trace.Span {
+	_, span := o.tracer.Start(o.ctx, name, trace.WithAttributes(attribute.String("host", o.host)))
+	return span
+}
+
+// end ends the span if in progress, recording err if any.
+func end(span *trace.Span, err error) {
+	if *span == nil {
+		return
+	}
+	if err != nil {
+		(*span).RecordError(err)
+		(*span).SetStatus(codes.Error, err.Error())
+	}
+	(*span).End()
+	*span = nil
+}
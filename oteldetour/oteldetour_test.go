@@ -0,0 +1,83 @@
+package oteldetour
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/detour"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestSetTracerProvider(t *testing.T) {
+	s := detour.SaveState()
+	defer detour.RestoreState(s)
+	detour.UpdateConfig(func(c detour.Config) detour.Config {
+		c.FirstReadTimeout = 50 * time.Millisecond
+		c.DetectPrivateNetworks = true
+		return c
+	})
+	exporter := tracetest.NewInMemoryExporter()
+	SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	defer SetTracerProvider(nil)
+
+	detourAddr := newBannerServer(t, "hello detour")
+	blockedAddr := newBannerServer(t, "")
+	conn, err := detour.Dialer(dialTo(blockedAddr), dialTo(detourAddr))(context.Background(), "tcp", blockedAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Read(make([]byte, 1024))
+	assert.NoError(t, err)
+	conn.Close()
+
+	spans := make(map[string]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = span
+	}
+	if !assert.Len(t, spans, 4) {
+		return
+	}
+	root := spans["detour.dial"]
+	for _, name := range []string{"detour.direct", "detour.decision", "detour.detour"} {
+		assert.Equal(t, root.SpanContext.SpanID(), spans[name].Parent.SpanID(), "%s should be a child span of the dial", name)
+		assert.Contains(t, spans[name].Attributes, attribute.String("host", "127.0.0.1"))
+	}
+	assert.Contains(t, root.Attributes, attribute.String("host", "127.0.0.1"))
+	assert.Contains(t, root.Attributes, attribute.Bool("detoured", true))
+	assert.Contains(t, spans["detour.decision"].Attributes, attribute.Bool("detoured", true))
+	assert.Contains(t, spans["detour.decision"].Attributes, attribute.String("reason", "read timeout"))
+	assert.True(t, spans["detour.direct"].EndTime.Sub(spans["detour.direct"].StartTime) >= 50*time.Millisecond, "direct attempt should last the first read timeout")
+	assert.False(t, spans["detour.detour"].EndTime.IsZero())
+}
+
+func dialTo(target string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return net.Dial(network, target)
+	}
+}
+
+// newBannerServer serves banner to each connection, or nothing if empty
+func newBannerServer(t *testing.T, banner string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if banner != "" {
+				conn.Write([]byte(banner))
+			}
+		}
+	}()
+	return l.Addr().String()
+}
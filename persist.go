@@ -0,0 +1,92 @@
+package detour
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// persistedEntry is the format of a whitelist entry saved by SaveWhitelist()
+type persistedEntry struct {
+	Host    string    `json:"host"`
+	Network string    `json:"network,omitempty"`
+	Added   time.Time `json:"added"`
+	Label   string    `json:"label,omitempty"`
+	// what's learned about the host, if anything
+	Learned *LearnedParams `json:"learned,omitempty"`
+	// the host is not whitelisted but only has what's learned about it saved
+	LearnedOnly bool `json:"learned_only,omitempty"`
+}
+
+// SaveWhitelist writes the permanent entries of the whitelist to w as JSON,
+// along with when each was added and the label if any, so they can be loaded
+// by LoadWhitelist(). What's learned about hosts, see Learned(), is saved too,
+// including hosts not whitelisted.
+// Dialers bound to entries are not saved.
+func SaveWhitelist(w io.Writer) error {
+	all := allLearned()
+	muWhitelist.RLock()
+	entries := make([]persistedEntry, 0, len(whitelist))
+	for host, e := range whitelist {
+		if e.permanent {
+			pe := persistedEntry{Host: host, Network: e.network, Added: e.added, Label: e.label}
+			if p, ok := all[host]; ok {
+				pe.Learned = &p
+				delete(all, host)
+			}
+			entries = append(entries, pe)
+		}
+	}
+	muWhitelist.RUnlock()
+	for host, p := range all {
+		p := p
+		entries = append(entries, persistedEntry{Host: host, Learned: &p, LearnedOnly: true})
+	}
+	return json.NewEncoder(w).Encode(entries)
+}
+
+// LoadWhitelist adds the entries saved by SaveWhitelist() to the whitelist as
+// permanent ones, skipping those added longer than maxAge ago so that stale
+// blocks don't force detour indefinitely. A zero maxAge loads all entries.
+// What's learned about hosts is always restored. It returns the number of
+// whitelist entries loaded.
+func LoadWhitelist(r io.Reader, maxAge time.Duration) (int, error) {
+	var entries []persistedEntry
+	if err := json.NewDecoder(r).Decode(&entries); err != nil {
+		return 0, fmt.Errorf("Unable to decode whitelist: %s", err)
+	}
+	now := time.Now()
+	muWhitelist.Lock()
+	defer muWhitelist.Unlock()
+	loaded := 0
+	for _, pe := range entries {
+		// normalized like any other added host, e.g. if saved before
+		// SetHostNormalizer()
+		host := normalizeHost(pe.Host)
+		if host == "" {
+			log.Debugf("Skipping whitelist entry with empty host")
+			continue
+		}
+		if pe.Learned != nil {
+			restoreLearned(host, *pe.Learned)
+		}
+		if pe.LearnedOnly {
+			continue
+		}
+		if maxAge > 0 && now.Sub(pe.Added) > maxAge {
+			log.Tracef("Skipping %v added at %v", pe.Host, pe.Added)
+			continue
+		}
+		e := whitelist[host]
+		e.permanent = true
+		e.provisional = false
+		e.network = pe.Network
+		e.added = pe.Added
+		e.label = pe.Label
+		putWl(host, e)
+		loaded++
+	}
+	log.Debugf("Loaded %d of %d whitelist entries", loaded, len(entries))
+	return loaded, nil
+}
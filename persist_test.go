@@ -0,0 +1,115 @@
+package detour
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaveAndLoadWhitelist(t *testing.T) {
+	defer RemoveFromWl("saved.com")
+	defer RemoveFromWl("temporary.com")
+	AddToWlForNetwork("saved.com:443", "tcp", true)
+	AddToWl("temporary.com:443", false)
+	var buf bytes.Buffer
+	if !assert.NoError(t, SaveWhitelist(&buf)) {
+		return
+	}
+	RemoveFromWl("saved.com")
+	RemoveFromWl("temporary.com")
+
+	_, err := LoadWhitelist(&buf, time.Hour)
+	if assert.NoError(t, err) {
+		assert.True(t, whitelistedFor("tcp", "saved.com:443"))
+		assert.False(t, whitelistedFor("udp", "saved.com:443"), "should keep network")
+		assert.False(t, wlTemporarily("saved.com:443"), "should load as permanent")
+		assert.False(t, whitelisted("temporary.com:443"), "should only save permanent entries")
+	}
+}
+
+func TestLoadWhitelistMaxAge(t *testing.T) {
+	defer RemoveFromWl("old.com")
+	defer RemoveFromWl("recent.com")
+	b, _ := json.Marshal([]persistedEntry{
+		{Host: "old.com", Added: time.Now().Add(-365 * 24 * time.Hour)},
+		{Host: "recent.com", Added: time.Now().Add(-time.Hour)},
+	})
+	n, err := LoadWhitelist(bytes.NewReader(b), 30*24*time.Hour)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, n)
+		assert.False(t, whitelisted("old.com"), "should skip entries older than max age")
+		assert.True(t, whitelisted("recent.com"), "should load recent entries")
+	}
+
+	_, err = LoadWhitelist(bytes.NewReader(b), 0)
+	if assert.NoError(t, err) {
+		assert.True(t, whitelisted("old.com"), "should load all entries without max age")
+	}
+}
+
+func TestLoadWhitelistNormalizes(t *testing.T) {
+	defer RestoreState(SaveState())
+	b, _ := json.Marshal([]persistedEntry{{Host: " Mixed.Example.COM ", Added: time.Now()}})
+	n, err := LoadWhitelist(bytes.NewReader(b), 0)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 1, n)
+		assert.True(t, wlPermanently("mixed.example.com:443"), "should normalize loaded hosts")
+		assert.NotContains(t, DumpWhitelist(), " Mixed.Example.COM ")
+	}
+}
+
+func TestWhitelistLabel(t *testing.T) {
+	defer RemoveFromWl("labeled.com")
+	defer RemoveFromWl("unlabeled.com")
+	AddToWlLabeled("labeled.com:443", true, "blocked in CN per report #123")
+	AddToWl("unlabeled.com:443", true)
+	AddToWl("labeled.com:443", true)
+	assert.Contains(t, DumpWhitelistEntries(), WhitelistEntry{"labeled.com", WhitelistedPermanently, "blocked in CN per report #123"}, "should keep label when added again")
+	assert.Contains(t, DumpWhitelistEntries(), WhitelistEntry{"unlabeled.com", WhitelistedPermanently, ""})
+
+	var buf bytes.Buffer
+	if !assert.NoError(t, SaveWhitelist(&buf)) {
+		return
+	}
+	RemoveFromWl("labeled.com")
+	RemoveFromWl("unlabeled.com")
+	_, err := LoadWhitelist(&buf, 0)
+	if assert.NoError(t, err) {
+		assert.Contains(t, DumpWhitelistEntries(), WhitelistEntry{"labeled.com", WhitelistedPermanently, "blocked in CN per report #123"}, "should load label")
+		assert.Contains(t, DumpWhitelistEntries(), WhitelistEntry{"unlabeled.com", WhitelistedPermanently, ""})
+	}
+}
+
+func TestSaveAndLoadLearned(t *testing.T) {
+	defer RemoveFromWl("learned.com")
+	defer ResetAdaptiveDetectionTimeouts()
+	defer resetLearned()
+	AddToWl("learned.com:443", true)
+	restoreLearned("learned.com", LearnedParams{FirstReadTimeout: 6 * time.Second, FalsePositives: 2})
+	restoreLearned("direct.com", LearnedParams{DirectLatency: 80 * time.Millisecond})
+	var buf bytes.Buffer
+	if !assert.NoError(t, SaveWhitelist(&buf)) {
+		return
+	}
+	RemoveFromWl("learned.com")
+	ResetAdaptiveDetectionTimeouts()
+	resetLearned()
+
+	_, err := LoadWhitelist(&buf, time.Hour)
+	if assert.NoError(t, err) {
+		assert.True(t, wlPermanently("learned.com"))
+		assert.False(t, whitelisted("direct.com"), "should not whitelist hosts with only learned params")
+		assert.Equal(t, LearnedParams{FirstReadTimeout: 6 * time.Second, FalsePositives: 2}, Learned("learned.com:443"))
+		assert.Equal(t, LearnedParams{DirectLatency: 80 * time.Millisecond}, Learned("direct.com:80"))
+		assert.Equal(t, 6*time.Second, adaptedTimeout("learned.com:443"), "should restore adaptive timeout")
+	}
+}
+
+func resetLearned() {
+	muLearned.Lock()
+	learned = make(map[string]LearnedParams)
+	muLearned.Unlock()
+}
@@ -0,0 +1,108 @@
+package detour
+
+import (
+	"sync"
+	"time"
+)
+
+// detour failures and direct successes of a host since last pinned
+type hostRecord struct {
+	detourFailures  int
+	directSuccesses int
+	lastFailure     time.Time
+}
+
+var (
+	muPins sync.Mutex
+	// only hosts which ever failed to detour are recorded
+	hostRecords = make(map[string]*hostRecord)
+	// pinned hosts and when their pins expire
+	pinnedHosts = make(map[string]time.Time)
+	// records of hosts which haven't failed to detour for this long are
+	// removed by the janitor started by StartCleanup()
+	hostRecordTTL = 24 * time.Hour
+)
+
+// SetPinDirect pins a host to direct once detouring it failed n times and it
+// then worked directly at least once. A pinned host is removed from whitelist
+// and always dialed directly without detection until cooldown passes, then it
+// goes through detection again. 0 n, the default, disables it.
+func SetPinDirect(n int, cooldown time.Duration) {
+	UpdateConfig(func(c Config) Config {
+		c.PinDirectAfterDetourFailures = n
+		c.PinDirectCooldown = cooldown
+		return c
+	})
+}
+
+// pinnedDirect checks if the host of addr is pinned to direct.
+func pinnedDirect(addr string) bool {
+	host := hostOnly(addr)
+	muPins.Lock()
+	defer muPins.Unlock()
+	until, ok := pinnedHosts[host]
+	if ok && !time.Now().Before(until) {
+		log.Debugf("Pin of %v to direct expired", host)
+		delete(pinnedHosts, host)
+		return false
+	}
+	return ok
+}
+
+func (dc *Conn) recordDetourFailure() {
+	if dc.cfg.PinDirectAfterDetourFailures <= 0 {
+		return
+	}
+	host := hostOnly(dc.addr)
+	muPins.Lock()
+	defer muPins.Unlock()
+	r := hostRecords[host]
+	if r == nil {
+		r = &hostRecord{}
+		hostRecords[host] = r
+	}
+	r.detourFailures++
+	r.lastFailure = time.Now()
+}
+
+func (dc *Conn) recordDirectSuccess() {
+	if dc.cfg.PinDirectAfterDetourFailures <= 0 {
+		return
+	}
+	host := hostOnly(dc.addr)
+	muPins.Lock()
+	r := hostRecords[host]
+	if r == nil {
+		muPins.Unlock()
+		return
+	}
+	r.directSuccesses++
+	pin := r.detourFailures >= dc.cfg.PinDirectAfterDetourFailures
+	if pin {
+		log.Debugf("Detouring %v failed %d times but direct works, pin it to direct for %v",
+			host, r.detourFailures, dc.cfg.PinDirectCooldown)
+		delete(hostRecords, host)
+		pinnedHosts[host] = time.Now().Add(dc.cfg.PinDirectCooldown)
+	}
+	muPins.Unlock()
+	if pin {
+		RemoveFromWl(host)
+	}
+}
+
+// sweepPins removes the expired pins and the records of hosts which haven't
+// failed to detour within hostRecordTTL by now.
+func sweepPins(now time.Time) {
+	muPins.Lock()
+	defer muPins.Unlock()
+	for host, r := range hostRecords {
+		if now.Sub(r.lastFailure) > hostRecordTTL {
+			delete(hostRecords, host)
+		}
+	}
+	for host, until := range pinnedHosts {
+		if !now.Before(until) {
+			delete(pinnedHosts, host)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package detour
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPinDirect(t *testing.T) {
+	defer stopMockServers()
+	SetPinDirect(2, 200*time.Millisecond)
+	defer SetPinDirect(0, 0)
+	const addr = "example.com:80"
+	defer RemoveFromWl(addr)
+	defer func() {
+		muPins.Lock()
+		delete(hostRecords, hostOnly(addr))
+		delete(pinnedHosts, hostOnly(addr))
+		muPins.Unlock()
+	}()
+
+	directAddr := newBannerServer("hello", 0)
+	failingDetour := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, errors.New("detour failed")
+	}
+	dialer := Dialer(dialTo(directAddr), failingDetour)
+
+	AddToWl(addr, false)
+	for i := 0; i < 2; i++ {
+		_, err := dialer(context.Background(), "tcp", addr)
+		assert.Error(t, err, "should fail to detour")
+	}
+	assert.False(t, pinnedDirect(addr), "should not pin without direct success")
+
+	RemoveFromWl(addr)
+	assert.Equal(t, "hello", readOnce(t, dialer, addr))
+	assert.True(t, pinnedDirect(addr), "should pin after detour failures and a direct success")
+	assert.False(t, whitelisted(addr), "pinned host should be removed from whitelist")
+
+	AddToWl(addr, false)
+	assert.Equal(t, "hello", readOnce(t, dialer, addr), "pinned host should be dialed directly even if whitelisted")
+
+	time.Sleep(300 * time.Millisecond)
+	_, err := dialer(context.Background(), "tcp", addr)
+	assert.Error(t, err, "should detect again after cooldown")
+	assert.False(t, pinnedDirect(addr))
+}
+
+func TestSweepPins(t *testing.T) {
+	defer RestoreState(SaveState())
+	now := time.Now()
+	muPins.Lock()
+	hostRecords["stale.example.com"] = &hostRecord{detourFailures: 1, lastFailure: now.Add(-2 * hostRecordTTL)}
+	hostRecords["recent.example.com"] = &hostRecord{detourFailures: 1, lastFailure: now}
+	pinnedHosts["expired.example.com"] = now.Add(-time.Second)
+	pinnedHosts["pinned.example.com"] = now.Add(time.Minute)
+	muPins.Unlock()
+
+	sweepPins(now)
+	muPins.Lock()
+	defer muPins.Unlock()
+	assert.NotContains(t, hostRecords, "stale.example.com", "should remove stale records")
+	assert.Contains(t, hostRecords, "recent.example.com")
+	assert.NotContains(t, pinnedHosts, "expired.example.com", "should remove expired pins")
+	assert.Contains(t, pinnedHosts, "pinned.example.com")
+}
@@ -0,0 +1,74 @@
+// Package prommetrics exposes the detour counters, whitelist sizes and
+// detection durations as Prometheus metrics. It's separate from package detour
+// so that only those who use it depend on the Prometheus client.
+package prommetrics
+
+import (
+	"github.com/getlantern/detour"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	detoursDesc = prometheus.NewDesc(
+		"detour_detours_total",
+		"Connections detoured, by the reason why.",
+		[]string{"reason"}, nil)
+	whitelistDesc = prometheus.NewDesc(
+		"detour_whitelist_entries",
+		"Entries in the whitelist, by type.",
+		[]string{"type"}, nil)
+	throttledDesc = prometheus.NewDesc(
+		"detour_whitelisted_throttled_total",
+		"Direct connections found throttled, whose sites are whitelisted so later connections detour.",
+		nil, nil)
+	detectionDesc = prometheus.NewDesc(
+		"detour_detection_duration_seconds",
+		"Time taken by first reads from direct connections to detect blocking.",
+		nil, nil)
+)
+
+type collector struct{}
+
+// Collector returns a prometheus.Collector reading the package wide state of
+// detour each time it's collected, to be registered with a
+// prometheus.Registerer.
+func Collector() prometheus.Collector {
+	return collector{}
+}
+
+// Describe implements prometheus.Collector.
+func (collector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- detoursDesc
+	ch <- whitelistDesc
+	ch <- throttledDesc
+	ch <- detectionDesc
+}
+
+// Collect implements prometheus.Collector.
+func (collector) Collect(ch chan<- prometheus.Metric) {
+	s := detour.Stats()
+	for reason, v := range map[string]int64{
+		"dial_failure":    s.DetouredDialFailure,
+		"unreachable":     s.DetouredUnreachable,
+		"read_timeout":    s.DetouredReadTimeout,
+		"hijack":          s.DetouredHijack,
+		"unsuccessful":    s.DetouredUnsuccessful,
+		"handshake_stall": s.DetouredHandshakeStall,
+	} {
+		ch <- prometheus.MustNewConstMetric(detoursDesc, prometheus.CounterValue, float64(v), reason)
+	}
+
+	permanent, temporary, force := detour.WhitelistSize()
+	for typ, v := range map[string]int{
+		"permanent": permanent,
+		"temporary": temporary,
+		"force":     force,
+	} {
+		ch <- prometheus.MustNewConstMetric(whitelistDesc, prometheus.GaugeValue, float64(v), typ)
+	}
+	ch <- prometheus.MustNewConstMetric(throttledDesc, prometheus.CounterValue, float64(s.WhitelistedThrottled))
+
+	// only the count and the total are tracked, so no quantiles
+	count, total := detour.DetectionDurations()
+	ch <- prometheus.MustNewConstSummary(detectionDesc, uint64(count), total.Seconds(), nil)
+}
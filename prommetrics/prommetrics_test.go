@@ -0,0 +1,93 @@
+package prommetrics
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/getlantern/detour"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCollector(t *testing.T) {
+	s := detour.SaveState()
+	defer detour.RestoreState(s)
+	detour.UpdateConfig(func(c detour.Config) detour.Config {
+		c.FirstReadTimeout = 50 * time.Millisecond
+		c.DetectPrivateNetworks = true
+		return c
+	})
+	before := detour.Stats()
+	detourAddr := newBannerServer(t, "hello detour")
+	blockedAddr := newBannerServer(t, "")
+	conn, err := detour.Dialer(dialTo(blockedAddr), dialTo(detourAddr))(context.Background(), "tcp", blockedAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	_, err = conn.Read(make([]byte, 1024))
+	assert.NoError(t, err)
+
+	reg := prometheus.NewRegistry()
+	if !assert.NoError(t, reg.Register(Collector())) {
+		return
+	}
+	families, err := reg.Gather()
+	if !assert.NoError(t, err) {
+		return
+	}
+	conn.Close()
+	metrics := make(map[string][]*dto.Metric)
+	for _, f := range families {
+		metrics[f.GetName()] = f.GetMetric()
+	}
+	assert.Equal(t, float64(before.DetouredReadTimeout+1), valueOf(metrics["detour_detours_total"], "reason", "read_timeout").GetCounter().GetValue())
+	assert.Len(t, metrics["detour_detours_total"], 6)
+	assert.Len(t, metrics["detour_whitelisted_throttled_total"], 1)
+	assert.True(t, valueOf(metrics["detour_whitelist_entries"], "type", "temporary").GetGauge().GetValue() >= 1, "should count the detoured site")
+	if assert.Len(t, metrics["detour_detection_duration_seconds"], 1) {
+		summary := metrics["detour_detection_duration_seconds"][0].GetSummary()
+		assert.True(t, summary.GetSampleCount() >= 1)
+		assert.True(t, summary.GetSampleSum() >= 0.05, "should take at least the first read timeout")
+	}
+}
+
+func valueOf(metrics []*dto.Metric, label, value string) *dto.Metric {
+	for _, m := range metrics {
+		for _, l := range m.GetLabel() {
+			if l.GetName() == label && l.GetValue() == value {
+				return m
+			}
+		}
+	}
+	return nil
+}
+
+func dialTo(target string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return net.Dial(network, target)
+	}
+}
+
+// newBannerServer serves banner to each connection, or nothing if empty
+func newBannerServer(t *testing.T, banner string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if banner != "" {
+				conn.Write([]byte(banner))
+			}
+		}
+	}()
+	return l.Addr().String()
+}
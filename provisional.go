@@ -0,0 +1,85 @@
+package detour
+
+import (
+	"context"
+	"time"
+)
+
+// SetVerifyBeforeTrust makes hosts newly whitelisted by detection provisional
+// until verified in background by dialing directly again, to avoid acting on
+// transient glitches. If the direct connection works this time, the entry is
+// removed, otherwise it's confirmed. Provisional entries still detour but are
+// not made permanent, see WhitelistedProvisionally(). Adding the host to
+// whitelist by other means confirms it. Disabled by default.
+func SetVerifyBeforeTrust(enabled bool) {
+	UpdateConfig(func(c Config) Config {
+		c.VerifyBeforeTrust = enabled
+		return c
+	})
+}
+
+// WhitelistedProvisionally checks if addr is in whitelist but not verified yet,
+// see SetVerifyBeforeTrust().
+func WhitelistedProvisionally(addr string) bool {
+	muWhitelist.RLock()
+	defer muWhitelist.RUnlock()
+	e, ok := whitelist[hostOnly(addr)]
+	return ok && e.provisional
+}
+
+// addProvisionally adds addr to whitelist temporarily and provisionally if it's
+// not in whitelist yet, and returns whether it did.
+func addProvisionally(addr string) bool {
+	muWhitelist.Lock()
+	defer muWhitelist.Unlock()
+	host := hostOnly(addr)
+	if _, ok := whitelist[host]; ok {
+		return false
+	}
+	log.Tracef("Adding %v to whitelist provisionally", addr)
+	putWl(host, wlEntry{provisional: true, added: time.Now()})
+	whitelistResolvedIPs(host)
+	return true
+}
+
+// verifyBlocked dials directly again, sends req if any and reads within the
+// first read timeout, to confirm addr is blocked. The provisional entry is
+// confirmed if it fails again or the response is hijacked, otherwise removed.
+func (dc *Conn) verifyBlocked(addr string, req []byte) {
+	ctx, cancel := context.WithTimeout(context.Background(), dc.cfg.firstReadTimeoutFor(dc.addr))
+	defer cancel()
+	blocked := true
+	conn, err := dc.directDialer(ctx, dc.network, dc.addr)
+	if err == nil {
+		err = withDeadline(ctx, conn, func() error {
+			if len(req) > 0 {
+				if _, err := conn.Write(req); err != nil {
+					return err
+				}
+			}
+			b := make([]byte, 4096)
+			n, err := conn.Read(b)
+			if err == nil && !dc.cfg.Detector.FakeResponse(b[:n]) {
+				blocked = false
+			}
+			return err
+		})
+		conn.Close()
+	}
+	muWhitelist.Lock()
+	defer muWhitelist.Unlock()
+	host := hostOnly(addr)
+	e, ok := whitelist[host]
+	if !ok || !e.provisional {
+		return
+	}
+	if blocked {
+		log.Debugf("Verified %s is blocked (%v), confirm its whitelist entry", addr, err)
+		e.provisional = false
+		whitelist[host] = e
+		return
+	}
+	log.Debugf("%s is reachable directly when verified, remove its provisional whitelist entry", addr)
+	deleteWl(host)
+	evicted(host, EvictRemoved)
+}
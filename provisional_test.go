@@ -0,0 +1,45 @@
+package detour
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyBeforeTrust(t *testing.T) {
+	s := SaveState()
+	defer RestoreState(s)
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	SetVerifyBeforeTrust(true)
+	blackholeAddr := newBannerServer("", 0)
+	directAddr := newBannerServer("hello direct", 0)
+	detourAddr := newBannerServer("hello detour", 0)
+
+	dialer := Dialer(dialTo(blackholeAddr), dialTo(detourAddr))
+	assert.Equal(t, "hello detour", readOnce(t, dialer, "confirmed.example.com:80"))
+	assert.True(t, WhitelistedProvisionally("confirmed.example.com"), "should whitelist provisionally until verified")
+	assert.Eventually(t, func() bool {
+		return !WhitelistedProvisionally("confirmed.example.com")
+	}, time.Second, 10*time.Millisecond)
+	assert.True(t, whitelisted("confirmed.example.com"), "should confirm if still blocked")
+
+	// blocked only on the first dial
+	var dials int32
+	glitchy := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if atomic.AddInt32(&dials, 1) == 1 {
+			return net.Dial(network, blackholeAddr)
+		}
+		return net.Dial(network, directAddr)
+	}
+	dialer = Dialer(glitchy, dialTo(detourAddr))
+	assert.Equal(t, "hello detour", readOnce(t, dialer, "refuted.example.com:80"))
+	assert.Eventually(t, func() bool {
+		return !whitelisted("refuted.example.com")
+	}, time.Second, 10*time.Millisecond, "should remove if reachable when verified")
+	assert.Equal(t, "hello direct", readOnce(t, dialer, "refuted.example.com:80"))
+}
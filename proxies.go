@@ -0,0 +1,282 @@
+package detour
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// WeightedProxy is a detour dialer along with its relative capacity.
+type WeightedProxy struct {
+	// ID identifies the proxy, it should be unique across all proxies.
+	ID   string
+	Dial dialFunc
+	// Weight is the relative chance the proxy is picked, values less than 1
+	// are treated as 1.
+	Weight int
+}
+
+var (
+	muProxies sync.RWMutex
+	// all proxies passed to DialerWithProxies() by ID
+	registeredProxies = make(map[string]WeightedProxy)
+	// IDs of proxies failed the last health check
+	unhealthyProxies = make(map[string]bool)
+	// IDs of quarantined proxies and when their quarantine ends
+	quarantinedProxies = make(map[string]time.Time)
+	// IDs of proxies disabled by DisableProxy()
+	disabledProxies = make(map[string]bool)
+	// the proxy each host was last detoured through, see SetStickyProxies()
+	proxyAffinity = make(map[string]affinity)
+
+	// instance of func()
+	allProxiesDownCallback atomic.Value
+	// the callback fires at most once within this interval
+	allProxiesDownDebounce = 30 * time.Second
+	lastAllProxiesDown     time.Time
+)
+
+// OnAllProxiesDown sets a callback invoked when detouring is needed but all
+// proxies passed to DialerWithProxies() failed to connect, e.g. to alert the
+// user. It's debounced so a burst of failures fires it only once.
+func OnAllProxiesDown(cb func()) {
+	allProxiesDownCallback.Store(cb)
+}
+
+func allProxiesDown() {
+	cb, _ := allProxiesDownCallback.Load().(func())
+	if cb == nil {
+		return
+	}
+	muProxies.Lock()
+	now := time.Now()
+	debounced := now.Sub(lastAllProxiesDown) < allProxiesDownDebounce
+	if !debounced {
+		lastAllProxiesDown = now
+	}
+	muProxies.Unlock()
+	if !debounced {
+		go cb()
+	}
+}
+
+type affinity struct {
+	id      string
+	expires time.Time
+}
+
+// SetStickyProxies makes detours to a host prefer the proxy it was last
+// detoured through within ttl, as switching proxies may break sessions bound
+// to the client IP server side. Other proxies are still tried if it fails or
+// is unusable. Pass 0 to disable.
+func SetStickyProxies(ttl time.Duration) {
+	UpdateConfig(func(c Config) Config {
+		c.StickyProxyTTL = ttl
+		return c
+	})
+}
+
+// DialerWithProxies is like Dialer() but detours through multiple proxies.
+// Each time it detours, a proxy is picked by weighted random selection, and if
+// dialing it fails the others are tried in turn, also by weight. Proxies
+// failed the health check are skipped, see StartProxyHealthChecks(). Proxies
+// no longer used should be unregistered with UnregisterProxy().
+func DialerWithProxies(directDialer dialFunc, proxies ...WeightedProxy) dialFunc {
+	muProxies.Lock()
+	for _, p := range proxies {
+		registeredProxies[p.ID] = p
+	}
+	muProxies.Unlock()
+	return Dialer(directDialer, proxiesDialer(proxies))
+}
+
+func proxiesDialer(proxies []WeightedProxy) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		err := errors.New("No detour proxy configured")
+		usable := usableProxies(proxies)
+		if len(usable) == 0 && len(proxies) > 0 {
+			return nil, errors.New("All detour proxies are disabled")
+		}
+		cfg := currentConfig()
+		ttl := cfg.StickyProxyTTL
+		if cfg.WeightProxiesBySuccess {
+			usable = weightedBySuccess(usable)
+		}
+		ordered := weightedOrder(usable)
+		if ttl > 0 {
+			ordered = preferAffinity(ordered, addr)
+		}
+		for _, p := range ordered {
+			var conn net.Conn
+			conn, err = p.Dial(ctx, network, addr)
+			recordAttempt(ctx, "proxy "+p.ID, err)
+			if err != nil && ctx.Err() != nil {
+				// cancelled or timed out as a whole, not the proxy's fault
+				log.Debugf("Gave up detouring to %s via proxy %s: %s", addr, p.ID, ctx.Err())
+				return nil, err
+			}
+			recordProxyOutcome(p.ID, err)
+			if err == nil {
+				log.Tracef("Detoured to %s via proxy %s", addr, p.ID)
+				if ttl > 0 {
+					muProxies.Lock()
+					proxyAffinity[hostOnly(addr)] = affinity{p.ID, time.Now().Add(ttl)}
+					muProxies.Unlock()
+				}
+				return conn, nil
+			}
+			log.Debugf("Unable to detour to %s via proxy %s: %s", addr, p.ID, err)
+		}
+		if len(proxies) > 0 {
+			allProxiesDown()
+		}
+		return nil, err
+	}
+}
+
+// QuarantineProxy takes the proxy out of rotation for d, e.g. when it's found
+// returning corrupted data. It's reported as unhealthy by ProxyHealth() until
+// the quarantine ends, regardless of health checks.
+func QuarantineProxy(id string, d time.Duration) {
+	log.Debugf("Quarantining proxy %s for %v", id, d)
+	muProxies.Lock()
+	defer muProxies.Unlock()
+	quarantinedProxies[id] = time.Now().Add(d)
+}
+
+// DisableProxy takes the proxy out of rotation until EnableProxy() is called,
+// e.g. for maintenance. Unlike unhealthy or quarantined proxies, disabled ones
+// are never tried, even if all other proxies are unusable.
+func DisableProxy(id string) {
+	log.Debugf("Disabling proxy %s", id)
+	muProxies.Lock()
+	defer muProxies.Unlock()
+	disabledProxies[id] = true
+}
+
+// EnableProxy puts the proxy disabled by DisableProxy() back into rotation,
+// subject to health checks and quarantine as usual.
+func EnableProxy(id string) {
+	log.Debugf("Enabling proxy %s", id)
+	muProxies.Lock()
+	defer muProxies.Unlock()
+	delete(disabledProxies, id)
+}
+
+// UnregisterProxy forgets the proxy passed to DialerWithProxies(), along with
+// its health, quarantine, stats and the hosts sticking to it, e.g. when it's
+// decommissioned or replaced by one with a different ID. Dialers created with
+// it still try it.
+func UnregisterProxy(id string) {
+	log.Debugf("Unregistering proxy %s", id)
+	muProxies.Lock()
+	defer muProxies.Unlock()
+	delete(registeredProxies, id)
+	delete(unhealthyProxies, id)
+	delete(quarantinedProxies, id)
+	delete(disabledProxies, id)
+	delete(proxyStats, id)
+	for host, a := range proxyAffinity {
+		if a.id == id {
+			delete(proxyAffinity, host)
+		}
+	}
+}
+
+// quarantined checks if the proxy is in quarantine. The caller should hold
+// muProxies.
+func quarantined(id string, now time.Time) bool {
+	until, ok := quarantinedProxies[id]
+	return ok && now.Before(until)
+}
+
+// usableProxies filters out disabled proxies, then unhealthy and quarantined
+// ones, unless all the enabled proxies are, in which case the enabled ones are
+// all tried anyway.
+func usableProxies(proxies []WeightedProxy) []WeightedProxy {
+	muProxies.RLock()
+	defer muProxies.RUnlock()
+	now := time.Now()
+	enabled := make([]WeightedProxy, 0, len(proxies))
+	usable := make([]WeightedProxy, 0, len(proxies))
+	for _, p := range proxies {
+		if disabledProxies[p.ID] {
+			continue
+		}
+		enabled = append(enabled, p)
+		if !unhealthyProxies[p.ID] && !quarantined(p.ID, now) {
+			usable = append(usable, p)
+		}
+	}
+	if len(usable) == 0 {
+		return enabled
+	}
+	return usable
+}
+
+// preferAffinity moves the proxy the host of addr was last detoured through,
+// if any and not expired, to the front.
+func preferAffinity(ordered []WeightedProxy, addr string) []WeightedProxy {
+	host := hostOnly(addr)
+	muProxies.Lock()
+	a, ok := proxyAffinity[host]
+	if ok && time.Now().After(a.expires) {
+		delete(proxyAffinity, host)
+		ok = false
+	}
+	muProxies.Unlock()
+	if !ok {
+		return ordered
+	}
+	for i, p := range ordered {
+		if p.ID == a.id {
+			copy(ordered[1:i+1], ordered[:i])
+			ordered[0] = p
+			break
+		}
+	}
+	return ordered
+}
+
+// sweepAffinity removes the proxy affinities expired by now.
+func sweepAffinity(now time.Time) {
+	muProxies.Lock()
+	defer muProxies.Unlock()
+	for host, a := range proxyAffinity {
+		if now.After(a.expires) {
+			delete(proxyAffinity, host)
+		}
+	}
+}
+
+// weightedOrder returns the proxies in the order to try, which is a weighted
+// random sampling without replacement.
+func weightedOrder(proxies []WeightedProxy) []WeightedProxy {
+	remaining := append([]WeightedProxy(nil), proxies...)
+	ordered := make([]WeightedProxy, 0, len(proxies))
+	for len(remaining) > 0 {
+		total := 0
+		for _, p := range remaining {
+			total += weightOf(p)
+		}
+		r := randIntn(total)
+		for i, p := range remaining {
+			if r -= weightOf(p); r < 0 {
+				ordered = append(ordered, p)
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+	}
+	return ordered
+}
+
+func weightOf(p WeightedProxy) int {
+	if p.Weight < 1 {
+		return 1
+	}
+	return p.Weight
+}
@@ -0,0 +1,343 @@
+package detour
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingProxy returns a proxy which records its ID to picked when dialed
+// and fails if fail is true.
+func recordingProxy(id string, weight int, fail bool, picked *[]string) WeightedProxy {
+	return WeightedProxy{
+		ID:     id,
+		Weight: weight,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			*picked = append(*picked, id)
+			if fail {
+				return nil, errors.New("proxy " + id + " down")
+			}
+			c1, c2 := net.Pipe()
+			c2.Close()
+			return c1, nil
+		},
+	}
+}
+
+func TestWeightedProxySelection(t *testing.T) {
+	var picked []string
+	dial := proxiesDialer([]WeightedProxy{
+		recordingProxy("light", 1, false, &picked),
+		recordingProxy("heavy", 3, false, &picked),
+	})
+	const dials = 10000
+	for i := 0; i < dials; i++ {
+		conn, err := dial(context.Background(), "tcp", "example.com:443")
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+	}
+	counts := make(map[string]int)
+	for _, id := range picked {
+		counts[id]++
+	}
+	assert.Equal(t, dials, counts["light"]+counts["heavy"], "should dial one proxy each time if it works")
+	assert.InDelta(t, 0.25, float64(counts["light"])/dials, 0.03, "selection should roughly match weights")
+	assert.InDelta(t, 0.75, float64(counts["heavy"])/dials, 0.03, "selection should roughly match weights")
+}
+
+func TestWeightedProxyFailover(t *testing.T) {
+	var picked []string
+	dial := proxiesDialer([]WeightedProxy{
+		recordingProxy("down", 100, true, &picked),
+		recordingProxy("up", 1, false, &picked),
+	})
+	// "up" is rarely but possibly tried first
+	for i := 0; i < 10 && !contains(picked, "down"); i++ {
+		conn, err := dial(context.Background(), "tcp", "example.com:443")
+		if assert.NoError(t, err, "should fail over to other proxies") {
+			conn.Close()
+		}
+	}
+	assert.Contains(t, picked, "down")
+	assert.Equal(t, "up", picked[len(picked)-1])
+
+	picked = nil
+	dial = proxiesDialer([]WeightedProxy{recordingProxy("down", 1, true, &picked)})
+	_, err := dial(context.Background(), "tcp", "example.com:443")
+	assert.Error(t, err, "should fail if all proxies fail")
+	_, err = proxiesDialer(nil)(context.Background(), "tcp", "example.com:443")
+	assert.Error(t, err, "should fail without proxies")
+}
+
+func contains(ids []string, id string) bool {
+	for _, v := range ids {
+		if v == id {
+			return true
+		}
+	}
+	return false
+}
+
+func TestOnAllProxiesDown(t *testing.T) {
+	var fired int32
+	OnAllProxiesDown(func() { atomic.AddInt32(&fired, 1) })
+	defer OnAllProxiesDown(nil)
+	var picked []string
+	dial := proxiesDialer([]WeightedProxy{
+		recordingProxy("down1", 1, true, &picked),
+		recordingProxy("down2", 1, true, &picked),
+	})
+	for i := 0; i < 10; i++ {
+		_, err := dial(context.Background(), "tcp", "example.com:443")
+		assert.Error(t, err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&fired), "should fire once in a burst")
+
+	picked = nil
+	dial = proxiesDialer([]WeightedProxy{
+		recordingProxy("down", 1, true, &picked),
+		recordingProxy("up", 1, false, &picked),
+	})
+	muProxies.Lock()
+	lastAllProxiesDown = time.Time{}
+	muProxies.Unlock()
+	conn, err := dial(context.Background(), "tcp", "example.com:443")
+	if assert.NoError(t, err) {
+		conn.Close()
+	}
+	time.Sleep(50 * time.Millisecond)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&fired), "should not fire if any proxy works")
+
+	picked = nil
+	dial = proxiesDialer([]WeightedProxy{
+		recordingProxy("down1", 1, true, &picked),
+		recordingProxy("down2", 1, true, &picked),
+	})
+	muProxies.Lock()
+	lastAllProxiesDown = time.Time{}
+	muProxies.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = dial(ctx, "tcp", "example.com:443")
+	assert.Error(t, err)
+	assert.Len(t, picked, 1, "should not try other proxies once cancelled")
+	time.Sleep(50 * time.Millisecond)
+	assert.EqualValues(t, 1, atomic.LoadInt32(&fired), "should not fire if cancelled")
+}
+
+func TestQuarantineProxy(t *testing.T) {
+	defer resetProxies()
+	var picked []string
+	proxies := []WeightedProxy{
+		recordingProxy("corrupting", 100, false, &picked),
+		recordingProxy("fine", 1, false, &picked),
+	}
+	// register the proxies so ProxyHealth() reports them
+	DialerWithProxies(nil, proxies...)
+	QuarantineProxy("corrupting", 100*time.Millisecond)
+	assert.False(t, ProxyHealth()["corrupting"], "should report quarantined proxy as unhealthy")
+	assert.True(t, ProxyHealth()["fine"])
+	for i := 0; i < 10; i++ {
+		conn, err := proxiesDialer(proxies)(context.Background(), "tcp", "example.com:443")
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+	}
+	assert.NotContains(t, picked, "corrupting", "should skip quarantined proxy")
+
+	time.Sleep(150 * time.Millisecond)
+	assert.True(t, ProxyHealth()["corrupting"], "should be healthy once quarantine ends")
+	picked = nil
+	for i := 0; i < 10; i++ {
+		conn, err := proxiesDialer(proxies)(context.Background(), "tcp", "example.com:443")
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+	}
+	assert.Contains(t, picked, "corrupting", "should include proxy again once quarantine ends")
+}
+
+func TestDisableProxy(t *testing.T) {
+	defer resetProxies()
+	var picked []string
+	proxies := []WeightedProxy{
+		recordingProxy("maintained", 100, false, &picked),
+		recordingProxy("unhealthy", 1, false, &picked),
+	}
+	DisableProxy("maintained")
+	muProxies.Lock()
+	unhealthyProxies["unhealthy"] = true
+	muProxies.Unlock()
+	for i := 0; i < 10; i++ {
+		conn, err := proxiesDialer(proxies)(context.Background(), "tcp", "example.com:443")
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+	}
+	assert.NotContains(t, picked, "maintained", "should skip disabled proxy even if the others are unhealthy")
+
+	DisableProxy("unhealthy")
+	_, err := proxiesDialer(proxies)(context.Background(), "tcp", "example.com:443")
+	assert.Error(t, err, "should fail if all proxies are disabled")
+
+	EnableProxy("maintained")
+	EnableProxy("unhealthy")
+	picked = nil
+	for i := 0; i < 10; i++ {
+		conn, err := proxiesDialer(proxies)(context.Background(), "tcp", "example.com:443")
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+	}
+	assert.Contains(t, picked, "maintained", "should include proxy again once enabled")
+	assert.NotContains(t, picked, "unhealthy", "should still skip unhealthy proxy")
+}
+
+func TestStickyProxies(t *testing.T) {
+	defer resetProxies()
+	SetStickyProxies(time.Minute)
+	defer SetStickyProxies(0)
+	var picked []string
+	proxies := []WeightedProxy{
+		recordingProxy("a", 1, false, &picked),
+		recordingProxy("b", 1, false, &picked),
+		recordingProxy("c", 1, false, &picked),
+	}
+	dial := proxiesDialer(proxies)
+	for i := 0; i < 20; i++ {
+		conn, err := dial(context.Background(), "tcp", "example.com:443")
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+	}
+	for _, id := range picked {
+		assert.Equal(t, picked[0], id, "should detour the host through the same proxy")
+	}
+
+	DisableProxy(picked[0])
+	sticky := picked[0]
+	picked = nil
+	conn, err := dial(context.Background(), "tcp", "example.com:80")
+	if assert.NoError(t, err, "should fail over if the proxy is unusable") {
+		conn.Close()
+	}
+	assert.NotEqual(t, sticky, picked[0])
+	EnableProxy(sticky)
+	failover := picked[0]
+	picked = nil
+	for i := 0; i < 5; i++ {
+		conn, err := dial(context.Background(), "tcp", "example.com:443")
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+	}
+	assert.Equal(t, []string{failover, failover, failover, failover, failover}, picked, "should stick to the proxy failed over to")
+}
+
+func TestAttemptLog(t *testing.T) {
+	defer resetProxies()
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	SetDebugTimeline(true)
+	defer SetDebugTimeline(false)
+	detourAddr := newBannerServer("hello detour", 0)
+	failingDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+	}
+	// whichever proxy is tried first fails
+	var dials int32
+	proxyDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if atomic.AddInt32(&dials, 1) == 1 {
+			return nil, errors.New("proxy down")
+		}
+		return net.Dial(network, detourAddr)
+	}
+	dialer := DialerWithProxies(failingDial,
+		WeightedProxy{ID: "proxy1", Dial: proxyDial},
+		WeightedProxy{ID: "proxy2", Dial: proxyDial})
+
+	conn, err := dialer(context.Background(), "tcp", "127.0.0.1:1")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	attempts := conn.(*Conn).AttemptLog()
+	if assert.Len(t, attempts, 3, "should record direct and two detour attempts") {
+		assert.Equal(t, "direct", attempts[0].Route)
+		assert.EqualError(t, attempts[0].Err, "dial failure")
+		assert.True(t, strings.HasPrefix(attempts[1].Route, "proxy "))
+		assert.EqualError(t, attempts[1].Err, "proxy down")
+		assert.True(t, strings.HasPrefix(attempts[2].Route, "proxy "))
+		assert.NotEqual(t, attempts[1].Route, attempts[2].Route)
+		assert.NoError(t, attempts[2].Err)
+	}
+
+	SetDebugTimeline(false)
+	RemoveFromWl("127.0.0.1")
+	conn, err = dialer(context.Background(), "tcp", "127.0.0.1:1")
+	if assert.NoError(t, err) {
+		assert.Nil(t, conn.(*Conn).AttemptLog(), "should not record unless debugging")
+		conn.Close()
+	}
+}
+
+func TestProxyStats(t *testing.T) {
+	defer resetProxies()
+	s := SaveState()
+	defer RestoreState(s)
+	var picked []string
+	flaky := recordingProxy("flaky", 1, false, &picked)
+	dialFlaky := flaky.Dial
+	flaky.Dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if addr == "blocked.example.com:443" {
+			return nil, errors.New("proxy flaky failed")
+		}
+		return dialFlaky(ctx, network, addr)
+	}
+	proxies := []WeightedProxy{flaky, recordingProxy("down", 1, true, &picked)}
+	dial := proxiesDialer(proxies)
+
+	DisableProxy("down")
+	for _, addr := range []string{"example.com:443", "example.com:443", "blocked.example.com:443"} {
+		if conn, err := dial(context.Background(), "tcp", addr); err == nil {
+			conn.Close()
+		}
+	}
+	EnableProxy("down")
+	DisableProxy("flaky")
+	for i := 0; i < 2; i++ {
+		_, err := dial(context.Background(), "tcp", "example.com:443")
+		assert.Error(t, err)
+	}
+	EnableProxy("flaky")
+	stats := ProxyStats()
+	assert.Equal(t, ProxyStat{Successes: 2, Failures: 1}, stats["flaky"])
+	assert.Equal(t, ProxyStat{Successes: 0, Failures: 2}, stats["down"])
+	assert.True(t, stats["flaky"].SuccessRate() > stats["down"].SuccessRate())
+
+	weighted := weightedBySuccess(proxies)
+	assert.Equal(t, 60, weighted[0].Weight, "should scale weight by success rate")
+	assert.Equal(t, 25, weighted[1].Weight, "should scale weight by success rate")
+
+	SetWeightProxiesBySuccess(true)
+	first := 0
+	for i := 0; i < 1000; i++ {
+		picked = nil
+		conn, err := dial(context.Background(), "tcp", "example.com:443")
+		if assert.NoError(t, err) {
+			conn.Close()
+		}
+		if picked[0] == "flaky" {
+			first++
+		}
+	}
+	assert.True(t, first > 600, "should pick the more successful proxy first more often")
+}
@@ -3,6 +3,7 @@
 package main
 
 import (
+	"context"
 	"log"
 
 	"net"
@@ -25,7 +26,12 @@ func main() {
 		Transport: &http.Transport{
 			// This just detours to net.Dial, meaning that it doesn't accomplish any
 			// unblocking, it's just here for performance testing.
-			Dial: detour.Dialer(net.Dial),
+			DialContext: detour.Dialer(dial, dial),
 		},
 	})
 }
+
+func dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	var d net.Dialer
+	return d.DialContext(ctx, network, addr)
+}
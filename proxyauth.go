@@ -0,0 +1,53 @@
+package detour
+
+import (
+	"sync/atomic"
+)
+
+var (
+	// 1 if the detour proxy required authentication, accessed atomically only
+	_proxyAuthRequired int32
+	// instance of func()
+	proxyAuthRequiredCallback atomic.Value
+)
+
+// OnProxyAuthRequired sets a callback invoked the first time detouring fails
+// with ErrProxyAuthRequired, e.g. to alert the user about misconfigured
+// credentials. It's invoked again only after ResetProxyAuth().
+func OnProxyAuthRequired(cb func()) {
+	proxyAuthRequiredCallback.Store(cb)
+}
+
+// SetFallbackDirectOnProxyAuth controls whether to stop detouring once the
+// detour proxy required authentication, as detouring every blocked site is
+// pointless then. Connections are dialed directly instead, and those which
+// would detour fail with ErrProxyAuthRequired, until ResetProxyAuth() is
+// called.
+func SetFallbackDirectOnProxyAuth(enabled bool) {
+	UpdateConfig(func(c Config) Config {
+		c.FallbackDirectOnProxyAuth = enabled
+		return c
+	})
+}
+
+// ResetProxyAuth forgets that the detour proxy required authentication, e.g.
+// after the credentials are fixed.
+func ResetProxyAuth() {
+	atomic.StoreInt32(&_proxyAuthRequired, 0)
+}
+
+func proxyAuthRequired() bool {
+	return atomic.LoadInt32(&_proxyAuthRequired) == 1
+}
+
+// proxyAuthRejected records that the detour proxy required authentication,
+// invoking the callback set by OnProxyAuthRequired() the first time.
+func proxyAuthRejected() {
+	if !atomic.CompareAndSwapInt32(&_proxyAuthRequired, 0, 1) {
+		return
+	}
+	log.Error("Detour proxy requires authentication, check the credentials")
+	if cb, _ := proxyAuthRequiredCallback.Load().(func()); cb != nil {
+		go cb()
+	}
+}
@@ -0,0 +1,83 @@
+package detour
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyAuthRequired(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	defer ResetProxyAuth()
+	setFirstReadTimeout(50 * time.Millisecond)
+	alerted := make(chan bool, 2)
+	OnProxyAuthRequired(func() { alerted <- true })
+	defer OnProxyAuthRequired(nil)
+	var detourDials int32
+	detour := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&detourDials, 1)
+		return nil, fmt.Errorf("Proxy responded with 407: %w", ErrProxyAuthRequired)
+	}
+	blockedAddr := newBannerServer("", 0)
+	dialer := Dialer(dialTo(blockedAddr), detour)
+
+	for i := 0; i < 2; i++ {
+		conn, err := dialer(context.Background(), "tcp", blockedAddr)
+		if assert.NoError(t, err) {
+			_, err = conn.Read(make([]byte, 1024))
+			assert.True(t, errors.Is(err, ErrProxyAuthRequired), "should surface auth required, got %v", err)
+			conn.Close()
+		}
+	}
+	assert.EqualValues(t, 2, atomic.LoadInt32(&detourDials), "should keep detouring unless falling back")
+	select {
+	case <-alerted:
+	case <-time.After(time.Second):
+		assert.Fail(t, "should alert")
+	}
+	select {
+	case <-alerted:
+		assert.Fail(t, "should alert only once")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	SetFallbackDirectOnProxyAuth(true)
+	defer SetFallbackDirectOnProxyAuth(false)
+	conn, err := dialer(context.Background(), "tcp", blockedAddr)
+	if assert.NoError(t, err) {
+		_, err = conn.Read(make([]byte, 1024))
+		assert.True(t, errors.Is(err, ErrProxyAuthRequired), "should surface auth required, got %v", err)
+		conn.Close()
+	}
+	assert.EqualValues(t, 2, atomic.LoadInt32(&detourDials), "should not detour once falling back")
+	directAddr := newBannerServer("hello direct", 0)
+	assert.Equal(t, "hello direct", readOnce(t, Dialer(dialTo(directAddr), detour), directAddr), "should still connect directly")
+
+	ResetProxyAuth()
+	conn, err = dialer(context.Background(), "tcp", blockedAddr)
+	if assert.NoError(t, err) {
+		conn.Read(make([]byte, 1024))
+		conn.Close()
+	}
+	assert.EqualValues(t, 3, atomic.LoadInt32(&detourDials), "should detour again after reset")
+}
+
+func TestConnectProxyAuthRequired(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusProxyAuthRequired)
+	}))
+	defer s.Close()
+	u, _ := url.Parse(s.URL)
+	_, err := httpConnectDialer(u)(context.Background(), "tcp", "example.com:443")
+	assert.True(t, errors.Is(err, ErrProxyAuthRequired), "should map 407 to ErrProxyAuthRequired, got %v", err)
+}
@@ -0,0 +1,82 @@
+package detour
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// SetHealthCheckAddr sets the address of the HTTP server to check the health
+// of proxies against, see StartProxyHealthChecks().
+func SetHealthCheckAddr(addr string) {
+	UpdateConfig(func(c Config) Config {
+		c.HealthCheckAddr = addr
+		return c
+	})
+}
+
+// StartProxyHealthChecks checks all proxies passed to DialerWithProxies()
+// right away and then every interval with CheckDialer(), until ctx is done.
+// Proxies failing the check are skipped when detouring until they pass again.
+func StartProxyHealthChecks(ctx context.Context, interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			checkProxies(ctx, interval)
+			select {
+			case <-ctx.Done():
+				log.Debugf("Stopped proxy health checks: %v", ctx.Err())
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func checkProxies(ctx context.Context, timeout time.Duration) {
+	muProxies.RLock()
+	proxies := make([]WeightedProxy, 0, len(registeredProxies))
+	for _, p := range registeredProxies {
+		proxies = append(proxies, p)
+	}
+	muProxies.RUnlock()
+	addr := currentConfig().HealthCheckAddr
+	var wg sync.WaitGroup
+	for _, p := range proxies {
+		wg.Add(1)
+		go func(p WeightedProxy) {
+			defer wg.Done()
+			checkCtx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+			err := CheckDialer(checkCtx, p.Dial, addr)
+			if ctx.Err() != nil {
+				// stopped checking, not the proxy's fault
+				return
+			}
+			if err != nil {
+				log.Debugf("Proxy %s is unhealthy: %s", p.ID, err)
+			}
+			muProxies.Lock()
+			if _, ok := registeredProxies[p.ID]; ok {
+				unhealthyProxies[p.ID] = err != nil
+			}
+			muProxies.Unlock()
+		}(p)
+	}
+	wg.Wait()
+}
+
+// ProxyHealth returns whether each proxy passed to DialerWithProxies() passed
+// the last health check and is not quarantined, by ID. Proxies not checked yet
+// are healthy.
+func ProxyHealth() map[string]bool {
+	muProxies.RLock()
+	defer muProxies.RUnlock()
+	now := time.Now()
+	health := make(map[string]bool, len(registeredProxies))
+	for id := range registeredProxies {
+		health[id] = !unhealthyProxies[id] && !quarantined(id, now)
+	}
+	return health
+}
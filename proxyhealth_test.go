@@ -0,0 +1,99 @@
+package detour
+
+import (
+	"context"
+	"net"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyHealthChecks(t *testing.T) {
+	defer stopMockServers()
+	defer resetProxies()
+	mockURL, _ := newMockServer(directMsg)
+	u, _ := url.Parse(mockURL)
+	SetHealthCheckAddr(u.Host)
+	defer SetHealthCheckAddr("www.google.com:80")
+	var upChecks int32
+	up := WeightedProxy{ID: "up", Weight: 1, Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&upChecks, 1)
+		return net.Dial(network, addr)
+	}}
+	down := WeightedProxy{ID: "down", Weight: 100, Dial: dialTo("127.0.0.1:1")}
+	DialerWithProxies(dialTo("127.0.0.1:1"), up, down)
+	assert.Equal(t, map[string]bool{"up": true, "down": true}, ProxyHealth(), "should be healthy before checked")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	StartProxyHealthChecks(ctx, 20*time.Millisecond)
+	assert.Eventually(t, func() bool { return !ProxyHealth()["down"] }, time.Second, 10*time.Millisecond, "should mark the down proxy unhealthy")
+	assert.True(t, ProxyHealth()["up"])
+	usable := usableProxies([]WeightedProxy{up, down})
+	if assert.Len(t, usable, 1, "should exclude unhealthy proxy from selection") {
+		assert.Equal(t, "up", usable[0].ID)
+	}
+
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	checks := atomic.LoadInt32(&upChecks)
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, checks, atomic.LoadInt32(&upChecks), "should stop checking once context is done")
+}
+
+func TestProxyHealthCheckCancelled(t *testing.T) {
+	defer resetProxies()
+	started := make(chan struct{})
+	hanging := WeightedProxy{ID: "hanging", Weight: 1, Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+		close(started)
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}}
+	DialerWithProxies(dialTo("127.0.0.1:1"), hanging)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		checkProxies(ctx, time.Minute)
+		close(done)
+	}()
+	<-started
+	cancel()
+	<-done
+	assert.True(t, ProxyHealth()["hanging"], "should not mark unhealthy if the checks are stopped")
+}
+
+func TestUnregisterProxy(t *testing.T) {
+	defer resetProxies()
+	p := WeightedProxy{ID: "old", Weight: 1, Dial: dialTo("127.0.0.1:1")}
+	DialerWithProxies(dialTo("127.0.0.1:1"), p)
+	QuarantineProxy("old", time.Minute)
+	DisableProxy("old")
+	recordProxyOutcome("old", nil)
+	muProxies.Lock()
+	unhealthyProxies["old"] = true
+	proxyAffinity["example.com"] = affinity{"old", time.Now().Add(time.Minute)}
+	muProxies.Unlock()
+
+	UnregisterProxy("old")
+	assert.Empty(t, ProxyHealth())
+	assert.Empty(t, ProxyStats())
+	muProxies.RLock()
+	defer muProxies.RUnlock()
+	assert.Empty(t, unhealthyProxies)
+	assert.Empty(t, quarantinedProxies)
+	assert.Empty(t, disabledProxies)
+	assert.Empty(t, proxyAffinity)
+}
+
+func resetProxies() {
+	muProxies.Lock()
+	registeredProxies = make(map[string]WeightedProxy)
+	unhealthyProxies = make(map[string]bool)
+	quarantinedProxies = make(map[string]time.Time)
+	disabledProxies = make(map[string]bool)
+	proxyAffinity = make(map[string]affinity)
+	proxyStats = make(map[string]ProxyStat)
+	muProxies.Unlock()
+}
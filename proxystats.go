@@ -0,0 +1,67 @@
+package detour
+
+// ProxyStat is the outcome of dialing through a proxy passed to
+// DialerWithProxies() when detouring.
+type ProxyStat struct {
+	Successes int64
+	Failures  int64
+}
+
+// SuccessRate is the ratio of successful dials, smoothed so that a proxy never
+// dialed is at 0.5 and a single outcome doesn't make it 0 or 1.
+func (s ProxyStat) SuccessRate() float64 {
+	return float64(s.Successes+1) / float64(s.Successes+s.Failures+2)
+}
+
+// the outcome of detour dials by proxy ID, guarded by muProxies
+var proxyStats = make(map[string]ProxyStat)
+
+// ProxyStats returns the outcome of detour dials through each proxy passed to
+// DialerWithProxies(), by ID. Health checks are not counted.
+func ProxyStats() map[string]ProxyStat {
+	muProxies.RLock()
+	defer muProxies.RUnlock()
+	stats := make(map[string]ProxyStat, len(registeredProxies))
+	for id := range registeredProxies {
+		stats[id] = ProxyStat{}
+	}
+	for id, s := range proxyStats {
+		stats[id] = s
+	}
+	return stats
+}
+
+// SetWeightProxiesBySuccess makes proxies with higher success rates, see
+// ProxyStats(), more likely to be picked first when detouring, in addition to
+// their configured weights.
+func SetWeightProxiesBySuccess(enabled bool) {
+	UpdateConfig(func(c Config) Config {
+		c.WeightProxiesBySuccess = enabled
+		return c
+	})
+}
+
+func recordProxyOutcome(id string, err error) {
+	muProxies.Lock()
+	defer muProxies.Unlock()
+	s := proxyStats[id]
+	if err == nil {
+		s.Successes++
+	} else {
+		s.Failures++
+	}
+	proxyStats[id] = s
+}
+
+// weightedBySuccess returns copies of the proxies with their weights scaled by
+// their success rates.
+func weightedBySuccess(proxies []WeightedProxy) []WeightedProxy {
+	muProxies.RLock()
+	defer muProxies.RUnlock()
+	weighted := make([]WeightedProxy, 0, len(proxies))
+	for _, p := range proxies {
+		p.Weight = int(float64(weightOf(p)*100) * proxyStats[p.ID].SuccessRate())
+		weighted = append(weighted, p)
+	}
+	return weighted
+}
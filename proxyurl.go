@@ -0,0 +1,276 @@
+package detour
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// DialerWithProxyURL is like Dialer() but builds the detour dialer from the
+// URL of a proxy. Supported schemes are socks5, http and https, the latter two
+// via the CONNECT method. The username and password in the URL, if any, are
+// used to authenticate with the proxy.
+func DialerWithProxyURL(directDialer dialFunc, proxyURL string) (dialFunc, error) {
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse proxy URL: %s", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("No host in proxy URL %s", proxyURL)
+	}
+	var detourDialer dialFunc
+	switch u.Scheme {
+	case "socks5":
+		var auth *SOCKS5Auth
+		if u.User != nil {
+			password, _ := u.User.Password()
+			auth = &SOCKS5Auth{Username: u.User.Username(), Password: password}
+		}
+		detourDialer = SOCKS5Dialer(withDefaultPort(u.Host, "1080"), auth)
+	case "http", "https":
+		detourDialer = httpConnectDialer(u)
+	default:
+		return nil, fmt.Errorf("Unsupported proxy scheme %s", u.Scheme)
+	}
+	return Dialer(directDialer, detourDialer), nil
+}
+
+func withDefaultPort(host string, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// SOCKS5Auth is the username and password to authenticate with a SOCKS5 proxy,
+// see https://www.ietf.org/rfc/rfc1929.txt.
+type SOCKS5Auth struct {
+	Username string
+	Password string
+}
+
+// SOCKS5Dialer returns a function which dials addr through the SOCKS5 proxy at
+// proxyAddr, see https://www.ietf.org/rfc/rfc1928.txt, to be passed as the
+// detour dialer to Dialer(). auth may be nil if the proxy requires no
+// authentication. Only TCP is supported. If the proxy rejects the credentials,
+// the error wraps ErrProxyAuthRequired.
+func SOCKS5Dialer(proxyAddr string, auth *SOCKS5Auth) dialFunc {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		if network != "tcp" && network != "tcp4" && network != "tcp6" {
+			return nil, fmt.Errorf("Unsupported network %s through SOCKS5 proxy", network)
+		}
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", proxyAddr)
+		if err != nil {
+			return nil, err
+		}
+		if err := withDeadline(ctx, conn, func() error { return socks5Connect(conn, addr, auth) }); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		return conn, nil
+	}
+}
+
+func socks5Connect(conn net.Conn, addr string, auth *SOCKS5Auth) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("Invalid port in %s: %s", addr, err)
+	}
+	if len(host) > 255 {
+		return fmt.Errorf("Host name too long: %s", host)
+	}
+	// version 5, one method: no authentication required
+	greeting := []byte{5, 1, 0}
+	if auth != nil {
+		if len(auth.Username) > 255 || len(auth.Password) > 255 {
+			return fmt.Errorf("SOCKS5 username or password too long")
+		}
+		// version 5, two methods: no authentication required, username/password
+		greeting = []byte{5, 2, 0, 2}
+	}
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	switch {
+	case reply[0] != 5:
+		return fmt.Errorf("Unexpected SOCKS5 version %d from proxy", reply[0])
+	case reply[1] == 0:
+	case reply[1] == 2 && auth != nil:
+		if err := socks5Authenticate(conn, auth); err != nil {
+			return err
+		}
+	case reply[1] == 2:
+		return fmt.Errorf("SOCKS5 proxy requires username/password without being offered: %w", ErrProxyAuthRequired)
+	case reply[1] == 0xff:
+		return fmt.Errorf("SOCKS5 proxy accepts none of the offered methods: %w", ErrProxyAuthRequired)
+	default:
+		return fmt.Errorf("Unexpected SOCKS5 method %d from proxy", reply[1])
+	}
+	// version 5, CONNECT, reserved
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip.To4() != nil {
+		req = append(append(req, 1), ip.To4()...)
+	} else if ip != nil {
+		req = append(append(req, 4), ip.To16()...)
+	} else {
+		req = append(append(req, 3, byte(len(host))), host...)
+	}
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[1] != 0 {
+		return fmt.Errorf("SOCKS5 proxy failed to connect to %s: %d", addr, head[1])
+	}
+	// skip the bound address and port
+	var addrLen int
+	switch head[3] {
+	case 1:
+		addrLen = net.IPv4len
+	case 4:
+		addrLen = net.IPv6len
+	case 3:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return err
+		}
+		addrLen = int(l[0])
+	default:
+		return fmt.Errorf("Unexpected SOCKS5 address type %d from proxy", head[3])
+	}
+	_, err = io.ReadFull(conn, make([]byte, addrLen+2))
+	return err
+}
+
+// socks5Authenticate authenticates with username and password, see
+// https://www.ietf.org/rfc/rfc1929.txt.
+func socks5Authenticate(conn net.Conn, auth *SOCKS5Auth) error {
+	// version 1 of the subnegotiation
+	req := append([]byte{1, byte(len(auth.Username))}, auth.Username...)
+	req = append(append(req, byte(len(auth.Password))), auth.Password...)
+	if _, err := conn.Write(req); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != 1 {
+		return fmt.Errorf("Unexpected SOCKS5 authentication version %d from proxy", reply[0])
+	}
+	if reply[1] != 0 {
+		return fmt.Errorf("SOCKS5 proxy rejected the credentials: %w", ErrProxyAuthRequired)
+	}
+	return nil
+}
+
+// httpConnectDialer dials addr through the HTTP(S) proxy at u using CONNECT.
+func httpConnectDialer(u *url.URL) dialFunc {
+	proxyAddr := withDefaultPort(u.Host, "80")
+	if u.Scheme == "https" {
+		proxyAddr = withDefaultPort(u.Host, "443")
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", proxyAddr)
+		if err != nil {
+			return nil, err
+		}
+		if u.Scheme == "https" {
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			conn = tlsConn
+		}
+		var br *bufio.Reader
+		if err := withDeadline(ctx, conn, func() (err error) {
+			br, err = httpConnect(conn, u, addr)
+			return
+		}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if br.Buffered() > 0 {
+			return &bufferedConn{conn, br}, nil
+		}
+		return conn, nil
+	}
+}
+
+func httpConnect(conn net.Conn, u *url.URL, addr string) (*bufio.Reader, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		password, _ := u.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(u.User.Username() + ":" + password))
+		req.Header.Set("Proxy-Authorization", "Basic "+auth)
+	}
+	if err := req.Write(conn); err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, err
+	}
+	// don't touch the body, there's nothing but the tunnel after the header
+	if resp.StatusCode == http.StatusProxyAuthRequired {
+		return nil, fmt.Errorf("Proxy responded to CONNECT %s with %s: %w", addr, resp.Status, ErrProxyAuthRequired)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Proxy responded to CONNECT %s with %s", addr, resp.Status)
+	}
+	return br, nil
+}
+
+// withDeadline runs fn with the deadline of ctx, if any, applied to conn.
+func withDeadline(ctx context.Context, conn net.Conn, fn func() error) error {
+	if deadline, ok := ctx.Deadline(); ok {
+		if err := conn.SetDeadline(deadline); err != nil {
+			return err
+		}
+		defer func() {
+			if err := conn.SetDeadline(zeroTime); err != nil {
+				log.Debugf("Unable to clear deadline: %v", err)
+			}
+		}()
+	}
+	return fn()
+}
+
+// bufferedConn reads what's left in the bufio.Reader before the conn itself
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
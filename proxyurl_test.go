@@ -0,0 +1,110 @@
+package detour
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDialerWithProxyURL(t *testing.T) {
+	defer RemoveFromWl("localhost")
+	defer stopMockServers()
+	defer ResetProxyAuth()
+	_, port, _ := net.SplitHostPort(newBannerServer("hello detour", 0))
+	// use domain name so the SOCKS5 mock can parse it
+	target := net.JoinHostPort("localhost", port)
+	failingDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+	}
+
+	for _, proxyURL := range []string{"socks5://" + newSOCKS5Server(), newConnectProxy()} {
+		dialer, err := DialerWithProxyURL(failingDial, proxyURL)
+		if assert.NoError(t, err) {
+			assert.Equal(t, "hello detour", readOnce(t, dialer, target), "should detour via %s", proxyURL)
+		}
+		RemoveFromWl("localhost")
+	}
+
+	_, err := DialerWithProxyURL(failingDial, "ftp://localhost:21")
+	assert.Error(t, err, "should reject unsupported scheme")
+
+	proxyAddr := newSOCKS5ServerWithAuth(&SOCKS5Auth{"user", "pass"})
+	dialer, err := DialerWithProxyURL(failingDial, "socks5://user:pass@"+proxyAddr)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "hello detour", readOnce(t, dialer, target), "should authenticate with SOCKS5 proxy")
+	}
+	RemoveFromWl("localhost")
+	dialer, err = DialerWithProxyURL(failingDial, "socks5://user:wrong@"+proxyAddr)
+	if assert.NoError(t, err) {
+		conn, err := dialer(context.Background(), "tcp", target)
+		if err == nil {
+			_, err = conn.Read(make([]byte, 1024))
+			conn.Close()
+		}
+		assert.True(t, errors.Is(err, ErrProxyAuthRequired), "should fail with ErrProxyAuthRequired on wrong credentials: %v", err)
+	}
+}
+
+func TestSOCKS5Dialer(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	auth := &SOCKS5Auth{"user", "pass"}
+	proxyAddr := newSOCKS5ServerWithAuth(auth)
+	bannerAddr := newBannerServer("hello detour", 0)
+	_, port, _ := net.SplitHostPort(bannerAddr)
+	targets := []string{bannerAddr, net.JoinHostPort("localhost", port)}
+	if l, err := net.Listen("tcp", "[::1]:0"); err == nil {
+		listeners = append(listeners, l)
+		go func() {
+			for {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				conn.Write([]byte("hello detour"))
+			}
+		}()
+		targets = append(targets, l.Addr().String())
+	} else {
+		t.Logf("IPv6 loopback unavailable, skip IPv6 target: %v", err)
+	}
+
+	for _, target := range targets {
+		conn, err := SOCKS5Dialer(proxyAddr, auth)(context.Background(), "tcp", target)
+		if assert.NoError(t, err, "should dial %s", target) {
+			b := make([]byte, 1024)
+			n, err := conn.Read(b)
+			assert.NoError(t, err)
+			assert.Equal(t, "hello detour", string(b[:n]), "should dial %s", target)
+			conn.Close()
+		}
+	}
+
+	failingDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+	}
+	assert.Equal(t, "hello detour", readOnce(t, Dialer(failingDial, SOCKS5Dialer(proxyAddr, auth)), bannerAddr), "should detour through SOCKS5 proxy")
+
+	_, err := SOCKS5Dialer(proxyAddr, &SOCKS5Auth{"user", "wrong"})(context.Background(), "tcp", bannerAddr)
+	assert.True(t, errors.Is(err, ErrProxyAuthRequired), "should fail with ErrProxyAuthRequired on wrong credentials: %v", err)
+	_, err = SOCKS5Dialer(proxyAddr, nil)(context.Background(), "tcp", bannerAddr)
+	assert.True(t, errors.Is(err, ErrProxyAuthRequired), "should fail with ErrProxyAuthRequired without credentials: %v", err)
+}
+
+func TestSOCKS5AuthNotOffered(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go func() {
+		defer server.Close()
+		// picks username/password though only no authentication is offered
+		if _, err := io.ReadFull(server, make([]byte, 3)); err == nil {
+			server.Write([]byte{5, 2})
+		}
+	}()
+	err := socks5Connect(client, "example.com:80", nil)
+	assert.True(t, errors.Is(err, ErrProxyAuthRequired), "should fail with ErrProxyAuthRequired: %v", err)
+}
@@ -0,0 +1,44 @@
+package detour
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	muRand sync.Mutex
+	// guarded by muRand as *rand.Rand is not safe for concurrent use
+	rnd = newDefaultRand()
+)
+
+func newDefaultRand() *rand.Rand {
+	return rand.New(rand.NewSource(time.Now().UnixNano()))
+}
+
+// SetRandSource sets the source of randomness for sampling, see
+// SetDetectionSampleRate() and SetVerifyContentSampleRate(), and for picking
+// weighted proxies, e.g. to make them deterministic in tests. src is only used
+// while holding a lock so it doesn't have to be safe for concurrent use. Pass
+// nil to restore the default, which is seeded with the current time.
+func SetRandSource(src rand.Source) {
+	muRand.Lock()
+	defer muRand.Unlock()
+	if src == nil {
+		rnd = newDefaultRand()
+		return
+	}
+	rnd = rand.New(src)
+}
+
+func randFloat64() float64 {
+	muRand.Lock()
+	defer muRand.Unlock()
+	return rnd.Float64()
+}
+
+func randIntn(n int) int {
+	muRand.Lock()
+	defer muRand.Unlock()
+	return rnd.Intn(n)
+}
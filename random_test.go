@@ -0,0 +1,38 @@
+package detour
+
+import (
+	"context"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetRandSource(t *testing.T) {
+	defer SetRandSource(nil)
+	defer stopMockServers()
+	SetDetectionSampleRate(0.5)
+	defer SetDetectionSampleRate(1)
+	setFirstReadTimeout(50 * time.Millisecond)
+	directAddr := newBannerServer("hello direct", 0)
+	dialer := Dialer(dialTo(directAddr), dialTo(directAddr))
+	sample := func() (sampled []bool) {
+		for i := 0; i < 20; i++ {
+			conn, err := dialer(context.Background(), "tcp", directAddr)
+			if !assert.NoError(t, err) {
+				return
+			}
+			sampled = append(sampled, conn.(*Conn).inState(stateInitial))
+			conn.Close()
+		}
+		return
+	}
+
+	SetRandSource(rand.NewSource(42))
+	first := sample()
+	assert.Contains(t, first, true)
+	assert.Contains(t, first, false)
+	SetRandSource(rand.NewSource(42))
+	assert.Equal(t, first, sample(), "should make the same sampling decisions with the same source")
+}
@@ -0,0 +1,62 @@
+package detour
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// a detoured connection counts as idle once nothing is written since the last
+// read for this long, see SetDetourAutoReconnect()
+var detourReconnectIdle = time.Second
+
+// SetDetourAutoReconnect controls whether a detoured connection which the
+// other end, e.g. a flaky proxy, disconnected while idle is redialed
+// transparently by the next Read(), which then reads from the new connection.
+// It's idle if nothing is written since the last read and the last read was
+// at least a second ago, otherwise, e.g. the server closing the connection
+// right after responding, the Read() returns the error as usual. Nothing
+// written before is resent, so it's only safe for stateless protocols where
+// each exchange stands on its own. Disabled by default.
+func SetDetourAutoReconnect(enabled bool) {
+	UpdateConfig(func(c Config) Config {
+		c.DetourAutoReconnect = enabled
+		return c
+	})
+}
+
+// idleDisconnected checks if a read failed with nothing read as the other end
+// closed the connection while idle, i.e. with no request in flight.
+func (dc *Conn) idleDisconnected(n int, err error) bool {
+	if n != 0 || (err != io.EOF && !errors.Is(err, syscall.ECONNRESET)) {
+		return false
+	}
+	lastRead := atomic.LoadInt64(&dc.lastReadNanos)
+	if atomic.LoadInt64(&dc.lastWriteNanos) > lastRead {
+		log.Tracef("Detoured connection to %s disconnected with a request in flight", dc.addr)
+		return false
+	}
+	return time.Since(time.Unix(0, lastRead)) >= detourReconnectIdle
+}
+
+// reconnectDetour redials the detour to replace the disconnected one, see
+// SetDetourAutoReconnect(). It returns whether it succeeded.
+func (dc *Conn) reconnectDetour() bool {
+	log.Debugf("Detoured connection to %s disconnected while idle, reconnecting", dc.addr)
+	dc.step("reconnect detour", nil)
+	conn, err := dc.dialDetourConn(context.Background())
+	if err != nil {
+		log.Debugf("Unable to reconnect detour to %s: %s", dc.addr, err)
+		return false
+	}
+	if !dc.inState(stateDetour) {
+		// closed meanwhile
+		conn.Close()
+		return false
+	}
+	dc.setConn(conn)
+	return true
+}
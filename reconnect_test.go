@@ -0,0 +1,119 @@
+package detour
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDetourAutoReconnect(t *testing.T) {
+	s := SaveState()
+	defer RestoreState(s)
+	defer stopMockServers()
+	defer func(d time.Duration) { detourReconnectIdle = d }(detourReconnectIdle)
+	detourReconnectIdle = 50 * time.Millisecond
+	directAddr := newBannerServer("", 0)
+	detourAddr := newBannerServer("hello detour", 0)
+	var dials int
+	dialDetour := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials++
+		return net.Dial(network, detourAddr)
+	}
+	dialer := Dialer(dialTo(directAddr), dialDetour)
+	addr := "reconnect.example.com:80"
+	ForceWhitelist(addr)
+
+	read := func(conn net.Conn) (string, error) {
+		b := make([]byte, 1024)
+		n, err := conn.Read(b)
+		return string(b[:n]), err
+	}
+	// reads EOF as if the proxy closed the idle connection
+	closeIdle := func(conn net.Conn) {
+		conn.(*Conn).getConn().(*net.TCPConn).CloseRead()
+	}
+
+	conn, err := dialer(context.Background(), "tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	msg, err := read(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello detour", msg)
+	closeIdle(conn)
+	_, err = read(conn)
+	assert.Equal(t, io.EOF, err, "should not reconnect if not enabled")
+	conn.Close()
+
+	SetDetourAutoReconnect(true)
+	dials = 0
+	conn, err = dialer(context.Background(), "tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	msg, err = read(conn)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello detour", msg)
+	closeIdle(conn)
+	time.Sleep(100 * time.Millisecond)
+	msg, err = read(conn)
+	assert.NoError(t, err, "should reconnect if disconnected while idle")
+	assert.Equal(t, "hello detour", msg, "should read from the new connection")
+	assert.Equal(t, 2, dials)
+}
+
+func TestDetourNoReconnectAfterResponse(t *testing.T) {
+	s := SaveState()
+	defer RestoreState(s)
+	defer stopMockServers()
+	SetDetourAutoReconnect(true)
+	// responds to the request and closes the connection right away
+	l, err := net.Listen("tcp", "localhost:0")
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				b := make([]byte, 1024)
+				if _, err := c.Read(b); err == nil {
+					c.Write([]byte("response"))
+				}
+			}()
+		}
+	}()
+	var dials int
+	dialDetour := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials++
+		return net.Dial(network, l.Addr().String())
+	}
+	dialer := Dialer(dialTo(newBannerServer("", 0)), dialDetour)
+	addr := "close-after-response.example.com:80"
+	ForceWhitelist(addr)
+
+	conn, err := dialer(context.Background(), "tcp", addr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte("request"))
+	assert.NoError(t, err)
+	b := make([]byte, 1024)
+	n, err := conn.Read(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "response", string(b[:n]))
+	_, err = conn.Read(b)
+	assert.Equal(t, io.EOF, err, "should not reconnect if closed right after responding")
+	assert.Equal(t, 1, dials)
+}
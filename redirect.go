@@ -0,0 +1,92 @@
+package detour
+
+import (
+	"bufio"
+	"bytes"
+	"net/http"
+	"net/url"
+)
+
+// SetDetectRedirectHijack enables treating the first response redirecting to
+// a different site as hijacked, e.g. a 302 from example.com to a censorship
+// portal. Redirects within the same registered domain, or to hosts allowed by
+// AllowRedirectTo(), are not. Only applies to ports detecting hijacked
+// responses, see SetSchemeConfig().
+func SetDetectRedirectHijack(enabled bool) {
+	UpdateConfig(func(c Config) Config {
+		c.DetectRedirectHijack = enabled
+		return c
+	})
+}
+
+// AllowRedirectTo allows redirects to hostSuffix and its subdomains, e.g. CDNs
+// sites legitimately redirect to, when SetDetectRedirectHijack() is enabled.
+func AllowRedirectTo(hostSuffix string) {
+	host := normalizeHost(hostSuffix)
+	UpdateConfig(func(c Config) Config {
+		hosts := make(map[string]bool, len(c.AllowedRedirectHosts)+1)
+		for k, v := range c.AllowedRedirectHosts {
+			hosts[k] = v
+		}
+		hosts[host] = true
+		c.AllowedRedirectHosts = hosts
+		return c
+	})
+}
+
+// redirectHijacked checks if b is a redirect to a host other than the one
+// requested which isn't allowed by AllowRedirectTo().
+func (dc *Conn) redirectHijacked(b []byte) bool {
+	location := redirectLocation(b)
+	if location == "" {
+		return false
+	}
+	u, err := url.Parse(location)
+	if err != nil || u.Host == "" {
+		// relative redirects stay on the same host
+		return false
+	}
+	to := hostOnly(u.Host)
+	from := hostOnly(dc.requestedHost())
+	if to == from || registeredDomain(to) == registeredDomain(from) {
+		return false
+	}
+	for host := to; host != ""; host = getParentDomain(host) {
+		if dc.cfg.AllowedRedirectHosts[host] {
+			return false
+		}
+	}
+	log.Debugf("%s redirected to %s", from, to)
+	return true
+}
+
+// requestedHost returns the target of the request buffered, if any, or the
+// address dialed.
+func (dc *Conn) requestedHost() string {
+	dc.muLocalBuffer.Lock()
+	defer dc.muLocalBuffer.Unlock()
+	if dc.localBuffer != nil {
+		if target := requestTarget(dc.localBuffer.Bytes()); target != "" {
+			return target
+		}
+	}
+	return dc.addr
+}
+
+// redirectLocation returns the Location of the HTTP redirect in b, or empty if
+// b isn't a complete enough HTTP redirect.
+func redirectLocation(b []byte) string {
+	if !bytes.HasPrefix(b, []byte("HTTP/")) {
+		return ""
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(b)), nil)
+	if err != nil {
+		return ""
+	}
+	switch resp.StatusCode {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return resp.Header.Get("Location")
+	}
+	return ""
+}
@@ -0,0 +1,52 @@
+package detour
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedirectHijack(t *testing.T) {
+	s := SaveState()
+	defer RestoreState(s)
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	SetDetectRedirectHijack(true)
+	portal := "HTTP/1.1 302 Found\r\nLocation: http://portal.censor.example/\r\nContent-Length: 0\r\n\r\n"
+	sameSite := "HTTP/1.1 301 Moved Permanently\r\nLocation: https://www.example.com/\r\nContent-Length: 0\r\n\r\n"
+	detourAddr := newBannerServer("hello detour", 0)
+
+	read := func(directAddr string) string {
+		_, port, _ := net.SplitHostPort(directAddr)
+		addr := net.JoinHostPort("example.com", port)
+		defer RemoveFromWl(addr)
+		dialer := Dialer(dialTo(directAddr), dialTo(detourAddr))
+		conn, err := dialer(context.Background(), "tcp", addr)
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n"))
+		if !assert.NoError(t, err) {
+			return ""
+		}
+		b := make([]byte, 1024)
+		n, err := conn.Read(b)
+		assert.NoError(t, err)
+		return string(b[:n])
+	}
+
+	before := Stats()
+	assert.Equal(t, "hello detour", read(newBannerServer(portal, 0)), "should detour if redirected to an unrelated host")
+	assert.Equal(t, int64(1), Stats().DetouredHijack-before.DetouredHijack)
+	assert.Equal(t, sameSite, read(newBannerServer(sameSite, 0)), "should not detour if redirected within the same site")
+
+	AllowRedirectTo("censor.example")
+	assert.Equal(t, portal, read(newBannerServer(portal, 0)), "should not detour if redirected to an allowed host")
+
+	SetDetectRedirectHijack(false)
+	assert.Equal(t, portal, read(newBannerServer(portal, 0)), "should not detour if disabled")
+}
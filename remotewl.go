@@ -0,0 +1,297 @@
+package detour
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// how long a miss in the whitelist store is remembered before looking it
+	// up again
+	storeMissTTL = 5 * time.Second
+	// expired misses are only swept once there are this many of them
+	maxStoreMisses = 1024
+	// the timeout of each request to the whitelist server, see
+	// RemoteWhitelistStore()
+	remoteWhitelistTimeout = time.Second
+)
+
+var (
+	muStoreMisses sync.Mutex
+	// hosts not in the whitelist store, or failed to look up, to when the
+	// miss expires
+	storeMisses = make(map[string]time.Time)
+)
+
+// WhitelistStore is a whitelist which can be shared, e.g. the one of a central
+// detour process queried by others in multi-process deployments, see
+// ServeWhitelist() and RemoteWhitelistStore().
+type WhitelistStore interface {
+	// Add adds addr to whitelist like AddToWl().
+	Add(addr string, permanent bool) error
+	// Remove removes addr from whitelist like RemoveFromWl().
+	Remove(addr string) error
+	// Status returns the status of addr in whitelist, including matching its
+	// parent domains.
+	Status(addr string) (WhitelistStatus, error)
+}
+
+// SetWhitelistStore shares the whitelist decisions of this process via store,
+// e.g. RemoteWhitelistStore() in multi-process deployments. Sites found
+// blocked or no longer blocked are added to or removed from store as well as
+// the local whitelist, and sites not in the local whitelist are looked up in
+// store before dialing. nil, the default, disables it.
+func SetWhitelistStore(store WhitelistStore) {
+	UpdateConfig(func(c Config) Config {
+		c.WhitelistStore = store
+		return c
+	})
+	resetStoreMisses()
+}
+
+// the status of hosts in the line protocol of ServeWhitelist()
+var wireStatuses = map[WhitelistStatus]string{
+	NotWhitelisted:         "none",
+	WhitelistedTemporarily: "temporary",
+	WhitelistedPermanently: "permanent",
+	ForceWhitelisted:       "force",
+}
+
+// ServeWhitelist serves the whitelist of this process over ln, e.g. a Unix
+// socket, to RemoteWhitelistStore() in other processes, until ln is closed.
+// Each request is a line, one of "ADD <host> permanent|temporary",
+// "REMOVE <host>" and "QUERY <host>", to which the response is a line of "OK",
+// followed by the status for QUERY, or "ERR <reason>". It returns the error
+// accepting from ln.
+func ServeWhitelist(ln net.Listener) error {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return err
+		}
+		go serveWhitelistConn(conn)
+	}
+}
+
+func serveWhitelistConn(conn net.Conn) {
+	defer conn.Close()
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		resp := handleWhitelistRequest(scanner.Text())
+		if _, err := fmt.Fprintln(conn, resp); err != nil {
+			log.Debugf("Unable to respond to whitelist request: %v", err)
+			return
+		}
+	}
+}
+
+func handleWhitelistRequest(line string) string {
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 3 && fields[0] == "ADD" && (fields[2] == "permanent" || fields[2] == "temporary"):
+		AddToWl(fields[1], fields[2] == "permanent")
+		return "OK"
+	case len(fields) == 2 && fields[0] == "REMOVE":
+		RemoveFromWl(fields[1])
+		return "OK"
+	case len(fields) == 2 && fields[0] == "QUERY":
+		return "OK " + wireStatuses[whitelistStatusOf(fields[1])]
+	}
+	return fmt.Sprintf("ERR invalid request %q", line)
+}
+
+// whitelistStatusOf returns the status of addr in whitelist, including
+// matching its parent domains.
+func whitelistStatusOf(addr string) WhitelistStatus {
+	ttl := currentConfig().TemporaryEntryTTL
+	muWhitelist.RLock()
+	defer muWhitelist.RUnlock()
+	key, via := lookupWlLocked("", addr, ttl)
+	switch via {
+	case "":
+		return NotWhitelisted
+	case LookupForce:
+		return ForceWhitelisted
+	}
+	if whitelist[key].permanent {
+		return WhitelistedPermanently
+	}
+	return WhitelistedTemporarily
+}
+
+// storeStatus looks up addr in the store set by SetWhitelistStore(), if any.
+// Misses are remembered for storeMissTTL so that hosts not in the store don't
+// cost a round trip on every dial.
+func storeStatus(cfg *Config, addr string) WhitelistStatus {
+	if cfg.WhitelistStore == nil {
+		return NotWhitelisted
+	}
+	host := hostOnly(addr)
+	now := time.Now()
+	muStoreMisses.Lock()
+	expires, missed := storeMisses[host]
+	muStoreMisses.Unlock()
+	if missed && now.Before(expires) {
+		return NotWhitelisted
+	}
+	status, err := cfg.WhitelistStore.Status(addr)
+	if err != nil {
+		log.Debugf("Unable to look up %s in whitelist store: %v", addr, err)
+		status = NotWhitelisted
+	}
+	muStoreMisses.Lock()
+	defer muStoreMisses.Unlock()
+	if status != NotWhitelisted {
+		delete(storeMisses, host)
+		return status
+	}
+	if len(storeMisses) >= maxStoreMisses {
+		for h, expires := range storeMisses {
+			if !now.Before(expires) {
+				delete(storeMisses, h)
+			}
+		}
+	}
+	storeMisses[host] = now.Add(storeMissTTL)
+	return NotWhitelisted
+}
+
+// resetStoreMisses forgets the misses remembered by storeStatus().
+func resetStoreMisses() {
+	muStoreMisses.Lock()
+	storeMisses = make(map[string]time.Time)
+	muStoreMisses.Unlock()
+}
+
+// storeAdd adds addr to the store set by SetWhitelistStore(), if any.
+func storeAdd(cfg *Config, addr string, permanent bool) {
+	if cfg.WhitelistStore == nil {
+		return
+	}
+	muStoreMisses.Lock()
+	delete(storeMisses, hostOnly(addr))
+	muStoreMisses.Unlock()
+	if err := cfg.WhitelistStore.Add(addr, permanent); err != nil {
+		log.Debugf("Unable to add %s to whitelist store: %v", addr, err)
+	}
+}
+
+// storeRemove removes addr from the store set by SetWhitelistStore(), if any.
+func storeRemove(cfg *Config, addr string) {
+	if cfg.WhitelistStore == nil {
+		return
+	}
+	if err := cfg.WhitelistStore.Remove(addr); err != nil {
+		log.Debugf("Unable to remove %s from whitelist store: %v", addr, err)
+	}
+}
+
+type remoteWhitelistStore struct {
+	dial func() (net.Conn, error)
+
+	// the connection kept open across requests, and the responses read from
+	// it, nil until the first request or after it fails
+	mu     sync.Mutex
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// RemoteWhitelistStore returns a WhitelistStore backed by the whitelist served
+// by ServeWhitelist() on the Unix socket at addr, e.g. by a central detour
+// process. Requests go through one connection kept open and redialed if it
+// fails.
+func RemoteWhitelistStore(addr string) WhitelistStore {
+	return &remoteWhitelistStore{dial: func() (net.Conn, error) {
+		return net.DialTimeout("unix", addr, remoteWhitelistTimeout)
+	}}
+}
+
+func (s *remoteWhitelistStore) Add(addr string, permanent bool) error {
+	kind := "temporary"
+	if permanent {
+		kind = "permanent"
+	}
+	_, err := s.request("ADD " + hostOnly(addr) + " " + kind)
+	return err
+}
+
+func (s *remoteWhitelistStore) Remove(addr string) error {
+	_, err := s.request("REMOVE " + hostOnly(addr))
+	return err
+}
+
+func (s *remoteWhitelistStore) Status(addr string) (WhitelistStatus, error) {
+	resp, err := s.request("QUERY " + hostOnly(addr))
+	if err != nil {
+		return NotWhitelisted, err
+	}
+	for status, wire := range wireStatuses {
+		if resp == wire {
+			return status, nil
+		}
+	}
+	return NotWhitelisted, fmt.Errorf("Unexpected whitelist status %q", resp)
+}
+
+// request sends the request line and returns what follows "OK" in the
+// response. A request failed on the connection kept open is retried once on a
+// new one, as the server may have closed it.
+func (s *remoteWhitelistStore) request(line string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reused := s.conn != nil
+	resp, err := s.roundTrip(line)
+	if err != nil && reused {
+		log.Debugf("Retrying whitelist request on a new connection: %v", err)
+		resp, err = s.roundTrip(line)
+	}
+	if err != nil {
+		return "", err
+	}
+	if resp == "OK" {
+		return "", nil
+	}
+	if strings.HasPrefix(resp, "OK ") {
+		return strings.TrimPrefix(resp, "OK "), nil
+	}
+	return "", fmt.Errorf("Whitelist request %q failed: %s", line, resp)
+}
+
+// roundTrip sends the request line over the connection kept open, dialing it
+// if not yet, and returns the response line. The connection is closed and
+// dropped on error. The caller should hold s.mu.
+func (s *remoteWhitelistStore) roundTrip(line string) (string, error) {
+	if s.conn == nil {
+		conn, err := s.dial()
+		if err != nil {
+			return "", fmt.Errorf("Unable to connect to whitelist server: %s", err)
+		}
+		s.conn, s.reader = conn, bufio.NewReader(conn)
+	}
+	resp, err := s.exchange(line)
+	if err != nil {
+		s.conn.Close()
+		s.conn, s.reader = nil, nil
+		return "", err
+	}
+	return resp, nil
+}
+
+// exchange writes the request line to s.conn and reads the response line.
+func (s *remoteWhitelistStore) exchange(line string) (string, error) {
+	if err := s.conn.SetDeadline(time.Now().Add(remoteWhitelistTimeout)); err != nil {
+		return "", err
+	}
+	if _, err := fmt.Fprintln(s.conn, line); err != nil {
+		return "", fmt.Errorf("Unable to send whitelist request: %s", err)
+	}
+	resp, err := s.reader.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("Unable to read whitelist response: %s", err)
+	}
+	return strings.TrimSuffix(resp, "\n"), nil
+}
@@ -0,0 +1,184 @@
+package detour
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// pipeListener accepts the in-memory connections made by its dial()
+type pipeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{conns: make(chan net.Conn), closed: make(chan struct{})}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: "pipe", Net: "unix"}
+}
+
+func (l *pipeListener) dial() (net.Conn, error) {
+	c1, c2 := net.Pipe()
+	select {
+	case l.conns <- c2:
+		return c1, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func TestRemoteWhitelistStore(t *testing.T) {
+	s := SaveState()
+	defer RestoreState(s)
+	ln := newPipeListener()
+	served := make(chan error, 1)
+	go func() { served <- ServeWhitelist(ln) }()
+	var dials int32
+	remote := &remoteWhitelistStore{dial: func() (net.Conn, error) {
+		atomic.AddInt32(&dials, 1)
+		return ln.dial()
+	}}
+	var store WhitelistStore = remote
+
+	assert.NoError(t, store.Add("remote.example.com:443", false))
+	assert.True(t, wlTemporarily("remote.example.com"), "should add to the served whitelist")
+	status, err := store.Status("www.remote.example.com")
+	if assert.NoError(t, err) {
+		assert.Equal(t, WhitelistedTemporarily, status, "should match parent domains")
+	}
+	assert.NoError(t, store.Add("remote.example.com", true))
+	status, err = store.Status("remote.example.com")
+	if assert.NoError(t, err) {
+		assert.Equal(t, WhitelistedPermanently, status)
+	}
+	ForceWhitelist("forced.example.com")
+	status, err = store.Status("forced.example.com")
+	if assert.NoError(t, err) {
+		assert.Equal(t, ForceWhitelisted, status)
+	}
+
+	assert.NoError(t, store.Remove("remote.example.com"))
+	assert.False(t, whitelisted("remote.example.com"), "should remove from the served whitelist")
+	status, err = store.Status("remote.example.com")
+	if assert.NoError(t, err) {
+		assert.Equal(t, NotWhitelisted, status)
+	}
+	_, err = (&remoteWhitelistStore{dial: ln.dial}).request("DROP remote.example.com")
+	assert.Error(t, err, "should fail on invalid requests")
+	assert.EqualValues(t, 1, atomic.LoadInt32(&dials), "should keep the connection open across requests")
+
+	remote.conn.Close()
+	_, err = store.Status("remote.example.com")
+	assert.NoError(t, err, "should redial if the connection is closed")
+	assert.EqualValues(t, 2, atomic.LoadInt32(&dials))
+
+	ln.Close()
+	assert.Error(t, <-served, "should stop serving once the listener is closed")
+	_, err = (&remoteWhitelistStore{dial: ln.dial}).Status("remote.example.com")
+	assert.Error(t, err)
+}
+
+// mapStore is an in-memory WhitelistStore
+type mapStore struct {
+	mu       sync.Mutex
+	statuses map[string]WhitelistStatus
+	queries  int
+}
+
+func (s *mapStore) Add(addr string, permanent bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.statuses[hostOnly(addr)] = WhitelistedTemporarily
+	if permanent {
+		s.statuses[hostOnly(addr)] = WhitelistedPermanently
+	}
+	return nil
+}
+
+func (s *mapStore) Remove(addr string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.statuses, hostOnly(addr))
+	return nil
+}
+
+func (s *mapStore) Status(addr string) (WhitelistStatus, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queries++
+	return s.statuses[hostOnly(addr)], nil
+}
+
+func TestSetWhitelistStore(t *testing.T) {
+	defer RestoreState(SaveState())
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	store := &mapStore{statuses: make(map[string]WhitelistStatus)}
+	SetWhitelistStore(store)
+	detourAddr := newBannerServer("hello detour", 0)
+	failingDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+	}
+
+	assert.Equal(t, "hello detour", readOnce(t, Dialer(failingDial, dialTo(detourAddr)), "127.0.0.1:1"))
+	status, _ := store.Status("127.0.0.1")
+	assert.NotEqual(t, NotWhitelisted, status, "should add to the store")
+
+	RemoveFromWl("127.0.0.1")
+	assert.True(t, whitelisted("127.0.0.1:1"), "should look up the store")
+	var directDials int32
+	directDial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		atomic.AddInt32(&directDials, 1)
+		return failingDial(ctx, network, addr)
+	}
+	assert.Equal(t, "hello detour", readOnce(t, Dialer(directDial, dialTo(detourAddr)), "127.0.0.1:1"))
+	assert.EqualValues(t, 0, atomic.LoadInt32(&directDials), "should detour sites whitelisted in the store")
+}
+
+func TestWhitelistStoreQueries(t *testing.T) {
+	defer RestoreState(SaveState())
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	store := &mapStore{statuses: make(map[string]WhitelistStatus)}
+	SetWhitelistStore(store)
+	directAddr := newBannerServer("hello direct", 0)
+	dialer := Dialer(dialTo(directAddr), dialTo(newBannerServer("hello detour", 0)))
+	queries := func() int {
+		store.mu.Lock()
+		defer store.mu.Unlock()
+		return store.queries
+	}
+
+	assert.Equal(t, "hello direct", readOnce(t, dialer, "direct.example.com:80"))
+	assert.Equal(t, 1, queries(), "should query the store once per dial")
+	assert.Equal(t, "hello direct", readOnce(t, dialer, "direct.example.com:80"))
+	assert.Equal(t, 1, queries(), "should remember misses for a while")
+
+	store.Add("detoured.example.com", false)
+	assert.Equal(t, "hello detour", readOnce(t, dialer, "detoured.example.com:80"))
+	assert.Equal(t, 2, queries())
+}
@@ -0,0 +1,79 @@
+package detour
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ReportKey is the context key to set to a *Report on the context passed to
+// the dialer returned by Dialer(), to have what happened to that connection
+// filled in, e.g. for one-off measurements without global callbacks.
+var ReportKey = &contextKey{"report"}
+
+// Report is what happened to a connection dialed with ReportKey. The route
+// and error of dialing are filled in by the time the dial returns, the outcome
+// of detection by the time the first read returns, and the bytes read and
+// latencies once the connection is closed. It should not be accessed while the
+// connection is being read or closed.
+type Report struct {
+	// Host is the host dialed, without port.
+	Host string
+	// Path is "direct" or "detour", or empty if not decided yet.
+	Path string
+	// Reason is why the path was chosen, e.g. "read timeout", or empty if it
+	// was not decided by detection, e.g. the host is whitelisted.
+	Reason string
+	// Signals are the signals of blocking observed, see SetScorer().
+	Signals []Signal
+	// DetectionTime is how long it took to decide the path since dialing.
+	DetectionTime time.Duration
+	// DirectLatency and DetourLatency are the same as Conn.Latencies().
+	DirectLatency time.Duration
+	DetourLatency time.Duration
+	// BytesRead is the number of bytes read from the connection.
+	BytesRead int64
+	// Err is the error dialing or the first read failed with, if any.
+	Err error
+}
+
+// reportDecision fills in the report, if any, with the path decided by
+// detection.
+func (dc *Conn) reportDecision(path, reason string) {
+	if dc.report == nil {
+		return
+	}
+	dc.report.Path = path
+	dc.report.Reason = reason
+	dc.report.Signals = append([]Signal(nil), dc.signals...)
+	dc.report.DetectionTime = time.Since(dc.detectStart)
+}
+
+// reportResult fills in the report, if any, with the outcome of dialing or
+// the first read.
+func (dc *Conn) reportResult(err error) {
+	if dc.report == nil {
+		return
+	}
+	if dc.report.Path == "" {
+		switch {
+		case dc.inState(stateDirect):
+			dc.report.Path = "direct"
+		case dc.inState(stateDetour):
+			dc.report.Path = "detour"
+		}
+	}
+	if len(dc.signals) > len(dc.report.Signals) {
+		dc.report.Signals = append([]Signal(nil), dc.signals...)
+	}
+	dc.report.Err = err
+	dc.report.DirectLatency, dc.report.DetourLatency = dc.Latencies()
+}
+
+// reportClose fills in the report, if any, with the bytes read.
+func (dc *Conn) reportClose() {
+	if dc.report == nil {
+		return
+	}
+	dc.report.BytesRead = atomic.LoadInt64(&dc.readBytes)
+	dc.report.DirectLatency, dc.report.DetourLatency = dc.Latencies()
+}
@@ -0,0 +1,46 @@
+package detour
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReport(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	detourAddr := newBannerServer("hello detour", 0)
+	directAddr := newBannerServer("", 0)
+	dialer := Dialer(dialTo(directAddr), dialTo(detourAddr))
+
+	report := &Report{}
+	conn, err := dialer(context.WithValue(context.Background(), ReportKey, report), "tcp", directAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	assert.Equal(t, "127.0.0.1", report.Host)
+	assert.Equal(t, "", report.Path, "should not decide before the first read")
+	b := make([]byte, 1024)
+	n, err := conn.Read(b)
+	assert.NoError(t, err)
+	assert.Equal(t, "detour", report.Path)
+	assert.Equal(t, "read timeout", report.Reason)
+	assert.Equal(t, []Signal{SignalReadTimeout}, report.Signals)
+	assert.True(t, report.DetectionTime >= 50*time.Millisecond, "should take at least the first read timeout, got %v", report.DetectionTime)
+	assert.NoError(t, report.Err)
+	conn.Close()
+	assert.EqualValues(t, n, report.BytesRead)
+	assert.True(t, report.DirectLatency > 0)
+	assert.True(t, report.DetourLatency > 0)
+
+	report = &Report{}
+	conn, err = dialer(context.WithValue(context.Background(), ReportKey, report), "tcp", directAddr)
+	if assert.NoError(t, err) {
+		assert.Equal(t, "detour", report.Path, "should fill in the path by the time dial returns if whitelisted")
+		assert.Equal(t, "", report.Reason)
+		conn.Close()
+	}
+}
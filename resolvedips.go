@@ -0,0 +1,148 @@
+package detour
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	resolveTimeout = 5 * time.Second
+	// the most hosts resolved at the same time to whitelist their IPs
+	resolveWorkers = 4
+)
+
+type resolvedIP struct {
+	// the whitelisted host which resolved to the IP
+	host    string
+	expires time.Time
+}
+
+var (
+	// IPs resolved from whitelisted hosts, protected by muWhitelist
+	resolvedIPs = make(map[string]resolvedIP)
+
+	muResolveQueue sync.Mutex
+	// hosts waiting to be resolved, in order, and the same as a set
+	resolveQueue   []string
+	queuedResolves = make(map[string]bool)
+	// number of goroutines resolving the queued hosts
+	resolvingWorkers int
+)
+
+// SetWhitelistResolvedIPs sets for how long the IPs a host resolves to are
+// whitelisted along with the host, so that dialing them directly, e.g. after
+// the caller's own DNS lookup, detours as well. The hosts are resolved by the
+// resolver set by SetResolvedIPsResolver(). 0, the default, disables it.
+func SetWhitelistResolvedIPs(ttl time.Duration) {
+	UpdateConfig(func(c Config) Config {
+		c.WhitelistResolvedIPsTTL = ttl
+		return c
+	})
+}
+
+// SetResolvedIPsResolver sets the resolver used to look up the IPs of
+// whitelisted hosts, see SetWhitelistResolvedIPs(). It's separate from
+// SetResolver() so that setting it doesn't enable checking DNS blocking. nil,
+// the default, means the system resolver.
+func SetResolvedIPsResolver(r Resolver) {
+	UpdateConfig(func(c Config) Config {
+		c.ResolvedIPsResolver = r
+		return c
+	})
+}
+
+// whitelistResolvedIPs queues host to be resolved in background and the
+// resulting IPs whitelisted, if enabled. At most resolveWorkers hosts are
+// resolved at the same time, so adding many hosts at once doesn't flood the
+// resolver.
+func whitelistResolvedIPs(host string) {
+	cfg := currentConfig()
+	if cfg.WhitelistResolvedIPsTTL <= 0 || net.ParseIP(host) != nil {
+		return
+	}
+	muResolveQueue.Lock()
+	defer muResolveQueue.Unlock()
+	if queuedResolves[host] {
+		return
+	}
+	queuedResolves[host] = true
+	resolveQueue = append(resolveQueue, host)
+	if resolvingWorkers < resolveWorkers {
+		resolvingWorkers++
+		go resolveQueued()
+	}
+}
+
+// resolveQueued resolves the queued hosts one by one until there's none left.
+func resolveQueued() {
+	for {
+		muResolveQueue.Lock()
+		if len(resolveQueue) == 0 {
+			resolvingWorkers--
+			muResolveQueue.Unlock()
+			return
+		}
+		host := resolveQueue[0]
+		resolveQueue = resolveQueue[1:]
+		delete(queuedResolves, host)
+		muResolveQueue.Unlock()
+		resolveAndWhitelist(host)
+	}
+}
+
+func resolveAndWhitelist(host string) {
+	cfg := currentConfig()
+	if cfg.WhitelistResolvedIPsTTL <= 0 {
+		return
+	}
+	r := cfg.ResolvedIPsResolver
+	if r == nil {
+		r = systemResolve
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), resolveTimeout)
+	defer cancel()
+	ips, err := r(ctx, host)
+	if err != nil {
+		log.Debugf("Unable to resolve %v to whitelist its IPs: %v", host, err)
+		return
+	}
+	now := time.Now()
+	muWhitelist.Lock()
+	defer muWhitelist.Unlock()
+	if _, ok := whitelist[host]; !ok {
+		log.Tracef("%v removed from whitelist while resolving", host)
+		return
+	}
+	for ip, e := range resolvedIPs {
+		if now.After(e.expires) {
+			delete(resolvedIPs, ip)
+		}
+	}
+	for _, ip := range ips {
+		log.Tracef("Whitelisting %v resolved from %v", ip, host)
+		resolvedIPs[ip.String()] = resolvedIP{host, now.Add(cfg.WhitelistResolvedIPsTTL)}
+	}
+}
+
+// resolvedIPWhitelisted checks if addr is an IP resolved from a whitelisted
+// host which hasn't expired yet. The caller should hold muWhitelist.
+func resolvedIPWhitelisted(addr string) bool {
+	ip := net.ParseIP(hostOnly(addr))
+	if ip == nil {
+		return false
+	}
+	e, ok := resolvedIPs[ip.String()]
+	return ok && time.Now().Before(e.expires)
+}
+
+// removeResolvedIPs removes the IPs resolved from host. The caller should hold
+// muWhitelist.
+func removeResolvedIPs(host string) {
+	for ip, e := range resolvedIPs {
+		if e.host == host {
+			delete(resolvedIPs, ip)
+		}
+	}
+}
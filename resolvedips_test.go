@@ -0,0 +1,74 @@
+package detour
+
+import (
+	"context"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWhitelistResolvedIPs(t *testing.T) {
+	defer RemoveFromWl("resolved.example")
+	defer stopMockServers()
+	defer SetResolvedIPsResolver(nil)
+	defer SetWhitelistResolvedIPs(0)
+	directAddr := newBannerServer("hello direct", 0)
+	detourAddr := newBannerServer("hello detour", 0)
+	SetResolvedIPsResolver(func(ctx context.Context, host string) ([]net.IP, error) {
+		return []net.IP{net.ParseIP("127.0.0.2"), net.ParseIP("::2")}, nil
+	})
+	SetWhitelistResolvedIPs(time.Minute)
+	assert.Nil(t, getResolver(currentConfig()), "should not enable checking DNS blocking")
+	dialer := Dialer(dialTo(directAddr), dialTo(detourAddr))
+
+	assert.Equal(t, "hello direct", readOnce(t, dialer, "127.0.0.2:80"), "should not detour before the host is whitelisted")
+	AddToWl("resolved.example:443", false)
+	assert.Eventually(t, func() bool { return whitelisted("127.0.0.2:80") }, time.Second, 10*time.Millisecond,
+		"should whitelist IPs resolved from the host")
+	assert.True(t, whitelisted("[::2]:80"))
+	assert.Equal(t, "hello detour", readOnce(t, dialer, "127.0.0.2:80"), "should detour when dialing a resolved IP")
+
+	RemoveFromWl("resolved.example")
+	assert.False(t, whitelisted("127.0.0.2:80"), "should remove resolved IPs along with the host")
+
+	SetWhitelistResolvedIPs(50 * time.Millisecond)
+	AddToWl("resolved.example:443", false)
+	assert.Eventually(t, func() bool { return whitelisted("127.0.0.2:80") }, time.Second, 10*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.False(t, whitelisted("127.0.0.2:80"), "should expire resolved IPs after TTL")
+	assert.True(t, whitelisted("resolved.example:443"), "should keep the host itself")
+}
+
+func TestWhitelistResolvedIPsBounded(t *testing.T) {
+	defer RestoreState(SaveState())
+	var mu sync.Mutex
+	resolving, maxResolving, resolved := 0, 0, 0
+	SetResolvedIPsResolver(func(ctx context.Context, host string) ([]net.IP, error) {
+		mu.Lock()
+		resolving++
+		if resolving > maxResolving {
+			maxResolving = resolving
+		}
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		resolving--
+		resolved++
+		mu.Unlock()
+		return []net.IP{net.ParseIP("127.0.0.3")}, nil
+	})
+	SetWhitelistResolvedIPs(time.Minute)
+
+	AddManyToWl(bulkAddrs(50), false)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return resolved == 50
+	}, 5*time.Second, 10*time.Millisecond, "should resolve all hosts")
+	mu.Lock()
+	defer mu.Unlock()
+	assert.True(t, maxResolving <= resolveWorkers, "should resolve at most %d hosts at once, got %d", resolveWorkers, maxResolving)
+}
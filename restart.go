@@ -0,0 +1,181 @@
+package detour
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// how many times the detour may be restarted for a single connection
+const maxMidStreamRestarts = 1
+
+var errRestartWindowExceeded = errors.New("response exceeds the restart window")
+
+// SetAllowMidStreamRestart controls whether a plain HTTP GET or HEAD request
+// is reissued through a new detour connection, possibly via another proxy, if
+// the detour fails before the whole response is received. To make it possible,
+// the response is held back until complete, or until it exceeds the window set
+// by SetMidStreamRestartMaxBytes(), after which restarting is impossible.
+// Disabled by default.
+func SetAllowMidStreamRestart(enabled bool) {
+	UpdateConfig(func(c Config) Config {
+		c.AllowMidStreamRestart = enabled
+		return c
+	})
+}
+
+// SetMidStreamRestartMaxBytes sets the largest response which can be restarted
+// if the detour fails midway, see SetAllowMidStreamRestart(). Defaults to 64KB.
+func SetMidStreamRestartMaxBytes(n int) {
+	UpdateConfig(func(c Config) Config {
+		c.MidStreamRestartMaxBytes = n
+		return c
+	})
+}
+
+// SetDirectReplayWindow keeps the request written before the first read after
+// direct connection seems fine, so that a plain HTTP GET or HEAD request is
+// still resent to detour if the direct connection fails before n bytes of the
+// response are received. To make it possible, the response is held back until
+// complete or exceeding n bytes. 0, the default, disables it.
+func SetDirectReplayWindow(n int) {
+	UpdateConfig(func(c Config) Config {
+		c.DirectReplayWindow = n
+		return c
+	})
+}
+
+// restartableRequest returns the request written so far if the detour can be
+// restarted for it, or nil.
+func (dc *Conn) restartableRequest() *http.Request {
+	if !dc.cfg.AllowMidStreamRestart || dc.cfg.MidStreamRestartMaxBytes <= 0 {
+		return nil
+	}
+	return dc.plainRequest()
+}
+
+// directReplayRequest returns the request written so far if it can be resent
+// to detour when the direct connection fails within the replay window, or nil.
+func (dc *Conn) directReplayRequest() *http.Request {
+	if dc.cfg.DirectReplayWindow <= 0 {
+		return nil
+	}
+	return dc.plainRequest()
+}
+
+// plainRequest returns the plain HTTP GET or HEAD request written so far, or
+// nil.
+func (dc *Conn) plainRequest() *http.Request {
+	dc.muLocalBuffer.Lock()
+	defer dc.muLocalBuffer.Unlock()
+	if dc.localBuffer == nil {
+		return nil
+	}
+	req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(dc.localBuffer.Bytes())))
+	if err != nil || (req.Method != http.MethodGet && req.Method != http.MethodHead) {
+		return nil
+	}
+	return req
+}
+
+// readWithRestart reads the response to req from detour ahead of the caller,
+// and restarts the detour if it fails before the response completes. What's
+// read ahead is returned by the following reads.
+func (dc *Conn) readWithRestart(b []byte, req *http.Request, deadline time.Time) (int, error) {
+	held, err := dc.readResponseAhead(dc.getConn(), req, dc.cfg.MidStreamRestartMaxBytes)
+	for restarts := 0; err != nil && err != errRestartWindowExceeded && restarts < maxMidStreamRestarts; restarts++ {
+		log.Debugf("Detour to %s failed after %d bytes, restart: %s", dc.addr, len(held), err)
+		dc.step("restart detour", err)
+		if err = dc.setupDetour(deadline); err != nil {
+			return 0, err
+		}
+		if !deadline.IsZero() {
+			if err := dc.getConn().SetReadDeadline(deadline); err != nil {
+				log.Debugf("Unable to set read deadline: %v", err)
+			}
+		}
+		held, err = dc.readResponseAhead(dc.getConn(), req, dc.cfg.MidStreamRestartMaxBytes)
+	}
+	if err == errRestartWindowExceeded {
+		log.Tracef("Response from %s exceeds the restart window, stream it", dc.addr)
+		err = nil
+	}
+	if len(held) == 0 {
+		return 0, err
+	}
+	atomic.AddInt64(&dc.readBytes, int64(len(held)))
+	n := copy(b, held)
+	dc.pending, dc.pendingErr = held[n:], err
+	return n, nil
+}
+
+// readDirectAhead reads the rest of the response to req from the direct
+// connection after the n bytes already read into b, and returns whether to
+// detour as the direct connection failed within the replay window. Otherwise
+// what's read is held back and returned by this and the following reads.
+func (dc *Conn) readDirectAhead(b []byte, n int, req *http.Request) (int, bool) {
+	first := append([]byte(nil), b[:n]...)
+	held, err := dc.readResponseAhead(io.MultiReader(bytes.NewReader(first), dc.getConn()), req, dc.cfg.DirectReplayWindow)
+	atomic.AddInt64(&dc.readBytes, int64(len(held)-n))
+	if err == errRestartWindowExceeded {
+		log.Tracef("Response from %s exceeds the replay window, stream it", dc.addr)
+		err = nil
+	}
+	if err != nil && dc.cfg.Detector.TamperingSuspected(err) {
+		log.Debugf("Direct connection to %s failed after %d bytes: %s", dc.addr, len(held), err)
+		dc.step("failed within replay window", err)
+		if dc.signal(SignalReadTimeout) && dc.canReplay() {
+			dc.detected(&counters.DetouredReadTimeout, "detour", "read timeout")
+			return 0, true
+		}
+	}
+	m := copy(b, held)
+	dc.pending, dc.pendingErr = held[m:], err
+	return m, false
+}
+
+// readResponseAhead reads the whole response to req from r, unless it exceeds
+// max bytes, in which case what's read so far is returned with
+// errRestartWindowExceeded.
+func (dc *Conn) readResponseAhead(r io.Reader, req *http.Request, max int) ([]byte, error) {
+	cr := &capturingReader{r: r, max: max}
+	resp, err := http.ReadResponse(bufio.NewReader(cr), req)
+	if err == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	return cr.captured.Bytes(), err
+}
+
+// readPending returns what's read ahead by readWithRestart().
+func (dc *Conn) readPending(b []byte) (int, error) {
+	if len(dc.pending) == 0 {
+		err := dc.pendingErr
+		dc.pendingErr = nil
+		return 0, err
+	}
+	n := copy(b, dc.pending)
+	dc.pending = dc.pending[n:]
+	return n, nil
+}
+
+// capturingReader captures everything read from r, and fails once more than
+// max bytes are read.
+type capturingReader struct {
+	r        io.Reader
+	captured bytes.Buffer
+	max      int
+}
+
+func (c *capturingReader) Read(b []byte) (int, error) {
+	n, err := c.r.Read(b)
+	c.captured.Write(b[:n])
+	if err == nil && c.captured.Len() > c.max {
+		return n, errRestartWindowExceeded
+	}
+	return n, err
+}
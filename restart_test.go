@@ -0,0 +1,102 @@
+package detour
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMidStreamRestart(t *testing.T) {
+	defer RemoveFromWl("restart.example")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	SetAllowMidStreamRestart(true)
+	defer SetAllowMidStreamRestart(false)
+	defer SetMidStreamRestartMaxBytes(64 * 1024)
+
+	body := strings.Repeat("a", 100)
+	directAddr := newBannerServer("", 0)
+	fullURL, _ := newMockServer(body)
+	truncatedURL, truncated := newMockServer("")
+	truncated.Raw("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n" + body[:10])
+	fullAddr, _ := url.Parse(fullURL)
+	truncatedAddr, _ := url.Parse(truncatedURL)
+	var detourDials int32
+	dialer := Dialer(dialTo(directAddr), func(ctx context.Context, network, addr string) (net.Conn, error) {
+		// the first detour dies midway, the next one works
+		if atomic.AddInt32(&detourDials, 1) == 1 {
+			return net.Dial(network, truncatedAddr.Host)
+		}
+		return net.Dial(network, fullAddr.Host)
+	})
+	get := func() (string, error) {
+		RemoveFromWl("restart.example")
+		conn, err := dialer(context.Background(), "tcp", "restart.example:80")
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		req, _ := http.NewRequest(http.MethodGet, "http://restart.example/", nil)
+		if err := req.Write(conn); err != nil {
+			return "", err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		b, err := io.ReadAll(resp.Body)
+		return string(b), err
+	}
+
+	read, err := get()
+	if assert.NoError(t, err, "should restart if detour fails midway") {
+		assert.Equal(t, body, read)
+	}
+	assert.EqualValues(t, 2, atomic.LoadInt32(&detourDials))
+
+	atomic.StoreInt32(&detourDials, 0)
+	SetMidStreamRestartMaxBytes(20)
+	_, err = get()
+	assert.Error(t, err, "should not restart beyond the restart window")
+	assert.EqualValues(t, 1, atomic.LoadInt32(&detourDials))
+}
+
+func TestDirectReplayWindow(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	SetDirectReplayWindow(64 * 1024)
+	defer SetDirectReplayWindow(0)
+	proxiedURL, _ := newMockServer(detourMsg)
+	mockURL, _ := newMockServer(strings.Repeat("a", 10000))
+
+	// direct succeeds on the first read but fails on the second
+	client := newDirectFailingClient(proxiedURL, time.Hour, 1)
+	resp, err := client.Get(mockURL)
+	if assert.NoError(t, err, "should get response if direct fails within the replay window") {
+		defer resp.Body.Close()
+		assertContent(t, resp, detourMsg, "should detour if direct fails within the replay window")
+	}
+	u, _ := url.Parse(mockURL)
+	assert.True(t, whitelisted(u.Host))
+	RemoveFromWl(u.Host)
+
+	client = newDirectFailingClient(proxiedURL, time.Hour, math.MaxInt64)
+	resp, err = client.Get(mockURL)
+	if assert.NoError(t, err) {
+		defer resp.Body.Close()
+		assertContent(t, resp, strings.Repeat("a", 10000), "should hold back and return the direct response")
+	}
+	assert.False(t, whitelisted(u.Host))
+}
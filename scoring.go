@@ -0,0 +1,95 @@
+package detour
+
+// Signal is something observed while detecting which suggests the site is
+// blocked.
+type Signal string
+
+// Signals which may be observed while dialing and reading first from a direct
+// connection.
+const (
+	SignalDNSBlocked       Signal = "dns blocked"
+	SignalDNSHijacked      Signal = "dns hijacked"
+	SignalDialFailure      Signal = "dial failure"
+	SignalUnreachable      Signal = "unreachable"
+	SignalUnsuccessful     Signal = "unsuccessful"
+	SignalHandshakeStall   Signal = "tls handshake stalled"
+	SignalReadTimeout      Signal = "read timeout"
+	SignalResponseHijacked Signal = "response hijacked"
+	SignalRedirectHijacked Signal = "redirect hijacked"
+	SignalThrottled        Signal = "throttled"
+)
+
+// SignalTransient is returned by the function passed to SetErrorClassifier()
+// for errors which are not a sign of blocking, so the connection doesn't
+// detour for them.
+const SignalTransient Signal = "transient"
+
+// Scorer decides if the signals observed so far for a connection are enough
+// to consider the site blocked and detour. It's consulted each time a signal is
+// observed, with all of them in order.
+type Scorer interface {
+	ShouldDetour(signals []Signal) bool
+}
+
+// WeightedScorer detours once the total weight of the signals observed
+// reaches Threshold. Signals without a weight count as 0.
+type WeightedScorer struct {
+	Weights   map[Signal]float64
+	Threshold float64
+}
+
+// ShouldDetour implements Scorer.
+func (s *WeightedScorer) ShouldDetour(signals []Signal) bool {
+	var score float64
+	for _, signal := range signals {
+		score += s.Weights[signal]
+	}
+	return score >= s.Threshold
+}
+
+// SetScorer sets the Scorer deciding whether to detour when signals of
+// blocking are observed. Pass nil to restore the default, which detours on any
+// signal.
+func SetScorer(s Scorer) {
+	UpdateConfig(func(c Config) Config {
+		c.Scorer = s
+		return c
+	})
+}
+
+// SetErrorClassifier sets a function to map errors dialing or reading first
+// from a direct connection to signals, e.g. driver specific or wrapped errors
+// the built-in rules don't recognize. It should return SignalTransient for
+// errors which are not a sign of blocking, any other signal for those which
+// are, or empty to leave the error to the built-in rules. Pass nil to remove
+// it.
+func SetErrorClassifier(classify func(err error) Signal) {
+	UpdateConfig(func(c Config) Config {
+		c.ErrorClassifier = classify
+		return c
+	})
+}
+
+// classifyError returns the signal err is mapped to by the function passed to
+// SetErrorClassifier(), and false if it's left to the built-in rules.
+func (dc *Conn) classifyError(err error) (Signal, bool) {
+	if dc.cfg.ErrorClassifier == nil {
+		return "", false
+	}
+	s := dc.cfg.ErrorClassifier(err)
+	return s, s != ""
+}
+
+// signal records an observed signal and checks if the connection should
+// detour.
+func (dc *Conn) signal(s Signal) bool {
+	dc.signals = append(dc.signals, s)
+	if dc.cfg.Scorer == nil {
+		return true
+	}
+	if !dc.cfg.Scorer.ShouldDetour(dc.signals) {
+		log.Debugf("Observed %v from %s so far, not enough to detour", dc.signals, dc.addr)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,99 @@
+package detour
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWeightedScorer(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(500 * time.Millisecond)
+	SetCountry("IR")
+	defer SetCountry("")
+	SetMinFirstReadBytesPerSec(1000)
+	defer SetMinFirstReadBytesPerSec(0)
+	SetThrottleSampleBytes(10)
+	defer SetThrottleSampleBytes(4096)
+	SetScorer(&WeightedScorer{
+		Weights:   map[Signal]float64{SignalResponseHijacked: 0.6, SignalThrottled: 0.6},
+		Threshold: 1,
+	})
+	defer SetScorer(nil)
+	detourAddr := newBannerServer("hello detour", 0)
+
+	hijacked := newBannerServer(iranResp, 0)
+	got := readOnce(t, Dialer(dialTo(hijacked), dialTo(detourAddr)), hijacked)
+	assert.True(t, strings.HasPrefix(got, "HTTP/1.1 403"), "should not detour on hijacked response alone")
+	assert.False(t, whitelisted(hijacked))
+
+	readSlowly := func(addr string, n int) {
+		conn, err := Dialer(dialTo(addr), dialTo(detourAddr))(context.Background(), "tcp", addr)
+		if assert.NoError(t, err) {
+			_, err = io.ReadFull(conn, make([]byte, n))
+			assert.NoError(t, err)
+			conn.Close()
+		}
+	}
+	throttled := newDripServer("hello direct, slowly", 20*time.Millisecond)
+	readSlowly(throttled, 15)
+	assert.False(t, whitelisted(throttled), "should not whitelist on throttling alone")
+
+	both := newBurstDripServer(iranResp, "more, slowly", 20*time.Millisecond)
+	readSlowly(both, len(iranResp)+11)
+	assert.True(t, whitelisted(both), "should whitelist if both signals observed")
+	assert.Equal(t, "hello detour", readOnce(t, Dialer(dialTo(both), dialTo(detourAddr)), both))
+}
+
+func TestWeightedScorerShouldDetour(t *testing.T) {
+	s := &WeightedScorer{Weights: map[Signal]float64{SignalDialFailure: 0.5}, Threshold: 1}
+	assert.False(t, s.ShouldDetour(nil))
+	assert.False(t, s.ShouldDetour([]Signal{SignalDialFailure}))
+	assert.False(t, s.ShouldDetour([]Signal{SignalDialFailure, SignalThrottled}), "signals without weight should count as 0")
+	assert.True(t, s.ShouldDetour([]Signal{SignalDialFailure, SignalDialFailure}))
+}
+
+func TestErrorClassifier(t *testing.T) {
+	s := SaveState()
+	defer RestoreState(s)
+	defer stopMockServers()
+	errBlocked := errors.New("driver: blocked by middlebox")
+	errFlaky := errors.New("driver: try again")
+	detourAddr := newBannerServer("hello detour", 0)
+	failing := func(err error) dialFunc {
+		return func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, fmt.Errorf("unable to connect: %w", err)
+		}
+	}
+
+	_, err := Dialer(failing(errBlocked), dialTo(detourAddr))(context.Background(), "tcp", "classified.example.com:80")
+	assert.Error(t, err, "should not detour for unrecognized errors by default")
+
+	SetErrorClassifier(func(err error) Signal {
+		switch {
+		case errors.Is(err, errBlocked):
+			return SignalDialFailure
+		case errors.Is(err, errFlaky):
+			return SignalTransient
+		}
+		return ""
+	})
+	assert.Equal(t, "hello detour", readOnce(t, Dialer(failing(errBlocked), dialTo(detourAddr)), "classified.example.com:80"),
+		"should detour if classified as a sign of blocking")
+	RemoveFromWl("classified.example.com")
+	_, err = Dialer(failing(errFlaky), dialTo(detourAddr))(context.Background(), "tcp", "classified.example.com:80")
+	assert.True(t, errors.Is(err, errFlaky), "should not detour if classified as transient")
+	refused := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		return nil, &net.OpError{Op: "dial", Err: errors.New("refused")}
+	}
+	_, err = Dialer(refused, dialTo(detourAddr))(context.Background(), "tcp", "classified.example.com:80")
+	assert.NoError(t, err, "should leave unhandled errors to the built-in rules")
+}
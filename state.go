@@ -0,0 +1,175 @@
+package detour
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// State is a snapshot of the package wide state taken by SaveState(): the
+// whitelist and everything learned about hosts, the country specific detection
+// rules, the censored and known good lists, the proxies and their health, the
+// callbacks, the counters and the config.
+type State struct {
+	whitelist        map[string]wlEntry
+	forceWhitelist   map[string]wlEntry
+	wlHighWaterMark  int
+	invalidatedHosts map[string]bool
+	resolvedIPs      map[string]resolvedIP
+	verifiedHosts    map[string]time.Time
+	adaptiveTimeouts map[string]time.Duration
+	learned          map[string]LearnedParams
+	hostRecords      map[string]hostRecord
+	pinnedHosts      map[string]time.Time
+
+	registeredProxies  map[string]WeightedProxy
+	unhealthyProxies   map[string]bool
+	quarantinedProxies map[string]time.Time
+	disabledProxies    map[string]bool
+	proxyAffinity      map[string]affinity
+	proxyStats         map[string]ProxyStat
+	lastAllProxiesDown time.Time
+	proxyAuthRequired  int32
+
+	onAllProxiesDown    func()
+	onProxyAuthRequired func()
+	onWhitelistEvict    func(addr string, reason EvictReason)
+
+	stats          DetectionStats
+	detections     int64
+	detectionNanos int64
+
+	censoredList  *DomainList
+	knownGoodList *DomainList
+	config        *Config
+}
+
+// SaveState takes a snapshot of the package wide state, e.g. for tests to
+// restore a clean state with RestoreState() in teardown. State added to the
+// package should be saved and restored here too.
+func SaveState() State {
+	var s State
+	muWhitelist.RLock()
+	s.whitelist = copyWl(whitelist)
+	s.forceWhitelist = copyWl(forceWhitelist)
+	s.wlHighWaterMark = wlHighWaterMark
+	s.invalidatedHosts = copyMap(invalidatedHosts)
+	s.resolvedIPs = copyMap(resolvedIPs)
+	muWhitelist.RUnlock()
+
+	s.verifiedHosts = copyVerifiedHosts()
+	muAdaptiveTimeouts.Lock()
+	s.adaptiveTimeouts = copyMap(adaptiveTimeouts)
+	muAdaptiveTimeouts.Unlock()
+	muLearned.Lock()
+	s.learned = copyMap(learned)
+	muLearned.Unlock()
+	muPins.Lock()
+	s.hostRecords = make(map[string]hostRecord, len(hostRecords))
+	for host, r := range hostRecords {
+		s.hostRecords[host] = *r
+	}
+	s.pinnedHosts = copyMap(pinnedHosts)
+	muPins.Unlock()
+
+	muProxies.RLock()
+	s.registeredProxies = copyMap(registeredProxies)
+	s.unhealthyProxies = copyMap(unhealthyProxies)
+	s.quarantinedProxies = copyMap(quarantinedProxies)
+	s.disabledProxies = copyMap(disabledProxies)
+	s.proxyAffinity = copyMap(proxyAffinity)
+	s.proxyStats = copyMap(proxyStats)
+	s.lastAllProxiesDown = lastAllProxiesDown
+	muProxies.RUnlock()
+	s.proxyAuthRequired = atomic.LoadInt32(&_proxyAuthRequired)
+
+	s.onAllProxiesDown, _ = allProxiesDownCallback.Load().(func())
+	s.onProxyAuthRequired, _ = proxyAuthRequiredCallback.Load().(func())
+	s.onWhitelistEvict, _ = whitelistEvictCallback.Load().(func(addr string, reason EvictReason))
+
+	s.stats = Stats()
+	s.detections = atomic.LoadInt64(&detections)
+	s.detectionNanos = atomic.LoadInt64(&detectionNanos)
+
+	s.censoredList = getCensoredList()
+	s.knownGoodList = getKnownGoodList()
+	s.config = currentConfig()
+	return s
+}
+
+// RestoreState restores the package wide state saved by SaveState(). The same
+// State can be restored more than once.
+func RestoreState(s State) {
+	UpdateConfig(func(Config) Config {
+		return *s.config
+	})
+	censoredList.Store(s.censoredList)
+	knownGoodList.Store(s.knownGoodList)
+
+	OnAllProxiesDown(s.onAllProxiesDown)
+	OnProxyAuthRequired(s.onProxyAuthRequired)
+	OnWhitelistEvict(s.onWhitelistEvict)
+
+	restoreStats(s.stats)
+	atomic.StoreInt64(&detections, s.detections)
+	atomic.StoreInt64(&detectionNanos, s.detectionNanos)
+
+	atomic.StoreInt32(&_proxyAuthRequired, s.proxyAuthRequired)
+	muProxies.Lock()
+	registeredProxies = copyMap(s.registeredProxies)
+	unhealthyProxies = copyMap(s.unhealthyProxies)
+	quarantinedProxies = copyMap(s.quarantinedProxies)
+	disabledProxies = copyMap(s.disabledProxies)
+	proxyAffinity = copyMap(s.proxyAffinity)
+	proxyStats = copyMap(s.proxyStats)
+	lastAllProxiesDown = s.lastAllProxiesDown
+	muProxies.Unlock()
+
+	muPins.Lock()
+	hostRecords = make(map[string]*hostRecord, len(s.hostRecords))
+	for host, r := range s.hostRecords {
+		r := r
+		hostRecords[host] = &r
+	}
+	pinnedHosts = copyMap(s.pinnedHosts)
+	muPins.Unlock()
+	muLearned.Lock()
+	learned = copyMap(s.learned)
+	muLearned.Unlock()
+	muAdaptiveTimeouts.Lock()
+	adaptiveTimeouts = copyMap(s.adaptiveTimeouts)
+	muAdaptiveTimeouts.Unlock()
+	muVerifiedHosts.Lock()
+	verifiedHosts = copyMap(s.verifiedHosts)
+	muVerifiedHosts.Unlock()
+	// only a cache of the whitelist store, which may differ in s.config
+	resetStoreMisses()
+
+	muWhitelist.Lock()
+	defer muWhitelist.Unlock()
+	whitelist = copyWl(s.whitelist)
+	forceWhitelist = copyWl(s.forceWhitelist)
+	rebuildTemporaryLRU()
+	wlHighWaterMark = s.wlHighWaterMark
+	invalidatedHosts = copyMap(s.invalidatedHosts)
+	resolvedIPs = copyMap(s.resolvedIPs)
+}
+
+func copyWl(m map[string]wlEntry) map[string]wlEntry {
+	c := make(map[string]wlEntry, len(m))
+	for host, e := range m {
+		if e.lastUsed != nil {
+			lastUsed := e.lastUsedNano()
+			e.lastUsed = &lastUsed
+		}
+		c[host] = e
+	}
+	return c
+}
+
+func copyMap[K comparable, V any](m map[K]V) map[K]V {
+	c := make(map[K]V, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
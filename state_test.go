@@ -0,0 +1,45 @@
+package detour
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSaveRestoreState(t *testing.T) {
+	s := SaveState()
+	defer RestoreState(s)
+	wasWhitelisted := whitelisted("state.example.com")
+	timeout := currentConfig().DetourTimeout
+
+	AddToWl("state.example.com", true)
+	ForceWhitelist("forced.example.com")
+	restoreLearned("state.example.com", LearnedParams{FirstReadTimeout: time.Minute, FalsePositives: 1})
+	DisableProxy("state-proxy")
+	OnWhitelistEvict(func(string, EvictReason) {})
+	atomic.AddInt64(&counters.StayedDirect, 1)
+	SetCountry("IR")
+	SetCensoredList(NewDomainList("censored.example.com"))
+	SetDetourTimeout(time.Minute)
+	assert.True(t, whitelisted("state.example.com"))
+	assert.True(t, LikelyCensored("censored.example.com"))
+
+	for i := 0; i < 2; i++ {
+		RestoreState(s)
+		assert.Equal(t, wasWhitelisted, whitelisted("state.example.com"), "should restore whitelist")
+		assert.False(t, whitelisted("forced.example.com"), "should restore force whitelist")
+		assert.False(t, LikelyCensored("censored.example.com"), "should restore censored list")
+		assert.Equal(t, timeout, currentConfig().DetourTimeout, "should restore config")
+		assert.True(t, currentDetector() == s.config.Detector, "should restore country rules")
+		assert.Equal(t, LearnedParams{}, Learned("state.example.com"), "should restore learned parameters")
+		muProxies.RLock()
+		assert.False(t, disabledProxies["state-proxy"], "should restore proxies")
+		muProxies.RUnlock()
+		onEvict, _ := whitelistEvictCallback.Load().(func(string, EvictReason))
+		assert.Equal(t, s.onWhitelistEvict == nil, onEvict == nil, "should restore callbacks")
+		assert.Equal(t, s.stats, Stats(), "should restore counters")
+		AddToWl("state.example.com", true)
+	}
+}
@@ -0,0 +1,90 @@
+package detour
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// DetectionStats counts the outcomes of detecting whether sites are blocked.
+type DetectionStats struct {
+	// DetouredDialFailure counts connections detoured because dialing
+	// directly failed in a suspicious way.
+	DetouredDialFailure int64
+	// DetouredUnreachable counts connections detoured because dialing
+	// directly failed as the host or network is unreachable, which is often
+	// caused by an ICMP unreachable from a firewall.
+	DetouredUnreachable int64
+	// DetouredReadTimeout counts connections detoured because the first read
+	// from the direct connection timed out or was otherwise tampered with,
+	// e.g. reset.
+	DetouredReadTimeout int64
+	// DetouredHijack counts connections detoured because DNS or the response
+	// was hijacked.
+	DetouredHijack int64
+	// DetouredUnsuccessful counts connections detoured because the function
+	// set by SetSuccessFunc() rejected the first read, or it didn't match the
+	// pattern set by SetSuccessPatternFor().
+	DetouredUnsuccessful int64
+	// DetouredHandshakeStall counts connections detoured because the TLS
+	// handshake stalled, see SetTLSHandshakeStallTimeout().
+	DetouredHandshakeStall int64
+	// WhitelistedThrottled counts direct connections found too slow. They stay
+	// direct, but their sites are added to whitelist so later connections
+	// detour, see SetMinFirstReadBytesPerSec().
+	WhitelistedThrottled int64
+	// StayedDirect counts connections settled to direct after the first read.
+	StayedDirect int64
+	// FalsePositiveDetours counts whitelisted hosts found reachable directly
+	// when detected again after InvalidateHost(), i.e. which were detoured
+	// while not or no longer blocked.
+	FalsePositiveDetours int64
+}
+
+var (
+	// accessed atomically only
+	counters DetectionStats
+
+	// number and total duration of first reads from direct connections to
+	// detect blocking, accessed atomically only
+	detections     int64
+	detectionNanos int64
+)
+
+func recordDetection(d time.Duration) {
+	atomic.AddInt64(&detections, 1)
+	atomic.AddInt64(&detectionNanos, int64(d))
+}
+
+// Stats returns a snapshot of the detection counters.
+func Stats() DetectionStats {
+	return DetectionStats{
+		DetouredDialFailure:    atomic.LoadInt64(&counters.DetouredDialFailure),
+		DetouredUnreachable:    atomic.LoadInt64(&counters.DetouredUnreachable),
+		DetouredReadTimeout:    atomic.LoadInt64(&counters.DetouredReadTimeout),
+		DetouredHijack:         atomic.LoadInt64(&counters.DetouredHijack),
+		DetouredUnsuccessful:   atomic.LoadInt64(&counters.DetouredUnsuccessful),
+		DetouredHandshakeStall: atomic.LoadInt64(&counters.DetouredHandshakeStall),
+		WhitelistedThrottled:   atomic.LoadInt64(&counters.WhitelistedThrottled),
+		StayedDirect:           atomic.LoadInt64(&counters.StayedDirect),
+		FalsePositiveDetours:   atomic.LoadInt64(&counters.FalsePositiveDetours),
+	}
+}
+
+// DetectionDurations returns the number and total duration of first reads from
+// direct connections to detect blocking.
+func DetectionDurations() (count int64, total time.Duration) {
+	return atomic.LoadInt64(&detections), time.Duration(atomic.LoadInt64(&detectionNanos))
+}
+
+// restoreStats sets the detection counters to s, see RestoreState().
+func restoreStats(s DetectionStats) {
+	atomic.StoreInt64(&counters.DetouredDialFailure, s.DetouredDialFailure)
+	atomic.StoreInt64(&counters.DetouredUnreachable, s.DetouredUnreachable)
+	atomic.StoreInt64(&counters.DetouredReadTimeout, s.DetouredReadTimeout)
+	atomic.StoreInt64(&counters.DetouredHijack, s.DetouredHijack)
+	atomic.StoreInt64(&counters.DetouredUnsuccessful, s.DetouredUnsuccessful)
+	atomic.StoreInt64(&counters.DetouredHandshakeStall, s.DetouredHandshakeStall)
+	atomic.StoreInt64(&counters.WhitelistedThrottled, s.WhitelistedThrottled)
+	atomic.StoreInt64(&counters.StayedDirect, s.StayedDirect)
+	atomic.StoreInt64(&counters.FalsePositiveDetours, s.FalsePositiveDetours)
+}
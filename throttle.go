@@ -0,0 +1,45 @@
+package detour
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SetThrottleSampleBytes sets how many bytes to read from a direct connection
+// after the first read before judging its throughput, see
+// SetMinFirstReadBytesPerSec(). Defaults to 4096.
+func SetThrottleSampleBytes(n int) {
+	UpdateConfig(func(c Config) Config {
+		c.ThrottleSampleBytes = n
+		return c
+	})
+}
+
+// sampleThroughput accumulates the bytes read from the direct connection after
+// the first read and the time spent reading them, and once there are
+// ThrottleSampleBytes of them, checks the throughput against
+// MinFirstReadBytesPerSec. The first read is left out as it's mostly the time
+// to first byte, and so is the time between reads, as it's the application
+// being slow to read rather than the network.
+func (dc *Conn) sampleThroughput(n int, elapsed time.Duration) {
+	minRate := dc.cfg.MinFirstReadBytesPerSec
+	if minRate <= 0 || dc.throughputChecked {
+		return
+	}
+	dc.sampledBytes += int64(n)
+	dc.sampledTime += elapsed
+	if dc.sampledBytes < int64(dc.cfg.ThrottleSampleBytes) {
+		return
+	}
+	dc.throughputChecked = true
+	rate := float64(dc.sampledBytes) / dc.sampledTime.Seconds()
+	if rate >= float64(minRate) {
+		return
+	}
+	log.Debugf("Read %d bytes from %s %s in %v, %.0f bytes/s, seems throttled", dc.sampledBytes, dc.addr, dc.stateDesc(), dc.sampledTime, rate)
+	dc.step("throttled", nil)
+	if dc.signal(SignalThrottled) {
+		atomic.AddInt64(&counters.WhitelistedThrottled, 1)
+		dc.addToWl(false)
+	}
+}
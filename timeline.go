@@ -0,0 +1,63 @@
+package detour
+
+import (
+	"time"
+)
+
+// Step is a step taken by a connection to decide whether to detour, see
+// Conn.Timeline().
+type Step struct {
+	// Elapsed is the time since dialing started
+	Elapsed time.Duration
+	Event   string
+	// Err is the error the step failed with, if any
+	Err error
+}
+
+// SetDebugTimeline enables debugging connections dialed afterwards, which
+// records the timeline of decisions, the routes tried and the request replayed
+// to detour, see Conn.Timeline(), Conn.AttemptLog() and
+// Conn.ReplayedRequest(). Disabled by default to avoid the overhead.
+func SetDebugTimeline(enabled bool) {
+	UpdateConfig(func(c Config) Config {
+		c.DebugTimeline = enabled
+		return c
+	})
+}
+
+// Timeline returns the steps taken so far to decide whether to detour this
+// connection, or nil if SetDebugTimeline() was not enabled when dialing.
+func (dc *Conn) Timeline() []Step {
+	dc.muTimeline.Lock()
+	defer dc.muTimeline.Unlock()
+	if dc.timeline == nil {
+		return nil
+	}
+	return append([]Step(nil), dc.timeline...)
+}
+
+// ReplayedRequest returns the bytes resent to detour, or nil if nothing was
+// resent or SetDebugTimeline() was not enabled when dialing.
+func (dc *Conn) ReplayedRequest() []byte {
+	dc.muLocalBuffer.Lock()
+	defer dc.muLocalBuffer.Unlock()
+	return dc.replayed
+}
+
+func (dc *Conn) debugging() bool {
+	return !dc.dialStart.IsZero()
+}
+
+// step records a step in timeline if debugging this connection, and notifies
+// the observer if any.
+func (dc *Conn) step(event string, err error) {
+	if dc.observer != nil {
+		dc.observer.Step(event, err)
+	}
+	if !dc.debugging() {
+		return
+	}
+	dc.muTimeline.Lock()
+	dc.timeline = append(dc.timeline, Step{time.Since(dc.dialStart), event, err})
+	dc.muTimeline.Unlock()
+}
@@ -0,0 +1,85 @@
+package detour
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTimeline(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	directAddr := newBannerServer("", 0)
+	detourAddr := newBannerServer("hello detour", 0)
+	dialer := Dialer(dialTo(directAddr), dialTo(detourAddr))
+
+	conn, err := dialer(context.Background(), "tcp", directAddr)
+	if assert.NoError(t, err) {
+		assert.Nil(t, conn.(*Conn).Timeline(), "should not record timeline unless enabled")
+		conn.Close()
+	}
+
+	SetDebugTimeline(true)
+	defer SetDebugTimeline(false)
+	conn, err = dialer(context.Background(), "tcp", directAddr)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close()
+	_, err = conn.Read(make([]byte, 1024))
+	assert.NoError(t, err)
+	steps := conn.(*Conn).Timeline()
+	var events []string
+	for _, step := range steps {
+		events = append(events, step.Event)
+	}
+	assert.Equal(t, []string{
+		"dial direct",
+		"dialed direct",
+		"first read",
+		"first read done",
+		"dial detour",
+		"dialed detour",
+		"detour first read",
+		"detour first read done",
+	}, events)
+	if assert.Len(t, steps, 8) {
+		assert.Error(t, steps[3].Err, "first read should time out")
+		assert.True(t, steps[3].Elapsed >= currentConfig().FirstReadTimeout, "first read should time out after the detection window")
+		assert.NoError(t, steps[7].Err)
+		for i := 1; i < len(steps); i++ {
+			assert.True(t, steps[i].Elapsed >= steps[i-1].Elapsed, "steps should be in order")
+		}
+	}
+}
+
+func TestReplayedRequest(t *testing.T) {
+	defer RemoveFromWl("127.0.0.1")
+	defer stopMockServers()
+	setFirstReadTimeout(50 * time.Millisecond)
+	directAddr := newBannerServer("", 0)
+	detourAddr := newEchoServer()
+	dialer := Dialer(dialTo(directAddr), dialTo(detourAddr))
+	request := []byte("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	replay := func() []byte {
+		conn, err := dialer(context.Background(), "tcp", directAddr)
+		if !assert.NoError(t, err) {
+			return nil
+		}
+		defer conn.Close()
+		_, err = conn.Write(request)
+		assert.NoError(t, err)
+		_, err = conn.Read(make([]byte, 1024))
+		assert.NoError(t, err)
+		RemoveFromWl(directAddr)
+		return conn.(*Conn).ReplayedRequest()
+	}
+
+	assert.Nil(t, replay(), "should not keep replayed request unless debugging")
+	SetDebugTimeline(true)
+	defer SetDebugTimeline(false)
+	assert.Equal(t, request, replay(), "should return what the client wrote before detour")
+}
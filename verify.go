@@ -0,0 +1,176 @@
+package detour
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// the direct response body is considered manipulated if it's shorter than this
+// ratio of the detour one
+const verifyContentMinRatio = 0.9
+
+var (
+	muVerifiedHosts sync.Mutex
+	// hosts which have been sampled for content verification and when
+	verifiedHosts = make(map[string]time.Time)
+	// a host may be sampled again once this long passed since last sampled
+	verifiedHostTTL = 24 * time.Hour
+	// the most hosts remembered as sampled
+	maxVerifiedHosts = 10000
+)
+
+// SetVerifyContent enables verifying the content of direct connections. The
+// first plain HTTP GET or HEAD request to a host which seems fine directly is
+// sampled, see SetVerifyContentSampleRate(), and fetched again in background
+// through both direct and detour. If the direct response body is much shorter
+// than the detour one, the content is likely manipulated, so the host is added
+// to whitelist to detour going forward. Disabled by default as it's expensive.
+func SetVerifyContent(enabled bool) {
+	UpdateConfig(func(c Config) Config {
+		c.VerifyContent = enabled
+		return c
+	})
+}
+
+// SetVerifyContentSampleRate sets the fraction, between 0 and 1, of new hosts
+// to verify when SetVerifyContent() is enabled. Defaults to 0.1.
+func SetVerifyContentSampleRate(rate float64) {
+	UpdateConfig(func(c Config) Config {
+		c.VerifyContentSampleRate = rate
+		return c
+	})
+}
+
+// maybeVerifyContent verifies the content of the site in background if enabled
+// and sampled. Must be called before the local buffer is released.
+func (dc *Conn) maybeVerifyContent() {
+	if !dc.cfg.VerifyContent || dc.cfg.Paused || dc.noWhitelist || dc.directDialer == nil {
+		return
+	}
+	host := hostOnly(dc.addr)
+	now := time.Now()
+	muVerifiedHosts.Lock()
+	last, seen := verifiedHosts[host]
+	sampled := (!seen || now.Sub(last) > verifiedHostTTL) && randFloat64() < dc.cfg.VerifyContentSampleRate
+	if sampled {
+		if !seen && len(verifiedHosts) >= maxVerifiedHosts {
+			forgetVerifiedHosts(now)
+		}
+		verifiedHosts[host] = now
+	}
+	muVerifiedHosts.Unlock()
+	if !sampled {
+		return
+	}
+	dc.muLocalBuffer.Lock()
+	var req []byte
+	if dc.localBuffer != nil {
+		req = append(req, dc.localBuffer.Bytes()...)
+	}
+	dc.muLocalBuffer.Unlock()
+	go dc.verifyContent(req)
+}
+
+// forgetVerifiedHosts forgets the hosts sampled longer than verifiedHostTTL
+// ago, or the least recently sampled one if there are none, to make room. The
+// caller should hold muVerifiedHosts.
+func forgetVerifiedHosts(now time.Time) {
+	oldest, oldestAt := "", now
+	for host, at := range verifiedHosts {
+		if now.Sub(at) > verifiedHostTTL {
+			delete(verifiedHosts, host)
+		} else if at.Before(oldestAt) {
+			oldest, oldestAt = host, at
+		}
+	}
+	if len(verifiedHosts) >= maxVerifiedHosts {
+		delete(verifiedHosts, oldest)
+	}
+}
+
+// sweepVerifiedHosts forgets the hosts sampled longer than verifiedHostTTL
+// before now.
+func sweepVerifiedHosts(now time.Time) {
+	muVerifiedHosts.Lock()
+	defer muVerifiedHosts.Unlock()
+	for host, at := range verifiedHosts {
+		if now.Sub(at) > verifiedHostTTL {
+			delete(verifiedHosts, host)
+		}
+	}
+}
+
+func copyVerifiedHosts() map[string]time.Time {
+	muVerifiedHosts.Lock()
+	defer muVerifiedHosts.Unlock()
+	c := make(map[string]time.Time, len(verifiedHosts))
+	for host, at := range verifiedHosts {
+		c[host] = at
+	}
+	return c
+}
+
+func (dc *Conn) verifyContent(req []byte) {
+	r, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(req)))
+	if err != nil || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+		log.Tracef("Not a plain HTTP GET or HEAD request to %s, skip verifying content", dc.addr)
+		return
+	}
+	timeout := dc.cfg.DetourTimeout
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	directSize, err := fetchBodySize(ctx, dc.directDialer, dc.network, dc.addr, req, r)
+	if directSize == 0 && err != nil {
+		log.Debugf("Unable to verify content of %s directly: %v", dc.addr, err)
+		return
+	}
+	detourAddr := rewriteDetourAddr(dc.cfg.DetourAddrRewriter, dc.addr)
+	detourSize, err := fetchBodySize(ctx, dc.detourDialer(), dc.network, detourAddr, req, r)
+	if err != nil {
+		log.Debugf("Unable to verify content of %s through detour: %v", dc.addr, err)
+		return
+	}
+	if float64(directSize) < float64(detourSize)*verifyContentMinRatio {
+		log.Debugf("Got %d bytes from %s directly but %d bytes through detour, seems manipulated, add to whitelist",
+			directSize, dc.addr, detourSize)
+		AddToWl(dc.whitelistAddr(), false)
+		return
+	}
+	log.Tracef("Verified content of %s, %d bytes directly and %d bytes through detour", dc.addr, directSize, detourSize)
+}
+
+// fetchBodySize sends the raw request through the dialer and returns the size
+// of the response body. In case the body is cut short, the size read so far is
+// returned along with the error.
+func fetchBodySize(ctx context.Context, dial dialFunc, network, addr string, raw []byte, req *http.Request) (n int64, err error) {
+	conn, err := dial(ctx, network, addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	err = withDeadline(ctx, conn, func() error {
+		if _, err := conn.Write(raw); err != nil {
+			return err
+		}
+		resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		n, err = io.Copy(io.Discard, resp.Body)
+		return err
+	})
+	if err != nil {
+		err = fmt.Errorf("Unable to fetch %s: %s", addr, err)
+	}
+	return
+}
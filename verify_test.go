@@ -0,0 +1,70 @@
+package detour
+
+import (
+	"context"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestVerifyContent(t *testing.T) {
+	s := SaveState()
+	defer RestoreState(s)
+	defer stopMockServers()
+	SetVerifyContent(true)
+	SetVerifyContentSampleRate(1)
+
+	body := strings.Repeat("a", 100)
+	detourURL, _ := newMockServer(body)
+	intactURL, _ := newMockServer(body)
+	truncatedURL, truncated := newMockServer("")
+	truncated.Raw("HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n" + body[:10])
+	detourAddr, _ := url.Parse(detourURL)
+	intactAddr, _ := url.Parse(intactURL)
+	truncatedAddr, _ := url.Parse(truncatedURL)
+
+	request := func(directAddr string, host string) {
+		conn, err := Dialer(dialTo(directAddr), dialTo(detourAddr.Host))(context.Background(), "tcp", host+":80")
+		if !assert.NoError(t, err) {
+			return
+		}
+		defer conn.Close()
+		_, err = conn.Write([]byte("GET / HTTP/1.1\r\nHost: " + host + "\r\n\r\n"))
+		assert.NoError(t, err)
+		_, err = conn.Read(make([]byte, 1024))
+		assert.NoError(t, err)
+	}
+
+	request(truncatedAddr.Host, "truncated.example")
+	assert.Eventually(t, func() bool { return whitelisted("truncated.example:80") }, time.Second, 10*time.Millisecond,
+		"should whitelist if direct response is truncated")
+
+	request(intactAddr.Host, "intact.example")
+	time.Sleep(200 * time.Millisecond)
+	assert.False(t, whitelisted("intact.example:80"), "should not whitelist if direct response is intact")
+}
+
+func TestVerifiedHostsBounded(t *testing.T) {
+	s := SaveState()
+	defer RestoreState(s)
+	defer func(max int) { maxVerifiedHosts = max }(maxVerifiedHosts)
+	maxVerifiedHosts = 2
+	now := time.Now()
+	muVerifiedHosts.Lock()
+	verifiedHosts = map[string]time.Time{
+		"expired.example": now.Add(-2 * verifiedHostTTL),
+		"old.example":     now.Add(-time.Hour),
+	}
+	forgetVerifiedHosts(now)
+	assert.Len(t, verifiedHosts, 1, "should forget expired hosts first")
+	verifiedHosts["new.example"] = now
+	forgetVerifiedHosts(now)
+	assert.Equal(t, map[string]time.Time{"new.example": now}, verifiedHosts, "should forget the least recently sampled host if full")
+	muVerifiedHosts.Unlock()
+
+	sweepVerifiedHosts(now.Add(2 * verifiedHostTTL))
+	assert.Empty(t, copyVerifiedHosts(), "should sweep expired hosts")
+}
@@ -2,41 +2,292 @@ package detour
 
 import (
 	"net"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
 )
 
 type wlEntry struct {
 	permanent bool
+	// the dialer to detour this host through, nil means the one passed to
+	// Dialer()
+	dialer dialFunc
+	// the network this entry applies to, empty means all networks
+	network string
+	// a note about the entry, see AddToWlLabeled()
+	label string
+	// not verified yet, see SetVerifyBeforeTrust()
+	provisional bool
+	// when the entry was last added
+	added time.Time
+	// unix nanoseconds when the entry was last added or matched, shared by
+	// copies of the entry so it can be touched with only the read lock held
+	lastUsed *int64
+}
+
+func (e wlEntry) touch() {
+	if e.lastUsed != nil {
+		atomic.StoreInt64(e.lastUsed, time.Now().UnixNano())
+	}
+}
+
+func (e wlEntry) lastUsedNano() int64 {
+	if e.lastUsed == nil {
+		return 0
+	}
+	return atomic.LoadInt64(e.lastUsed)
+}
+
+// expired checks if the entry is a temporary one added longer than ttl ago,
+// see SetTemporaryEntryTTL().
+func (e wlEntry) expired(ttl time.Duration, now time.Time) bool {
+	return ttl > 0 && !e.permanent && now.Sub(e.added) > ttl
+}
+
+// matches checks if the entry applies to the network, empty network matches
+// all entries.
+func (e wlEntry) matches(network string) bool {
+	return e.network == "" || network == "" || e.network == baseNetwork(network)
 }
 
 var (
 	muWhitelist    sync.RWMutex
 	whitelist      = make(map[string]wlEntry)
 	forceWhitelist = make(map[string]wlEntry)
+	// the most entries whitelist and forceWhitelist ever had in total
+	wlHighWaterMark int
+	// hosts to detect again on next dial, see InvalidateHost()
+	invalidatedHosts = make(map[string]bool)
 )
 
 func ForceWhitelist(addr string) {
 	log.Tracef("Force whitelisting %v", addr)
 	muWhitelist.Lock()
 	defer muWhitelist.Unlock()
-	forceWhitelist[hostOnly(addr)] = wlEntry{true}
+	forceWhitelist[hostOnly(addr)] = wlEntry{permanent: true}
+	updateWlHighWaterMark()
 }
 
 // AddToWl adds a domain to whitelist, all subdomains of this domain
-// are also considered to be in the whitelist.
+// are also considered to be in the whitelist. If the domain is already in the
+// whitelist, only whether it's permanent is updated.
 func AddToWl(addr string, permanent bool) {
 	log.Tracef("Adding %v to whitelist. Permanent? %v", addr, permanent)
 	muWhitelist.Lock()
 	defer muWhitelist.Unlock()
-	whitelist[hostOnly(addr)] = wlEntry{permanent}
+	addToWl(hostOnly(addr), permanent, time.Now())
+}
+
+// AddManyToWl is like AddToWl but adds all of addrs at once, logging only a
+// summary rather than each of them, which is much cheaper for bulk loads.
+func AddManyToWl(addrs []string, permanent bool) {
+	muWhitelist.Lock()
+	defer muWhitelist.Unlock()
+	now := time.Now()
+	for _, addr := range addrs {
+		addToWl(hostOnly(addr), permanent, now)
+	}
+	log.Debugf("Added %d entries to whitelist. Permanent? %v", len(addrs), permanent)
+}
+
+// addToWl adds host to whitelist. The caller should hold muWhitelist.
+func addToWl(host string, permanent bool, now time.Time) {
+	// keep the dialer and network if already set
+	e := whitelist[host]
+	e.permanent = permanent
+	e.provisional = false
+	e.added = now
+	putWl(host, e)
+	whitelistResolvedIPs(host)
+}
+
+// AddToWlLabeled is like AddToWl but attaches a label to the entry, e.g. a note
+// about why an operator added it. The label is kept when the host is added
+// again, and is returned by DumpWhitelistEntries() and saved by
+// SaveWhitelist().
+func AddToWlLabeled(addr string, permanent bool, label string) {
+	log.Tracef("Adding %v to whitelist labeled %q. Permanent? %v", addr, label, permanent)
+	muWhitelist.Lock()
+	defer muWhitelist.Unlock()
+	host := hostOnly(addr)
+	e := whitelist[host]
+	e.permanent = permanent
+	e.provisional = false
+	e.label = label
+	e.added = time.Now()
+	putWl(host, e)
+	whitelistResolvedIPs(host)
+}
+
+// AddToWlForNetwork is like AddToWl but the entry only applies to the given
+// network, e.g. to detour TCP but not UDP to a domain. "tcp4" and "tcp6" are
+// the same as "tcp", so do the "udp" ones.
+func AddToWlForNetwork(addr string, network string, permanent bool) {
+	log.Tracef("Adding %v to whitelist for %v. Permanent? %v", addr, network, permanent)
+	muWhitelist.Lock()
+	defer muWhitelist.Unlock()
+	host := hostOnly(addr)
+	e := whitelist[host]
+	e.permanent = permanent
+	e.network = baseNetwork(network)
+	e.added = time.Now()
+	putWl(host, e)
+	whitelistResolvedIPs(host)
+}
+
+// AddToWlWithDialer is like AddToWl but binds the whitelisted domain to a
+// specific detour dialer, e.g. when only a particular proxy can reach it. A
+// nil dialer falls back to the one passed to Dialer(). An existing entry keeps
+// its network, label and whether it's provisional, and is only made permanent
+// rather than temporary.
+func AddToWlWithDialer(addr string, permanent bool, d dialFunc) {
+	log.Tracef("Adding %v to whitelist with dialer. Permanent? %v", addr, permanent)
+	muWhitelist.Lock()
+	defer muWhitelist.Unlock()
+	host := hostOnly(addr)
+	e, ok := whitelist[host]
+	if !ok {
+		e.added = time.Now()
+	}
+	if permanent && !e.permanent {
+		e.permanent = true
+		e.provisional = false
+	}
+	e.dialer = d
+	putWl(host, e)
+	whitelistResolvedIPs(host)
+}
+
+// SetMaxTemporaryEntries caps the number of temporary whitelist entries. Once
+// exceeded, the least recently added or matched ones are evicted. Permanent
+// and force whitelisted entries are exempt. 0 means no limit. Defaults to
+// 10000.
+func SetMaxTemporaryEntries(n int) {
+	UpdateConfig(func(c Config) Config {
+		c.MaxTemporaryEntries = n
+		return c
+	})
+}
+
+// SetMaxTemporaryEntriesPerDomain caps the number of temporary whitelist
+// entries under the same registered domain (eTLD+1), e.g. a.example.com and
+// b.example.com, so that one domain's many subdomains don't crowd out other
+// sites. Once exceeded, the least recently used ones in the domain are
+// evicted. 0, the default, means no limit.
+func SetMaxTemporaryEntriesPerDomain(n int) {
+	UpdateConfig(func(c Config) Config {
+		c.MaxTemporaryEntriesPerDomain = n
+		return c
+	})
+}
+
+// SetTemporaryEntryTTL sets for how long a temporary whitelist entry lasts
+// after added. Expired entries are no longer matched, and are removed by the
+// janitor started by StartCleanup(), if any. 0, the default, means they never
+// expire.
+func SetTemporaryEntryTTL(ttl time.Duration) {
+	UpdateConfig(func(c Config) Config {
+		c.TemporaryEntryTTL = ttl
+		return c
+	})
+}
+
+// putWl stores the entry as just used, evicting the least recently used
+// temporary entries if there are too many. The caller should hold muWhitelist.
+func putWl(host string, e wlEntry) {
+	if e.lastUsed == nil {
+		e.lastUsed = new(int64)
+	}
+	e.touch()
+	untrackTemporary(host)
+	if !e.permanent {
+		evictTemporary(host)
+	}
+	whitelist[host] = e
+	trackTemporary(host, e)
+	updateWlHighWaterMark()
+}
+
+// evictTemporary evicts the least recently used temporary entries to make
+// room for host, which shouldn't be in the temporary LRUs. The caller should
+// hold muWhitelist.
+func evictTemporary(host string) {
+	cfg := currentConfig()
+	if max := cfg.MaxTemporaryEntriesPerDomain; max > 0 {
+		domain := registeredDomain(host)
+		if byDomain := temporaryLRUByDomain[domain]; byDomain != nil {
+			evictLRU(byDomain, max-1, " in "+domain)
+		}
+	}
+	if max := cfg.MaxTemporaryEntries; max > 0 {
+		evictLRU(temporaryLRU, max-1, "")
+	}
+}
+
+// evictLRU evicts the least recently used entries in l until there are at most
+// max of them. The caller should hold muWhitelist.
+func evictLRU(l *tempLRU, max int, scope string) {
+	for l.Len() > max {
+		oldest := l.oldest()
+		log.Debugf("Too many temporary whitelist entries%s, evicting %v", scope, oldest)
+		deleteWl(oldest)
+		evicted(oldest, EvictLRU)
+	}
+}
+
+// deleteWl removes host from whitelist along with the IPs resolved from it.
+// The caller should hold muWhitelist.
+func deleteWl(host string) {
+	delete(whitelist, host)
+	removeResolvedIPs(host)
+	untrackTemporary(host)
+}
+
+// registeredDomain returns the eTLD+1 of host, or host itself if it has none,
+// e.g. an IP address.
+func registeredDomain(host string) string {
+	if domain, err := publicsuffix.EffectiveTLDPlusOne(host); err == nil {
+		return domain
+	}
+	return host
+}
+
+// PromoteToPermanent makes a temporary whitelist entry permanent, e.g. when
+// the user confirms the site is really blocked, which also confirms a
+// provisional entry. The whitelist store set by SetWhitelistStore() is updated
+// as well. It returns whether the entry was found and promoted.
+func PromoteToPermanent(addr string) bool {
+	host := hostOnly(addr)
+	muWhitelist.Lock()
+	e, ok := whitelist[host]
+	if !ok || e.permanent {
+		muWhitelist.Unlock()
+		return false
+	}
+	log.Tracef("Promoting %v to permanent whitelist", addr)
+	e.permanent = true
+	e.provisional = false
+	whitelist[host] = e
+	untrackTemporary(host)
+	muWhitelist.Unlock()
+	storeAdd(currentConfig(), host, true)
+	return true
 }
 
 func RemoveFromWl(addr string) {
 	log.Tracef("Removing %v from whitelist.", addr)
 	muWhitelist.Lock()
 	defer muWhitelist.Unlock()
-	delete(whitelist, hostOnly(addr))
+	host := hostOnly(addr)
+	if _, ok := whitelist[host]; !ok {
+		return
+	}
+	deleteWl(host)
+	evicted(host, EvictRemoved)
 }
 
 func DumpWhitelist() (wl []string) {
@@ -51,24 +302,333 @@ func DumpWhitelist() (wl []string) {
 	return
 }
 
-func whitelisted(_addr string) (in bool) {
+// WhitelistStatus is the status of a host in whitelist.
+type WhitelistStatus int
+
+const (
+	NotWhitelisted WhitelistStatus = iota
+	WhitelistedTemporarily
+	WhitelistedPermanently
+	ForceWhitelisted
+)
+
+// WhitelistSnapshot returns the status of all hosts in whitelist, including
+// the force whitelisted ones.
+func WhitelistSnapshot() map[string]WhitelistStatus {
 	muWhitelist.RLock()
 	defer muWhitelist.RUnlock()
-	log.Tracef("Checking if %v is whitelisted", _addr)
-	for addr := hostOnly(_addr); addr != ""; addr = getParentDomain(addr) {
+	snapshot := make(map[string]WhitelistStatus, len(whitelist)+len(forceWhitelist))
+	for host, e := range whitelist {
+		if e.permanent {
+			snapshot[host] = WhitelistedPermanently
+		} else {
+			snapshot[host] = WhitelistedTemporarily
+		}
+	}
+	for host := range forceWhitelist {
+		snapshot[host] = ForceWhitelisted
+	}
+	return snapshot
+}
+
+// WhitelistEntry is a host in whitelist, see DumpWhitelistEntries().
+type WhitelistEntry struct {
+	Host   string
+	Status WhitelistStatus
+	// Label is the label attached by AddToWlLabeled(), if any.
+	Label string
+}
+
+// DumpWhitelistEntries returns all hosts in whitelist, including the force
+// whitelisted ones, along with their status and label, sorted by host.
+func DumpWhitelistEntries() []WhitelistEntry {
+	muWhitelist.RLock()
+	entries := make([]WhitelistEntry, 0, len(whitelist)+len(forceWhitelist))
+	for host, e := range whitelist {
+		if _, ok := forceWhitelist[host]; ok {
+			continue
+		}
+		status := WhitelistedTemporarily
+		if e.permanent {
+			status = WhitelistedPermanently
+		}
+		entries = append(entries, WhitelistEntry{host, status, e.label})
+	}
+	for host, e := range forceWhitelist {
+		entries = append(entries, WhitelistEntry{host, ForceWhitelisted, e.label})
+	}
+	muWhitelist.RUnlock()
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Host < entries[j].Host
+	})
+	return entries
+}
+
+// MergeWhitelist applies the entries of another snapshot, e.g. from another
+// instance, on top of the whitelist. On conflicts the stronger status wins, so
+// a temporary entry never downgrades a permanent one but is upgraded by it.
+func MergeWhitelist(other map[string]WhitelistStatus) {
+	log.Tracef("Merging %d entries to whitelist", len(other))
+	muWhitelist.Lock()
+	defer muWhitelist.Unlock()
+	now := time.Now()
+	for addr, status := range other {
+		host := hostOnly(addr)
+		switch status {
+		case ForceWhitelisted:
+			forceWhitelist[host] = wlEntry{permanent: true}
+		case WhitelistedPermanently:
+			// keep the dialer and network if already set
+			e := whitelist[host]
+			e.permanent = true
+			e.added = now
+			putWl(host, e)
+		case WhitelistedTemporarily:
+			if _, ok := whitelist[host]; !ok {
+				putWl(host, wlEntry{added: now})
+			}
+		}
+	}
+	updateWlHighWaterMark()
+}
+
+// ReplaceWhitelist replaces the whole whitelist with entries at once, e.g. when
+// reloading config, so lookups see either the old or the new whitelist but
+// never a mix or an empty one in between. Force whitelisted entries are kept
+// unless entries include the same hosts. Entries kept from the old whitelist
+// keep their dialers, networks and labels.
+func ReplaceWhitelist(entries map[string]WhitelistStatus) {
+	log.Debugf("Replacing whitelist with %d entries", len(entries))
+	muWhitelist.Lock()
+	defer muWhitelist.Unlock()
+	now := time.Now()
+	newWhitelist := make(map[string]wlEntry, len(entries))
+	newForceWhitelist := make(map[string]wlEntry, len(forceWhitelist))
+	for host, e := range forceWhitelist {
+		newForceWhitelist[host] = e
+	}
+	for addr, status := range entries {
+		host := hostOnly(addr)
+		delete(newForceWhitelist, host)
+		switch status {
+		case ForceWhitelisted:
+			newForceWhitelist[host] = wlEntry{permanent: true}
+		case WhitelistedPermanently, WhitelistedTemporarily:
+			old := whitelist[host]
+			e := wlEntry{
+				permanent: status == WhitelistedPermanently,
+				dialer:    old.dialer,
+				network:   old.network,
+				label:     old.label,
+				added:     now,
+				lastUsed:  new(int64),
+			}
+			e.touch()
+			newWhitelist[host] = e
+		}
+	}
+	for host := range whitelist {
+		if _, ok := newWhitelist[host]; !ok {
+			evicted(host, EvictRemoved)
+		}
+	}
+	whitelist, forceWhitelist = newWhitelist, newForceWhitelist
+	rebuildTemporaryLRU()
+	for ip, e := range resolvedIPs {
+		if _, ok := whitelist[e.host]; !ok {
+			delete(resolvedIPs, ip)
+		}
+	}
+	updateWlHighWaterMark()
+}
+
+// WhitelistSize returns the number of permanent, temporary and force
+// whitelisted entries.
+func WhitelistSize() (permanent, temporary, force int) {
+	muWhitelist.RLock()
+	defer muWhitelist.RUnlock()
+	for _, e := range whitelist {
+		if e.permanent {
+			permanent++
+		} else {
+			temporary++
+		}
+	}
+	return permanent, temporary, len(forceWhitelist)
+}
+
+// WhitelistHighWaterMark returns the most entries the whitelist, including
+// force whitelisted ones, ever had.
+func WhitelistHighWaterMark() int {
+	muWhitelist.RLock()
+	defer muWhitelist.RUnlock()
+	return wlHighWaterMark
+}
+
+// updateWlHighWaterMark should be called with muWhitelist held after adding
+// entries.
+func updateWlHighWaterMark() {
+	if n := len(whitelist) + len(forceWhitelist); n > wlHighWaterMark {
+		wlHighWaterMark = n
+	}
+}
+
+func whitelisted(addr string) bool {
+	return whitelistedFor("", addr)
+}
+
+// Ways a whitelist lookup matches, see SetLookupTracer().
+const (
+	LookupExact      = "exact"
+	LookupParent     = "parent"
+	LookupForce      = "force"
+	LookupResolvedIP = "resolved ip"
+	LookupStore      = "store"
+)
+
+// SetLookupTracer sets a function called on each whitelist lookup with the
+// queried host, the key in whitelist which matched it and how it matched, one
+// of LookupExact, LookupParent, LookupForce, LookupResolvedIP and LookupStore,
+// or both empty if not matched. It's for debugging why a host is or isn't
+// matched. Pass nil to remove it.
+func SetLookupTracer(trace func(queried string, matchedKey string, via string)) {
+	UpdateConfig(func(c Config) Config {
+		c.LookupTracer = trace
+		return c
+	})
+}
+
+// whitelistedFor checks if addr is whitelisted for the network, empty network
+// means any network.
+func whitelistedFor(network string, addr string) bool {
+	cfg := currentConfig()
+	return whitelistedIn(cfg, network, addr, func() WhitelistStatus {
+		return storeStatus(cfg, addr)
+	})
+}
+
+// whitelistedIn is whitelistedFor with cfg, looking up addr in the whitelist
+// store by inStore if not in the local whitelist.
+func whitelistedIn(cfg *Config, network string, addr string, inStore func() WhitelistStatus) bool {
+	key, via := lookupWl(network, addr, cfg.TemporaryEntryTTL)
+	if via == "" && inStore() != NotWhitelisted {
+		log.Tracef("%v is whitelisted in whitelist store", addr)
+		key, via = hostOnly(addr), LookupStore
+	}
+	if trace := cfg.LookupTracer; trace != nil {
+		trace(hostOnly(addr), key, via)
+	}
+	return via != ""
+}
+
+// whitelisted checks if the connection's address is whitelisted for its
+// network, looking it up in the whitelist store at most once per dial.
+func (dc *Conn) whitelisted() bool {
+	return whitelistedIn(dc.cfg, dc.network, dc.addr, func() WhitelistStatus {
+		if !dc.storeLooked {
+			dc.storeLooked = true
+			dc.inStore = storeStatus(dc.cfg, dc.addr)
+		}
+		return dc.inStore
+	})
+}
+
+// lookupWl returns the key in whitelist which matches addr for the network and
+// how it matches, or empty strings if not matched.
+func lookupWl(network string, _addr string, ttl time.Duration) (key string, via string) {
+	muWhitelist.RLock()
+	defer muWhitelist.RUnlock()
+	return lookupWlLocked(network, _addr, ttl)
+}
+
+// lookupWlLocked is lookupWl with muWhitelist held by the caller.
+func lookupWlLocked(network string, _addr string, ttl time.Duration) (key string, via string) {
+	log.Tracef("Checking if %v is whitelisted for %v", _addr, network)
+	var now time.Time
+	if ttl > 0 {
+		now = time.Now()
+	}
+	host := hostOnly(_addr)
+	for addr := host; addr != ""; addr = getParentDomain(addr) {
 		_, forced := forceWhitelist[addr]
 		if forced {
 			log.Tracef("%v is force whitelisted as %v", _addr, addr)
-			return true
+			return addr, LookupForce
 		}
-		_, whitelisted := whitelist[addr]
-		if whitelisted {
+		e, whitelisted := whitelist[addr]
+		if whitelisted && e.matches(network) && !e.expired(ttl, now) {
 			log.Tracef("%v is whitelisted as %v", _addr, addr)
-			return true
+			e.touch()
+			if addr == host {
+				return addr, LookupExact
+			}
+			return addr, LookupParent
 		}
 	}
+	if resolvedIPWhitelisted(_addr) {
+		log.Tracef("%v is resolved from a whitelisted host", _addr)
+		return host, LookupResolvedIP
+	}
 	log.Tracef("%v is not whitelisted", _addr)
-	return
+	return "", ""
+}
+
+// wlDialer returns the detour dialer bound to addr or its closest parent
+// domain in the whitelist, or nil if there isn't one.
+func wlDialer(_addr string) dialFunc {
+	muWhitelist.RLock()
+	defer muWhitelist.RUnlock()
+	for addr := hostOnly(_addr); addr != ""; addr = getParentDomain(addr) {
+		if e, ok := whitelist[addr]; ok && e.dialer != nil {
+			return e.dialer
+		}
+	}
+	return nil
+}
+
+// InvalidateHost makes the next dial to addr or its subdomains try direct
+// connection with detection again even if whitelisted, e.g. after switching
+// networks. If the site is no longer blocked, its temporary whitelist entry is
+// removed, but permanent entries are always kept. Force whitelisted hosts are
+// not affected.
+func InvalidateHost(addr string) {
+	log.Tracef("Invalidating %v", addr)
+	muWhitelist.Lock()
+	defer muWhitelist.Unlock()
+	invalidatedHosts[hostOnly(addr)] = true
+}
+
+// consumeInvalidation checks if addr or any of its parent domains is
+// invalidated and clears it so only one dial detects again.
+func consumeInvalidation(_addr string) bool {
+	muWhitelist.RLock()
+	none := len(invalidatedHosts) == 0
+	muWhitelist.RUnlock()
+	if none {
+		return false
+	}
+	muWhitelist.Lock()
+	defer muWhitelist.Unlock()
+	for addr := hostOnly(_addr); addr != ""; addr = getParentDomain(addr) {
+		if _, forced := forceWhitelist[addr]; forced {
+			return false
+		}
+	}
+	for addr := hostOnly(_addr); addr != ""; addr = getParentDomain(addr) {
+		if invalidatedHosts[addr] {
+			delete(invalidatedHosts, addr)
+			log.Debugf("%v is invalidated as %v, detect again", _addr, addr)
+			return true
+		}
+	}
+	return false
+}
+
+func wlPermanently(addr string) bool {
+	muWhitelist.RLock()
+	defer muWhitelist.RUnlock()
+	p, ok := whitelist[hostOnly(addr)]
+	return ok && p.permanent
 }
 
 func wlTemporarily(addr string) bool {
@@ -79,6 +639,10 @@ func wlTemporarily(addr string) bool {
 	return ok && p.permanent == false
 }
 
+func baseNetwork(network string) string {
+	return strings.TrimRight(network, "46")
+}
+
 func getParentDomain(addr string) string {
 	parts := strings.SplitN(addr, ".", 2)
 	if len(parts) < 2 {
@@ -87,10 +651,29 @@ func getParentDomain(addr string) string {
 	return parts[1]
 }
 
+// SetHostNormalizer sets the function to normalize host names with before
+// adding them to or looking them up in whitelist and domain lists, e.g. to fold
+// IDN hosts to punycode. Pass nil to restore the default, which lowercases and
+// trims spaces.
+func SetHostNormalizer(normalize func(host string) string) {
+	UpdateConfig(func(c Config) Config {
+		c.HostNormalizer = normalize
+		return c
+	})
+}
+
+func defaultHostNormalizer(host string) string {
+	return strings.ToLower(strings.TrimSpace(host))
+}
+
+// hostOnly strips the port, if any, from addr and normalizes the host.
 func hostOnly(addr string) string {
 	host, _, err := net.SplitHostPort(addr)
 	if err != nil {
 		host = addr
 	}
-	return host
+	if normalize := currentConfig().HostNormalizer; normalize != nil {
+		return normalize(host)
+	}
+	return defaultHostNormalizer(host)
 }
@@ -1,6 +1,9 @@
 package detour
 
 import (
+	"fmt"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -19,3 +22,319 @@ func TestDumpWhiteList(t *testing.T) {
 	assert.Contains(t, dumped, "a.com", "dumped list should contain permanent items")
 	assert.NotContains(t, dumped, "b.com", "dumped list should not contain temporary items")
 }
+
+func TestPromoteToPermanent(t *testing.T) {
+	defer RemoveFromWl("promoted.com")
+	defer RemoveFromWl("provisional.promoted.com")
+	assert.False(t, PromoteToPermanent("promoted.com:80"), "should not promote missing entry")
+	AddToWl("promoted.com:80", false)
+	assert.NotContains(t, DumpWhitelist(), "promoted.com")
+	assert.True(t, PromoteToPermanent("promoted.com:443"), "should promote temporary entry")
+	assert.False(t, wlTemporarily("promoted.com:80"))
+	assert.Contains(t, DumpWhitelist(), "promoted.com", "dumped list should contain promoted entry")
+	assert.False(t, PromoteToPermanent("promoted.com:80"), "should not promote permanent entry again")
+
+	store := &mapStore{statuses: make(map[string]WhitelistStatus)}
+	SetWhitelistStore(store)
+	defer SetWhitelistStore(nil)
+	addProvisionally("provisional.promoted.com:80")
+	assert.True(t, PromoteToPermanent("provisional.promoted.com:80"))
+	assert.False(t, WhitelistedProvisionally("provisional.promoted.com:80"), "should confirm provisional entry")
+	status, _ := store.Status("provisional.promoted.com")
+	assert.Equal(t, WhitelistedPermanently, status, "should add to the whitelist store")
+}
+
+func TestWhitelistForNetwork(t *testing.T) {
+	defer RemoveFromWl("scoped.com")
+	defer RemoveFromWl("unscoped.com")
+	AddToWlForNetwork("scoped.com:443", "tcp", false)
+	assert.True(t, whitelistedFor("tcp", "scoped.com:443"))
+	assert.True(t, whitelistedFor("tcp6", "www.scoped.com:443"), "should match tcp6 and subdomains")
+	assert.False(t, whitelistedFor("udp", "scoped.com:443"), "should not match other network")
+	assert.True(t, whitelisted("scoped.com:443"), "should match if network is not specified")
+	AddToWl("scoped.com:443", true)
+	assert.False(t, whitelistedFor("udp", "scoped.com:443"), "should keep the network when updated")
+
+	AddToWl("unscoped.com:443", false)
+	assert.True(t, whitelistedFor("tcp", "unscoped.com:443"))
+	assert.True(t, whitelistedFor("udp4", "unscoped.com:443"), "unscoped entry should match all networks")
+}
+
+func TestMergeWhitelist(t *testing.T) {
+	defer RemoveFromWl("merged.com")
+	defer RemoveFromWl("kept.com")
+	defer RemoveFromWl("added.com")
+	defer func() {
+		muWhitelist.Lock()
+		delete(forceWhitelist, "forced.com")
+		muWhitelist.Unlock()
+	}()
+	AddToWl("merged.com:80", false)
+	AddToWl("kept.com:80", true)
+
+	MergeWhitelist(map[string]WhitelistStatus{
+		"merged.com": WhitelistedPermanently,
+		"kept.com":   WhitelistedTemporarily,
+		"added.com":  WhitelistedTemporarily,
+		"forced.com": ForceWhitelisted,
+	})
+	snapshot := WhitelistSnapshot()
+	assert.Equal(t, WhitelistedPermanently, snapshot["merged.com"], "permanent should take precedence over temporary")
+	assert.Equal(t, WhitelistedPermanently, snapshot["kept.com"], "temporary should not downgrade permanent")
+	assert.Equal(t, WhitelistedTemporarily, snapshot["added.com"])
+	assert.Equal(t, ForceWhitelisted, snapshot["forced.com"])
+	assert.True(t, whitelisted("www.forced.com:443"))
+}
+
+func TestHostNormalizer(t *testing.T) {
+	defer RemoveFromWl("xn--bcher-kva.example")
+	defer SetHostNormalizer(nil)
+	AddToWl("Mixed.Example:80", false)
+	assert.True(t, whitelisted("mixed.example:443"), "should lowercase by default")
+	RemoveFromWl("MIXED.example")
+	assert.False(t, whitelisted("mixed.example:443"))
+
+	SetHostNormalizer(func(host string) string {
+		// a minimal IDN folding for the test
+		return strings.Replace(strings.ToLower(host), "bücher", "xn--bcher-kva", 1)
+	})
+	AddToWl("bücher.example:80", false)
+	assert.True(t, whitelisted("xn--bcher-kva.example:443"), "punycode form should match the IDN entry")
+	assert.True(t, whitelisted("www.BÜCHER.example:443"), "IDN form should match as well")
+	assert.Contains(t, WhitelistSnapshot(), "xn--bcher-kva.example", "should store the normalized form")
+}
+
+func TestWhitelistSize(t *testing.T) {
+	defer RemoveFromWl("size-permanent.com")
+	defer RemoveFromWl("size-temporary1.com")
+	defer RemoveFromWl("size-temporary2.com")
+	defer func() {
+		muWhitelist.Lock()
+		delete(forceWhitelist, "size-forced.com")
+		muWhitelist.Unlock()
+	}()
+	permanent, temporary, force := WhitelistSize()
+	AddToWl("size-permanent.com:80", true)
+	AddToWl("size-temporary1.com:80", false)
+	AddToWl("size-temporary2.com:80", false)
+	AddToWl("size-temporary2.com:443", false)
+	ForceWhitelist("size-forced.com:80")
+	p, tmp, f := WhitelistSize()
+	assert.Equal(t, permanent+1, p)
+	assert.Equal(t, temporary+2, tmp, "should count the same host only once")
+	assert.Equal(t, force+1, f)
+
+	highWaterMark := WhitelistHighWaterMark()
+	assert.True(t, highWaterMark >= p+tmp+f)
+	RemoveFromWl("size-temporary1.com")
+	_, tmp, _ = WhitelistSize()
+	assert.Equal(t, temporary+1, tmp)
+	assert.Equal(t, highWaterMark, WhitelistHighWaterMark(), "high-water mark should not drop on removal")
+}
+
+func TestEvictTemporaryEntries(t *testing.T) {
+	defer RestoreState(SaveState())
+	muWhitelist.Lock()
+	whitelist = make(map[string]wlEntry)
+	rebuildTemporaryLRU()
+	muWhitelist.Unlock()
+	SetMaxTemporaryEntries(2)
+	defer SetMaxTemporaryEntries(10000)
+
+	AddToWl("permanent.com:80", true)
+	AddToWl("oldest.com:80", false)
+	AddToWl("older.com:80", false)
+	AddToWl("newer.com:80", false)
+	assert.False(t, whitelisted("oldest.com:80"), "should evict the oldest temporary entry")
+	assert.True(t, whitelisted("permanent.com:80"), "should not evict permanent entry")
+
+	// older.com is now used more recently than newer.com
+	assert.True(t, whitelisted("www.older.com:80"))
+	AddToWl("newest.com:80", false)
+	assert.False(t, whitelisted("newer.com:80"), "should evict the least recently used temporary entry")
+	assert.True(t, whitelisted("older.com:80"))
+	assert.True(t, whitelisted("newest.com:80"))
+	_, temporary, _ := WhitelistSize()
+	assert.Equal(t, 2, temporary)
+}
+
+func TestMaxTemporaryEntriesPerDomain(t *testing.T) {
+	defer RestoreState(SaveState())
+	muWhitelist.Lock()
+	whitelist = make(map[string]wlEntry)
+	rebuildTemporaryLRU()
+	muWhitelist.Unlock()
+	SetMaxTemporaryEntriesPerDomain(3)
+	defer SetMaxTemporaryEntriesPerDomain(0)
+
+	AddToWl("example.co.uk:443", true)
+	AddToWl("other.co.uk:443", false)
+	for i := 0; i < 10; i++ {
+		AddToWl(fmt.Sprintf("s%d.example.co.uk:443", i), false)
+	}
+	for i := 0; i < 7; i++ {
+		assert.False(t, wlTemporarily(fmt.Sprintf("s%d.example.co.uk", i)), "should evict the oldest subdomains")
+	}
+	for i := 7; i < 10; i++ {
+		assert.True(t, wlTemporarily(fmt.Sprintf("s%d.example.co.uk", i)))
+	}
+	assert.True(t, wlTemporarily("other.co.uk"), "should not count other domains under the same public suffix")
+	assert.True(t, wlPermanently("example.co.uk"), "should not evict permanent entry")
+	_, temporary, _ := WhitelistSize()
+	assert.Equal(t, 4, temporary)
+}
+
+func TestTemporaryLRUInSync(t *testing.T) {
+	defer RestoreState(SaveState())
+	SetMaxTemporaryEntries(6)
+	SetMaxTemporaryEntriesPerDomain(2)
+
+	for i := 0; i < 5; i++ {
+		AddToWl(fmt.Sprintf("s%d.lru.com:443", i), false)
+		AddToWl(fmt.Sprintf("lru%d.com:443", i), false)
+	}
+	AddToWl("lru4.com:443", true)
+	PromoteToPermanent("lru3.com")
+	RemoveFromWl("s4.lru.com")
+	muWhitelist.RLock()
+	defer muWhitelist.RUnlock()
+	temporary := 0
+	for _, e := range whitelist {
+		if !e.permanent {
+			temporary++
+		}
+	}
+	assert.Equal(t, temporary, temporaryLRU.Len(), "should count temporary entries")
+	assert.Equal(t, 1, temporaryLRUByDomain["lru.com"].Len(), "should count temporary entries by domain")
+	assert.False(t, wlTemporarily("lru0.com"), "should evict the least recently used entry")
+}
+
+func TestAddManyToWl(t *testing.T) {
+	defer RemoveFromWl("many1.com")
+	defer RemoveFromWl("many2.com")
+	AddManyToWl([]string{"many1.com:80", "many2.com:443"}, true)
+	assert.True(t, whitelisted("www.many1.com:80"))
+	assert.True(t, whitelisted("many2.com:80"))
+	assert.Contains(t, DumpWhitelist(), "many2.com")
+}
+
+func bulkAddrs(n int) []string {
+	addrs := make([]string, n)
+	for i := range addrs {
+		addrs[i] = fmt.Sprintf("bulk%d.com:443", i)
+	}
+	return addrs
+}
+
+func removeBulkAddrs(addrs []string) {
+	for _, addr := range addrs {
+		RemoveFromWl(addr)
+	}
+}
+
+func BenchmarkAddToWlOneByOne(b *testing.B) {
+	addrs := bulkAddrs(1000)
+	defer removeBulkAddrs(addrs)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, addr := range addrs {
+			AddToWl(addr, true)
+		}
+	}
+}
+
+func BenchmarkAddManyToWl(b *testing.B) {
+	addrs := bulkAddrs(1000)
+	defer removeBulkAddrs(addrs)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		AddManyToWl(addrs, true)
+	}
+}
+
+func TestReplaceWhitelist(t *testing.T) {
+	muWhitelist.Lock()
+	orig, origForce := whitelist, forceWhitelist
+	whitelist, forceWhitelist = make(map[string]wlEntry), make(map[string]wlEntry)
+	muWhitelist.Unlock()
+	defer func() {
+		muWhitelist.Lock()
+		whitelist, forceWhitelist = orig, origForce
+		muWhitelist.Unlock()
+	}()
+
+	ForceWhitelist("kept-forced.com")
+	ForceWhitelist("overridden-forced.com")
+	AddToWl("old.com", true)
+	setA := make(map[string]WhitelistStatus)
+	setB := make(map[string]WhitelistStatus)
+	for i := 0; i < 50; i++ {
+		setA[fmt.Sprintf("a%d.com", i)] = WhitelistedPermanently
+		setB[fmt.Sprintf("b%d.com", i)] = WhitelistedTemporarily
+	}
+	setB["overridden-forced.com"] = WhitelistedTemporarily
+	ReplaceWhitelist(setA)
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if i%2 == 0 {
+				ReplaceWhitelist(setA)
+			} else {
+				ReplaceWhitelist(setB)
+			}
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		snapshot := WhitelistSnapshot()
+		_, inA := snapshot["a0.com"]
+		_, inB := snapshot["b0.com"]
+		if !assert.True(t, inA != inB, "should see either set, not both or neither") {
+			break
+		}
+		for j := 0; j < 50; j++ {
+			_, a := snapshot[fmt.Sprintf("a%d.com", j)]
+			_, b := snapshot[fmt.Sprintf("b%d.com", j)]
+			if !assert.True(t, a == inA && b == inB, "should never see a partially applied set") {
+				break
+			}
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	ReplaceWhitelist(setB)
+	snapshot := WhitelistSnapshot()
+	assert.Len(t, snapshot, 52)
+	assert.NotContains(t, snapshot, "old.com", "should drop entries not in the new set")
+	assert.Equal(t, ForceWhitelisted, snapshot["kept-forced.com"], "should keep force entries")
+	assert.Equal(t, WhitelistedTemporarily, snapshot["overridden-forced.com"], "new set should override force entries")
+}
+
+func TestLookupTracer(t *testing.T) {
+	type lookup struct{ queried, key, via string }
+	var lookups []lookup
+	SetLookupTracer(func(queried string, matchedKey string, via string) {
+		lookups = append(lookups, lookup{queried, matchedKey, via})
+	})
+	defer SetLookupTracer(nil)
+	AddToWl("traced.example.com", false)
+	defer RemoveFromWl("traced.example.com")
+
+	assert.True(t, whitelisted("www.Traced.example.com:443"))
+	assert.True(t, whitelisted("traced.example.com"))
+	assert.False(t, whitelisted("untraced.example.com"))
+	assert.Equal(t, []lookup{
+		{"www.traced.example.com", "traced.example.com", LookupParent},
+		{"traced.example.com", "traced.example.com", LookupExact},
+		{"untraced.example.com", "", ""},
+	}, lookups)
+}